@@ -0,0 +1,173 @@
+package s3
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+	datastore "github.com/ipfs/go-datastore"
+)
+
+// maxDeleteObjects is the largest number of keys S3 accepts in a single DeleteObjects request
+const maxDeleteObjects = 1000
+
+// Batch buffers puts and deletes, deferring all writes to S3 until Commit is called
+type Batch struct {
+	ds      *Datastore
+	puts    map[datastore.Key][]byte
+	deletes map[datastore.Key]struct{}
+}
+
+// assert *Batch satisfies datastore.Batch interface at compile time
+var _ datastore.Batch = (*Batch)(nil)
+
+// newBatch creates an empty batch for a datastore
+func newBatch(ds *Datastore) *Batch {
+	return &Batch{
+		ds:      ds,
+		puts:    map[datastore.Key][]byte{},
+		deletes: map[datastore.Key]struct{}{},
+	}
+}
+
+// Put adds a value to the batch, replacing any pending operation on key
+func (b *Batch) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	if b.ds.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := validKey(key); err != nil {
+		return err
+	}
+
+	delete(b.deletes, key)
+	b.puts[key] = value
+	return nil
+}
+
+// Delete adds a key removal to the batch, replacing any pending operation on key
+func (b *Batch) Delete(ctx context.Context, key datastore.Key) error {
+	if b.ds.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := validKey(key); err != nil {
+		return err
+	}
+
+	delete(b.puts, key)
+	b.deletes[key] = struct{}{}
+	return nil
+}
+
+// Commit writes all pending operations to the store. Puts are written concurrently,
+// deletes are flushed with DeleteObjects in chunks of up to 1000 keys. Nothing is
+// written to S3 until Commit is called. Unlike Datastore.Delete, deleting a key that
+// doesn't exist is not an error
+func (b *Batch) Commit(ctx context.Context) error {
+	if err := b.commitPuts(ctx); err != nil {
+		return err
+	}
+
+	keys := make([]datastore.Key, 0, len(b.deletes))
+	for key := range b.deletes {
+		keys = append(keys, key)
+	}
+	if err := b.ds.deleteObjects(ctx, keys); err != nil {
+		return err
+	}
+	b.deletes = map[datastore.Key]struct{}{}
+
+	return nil
+}
+
+// Flush writes the operations buffered so far like Commit, leaving the batch open for
+// more operations. Flushing periodically bounds the memory used by large batches, at the
+// cost of the flushed operations being visible before the batch is committed
+func (b *Batch) Flush(ctx context.Context) error {
+	return b.Commit(ctx)
+}
+
+// commitPuts writes pending puts concurrently, removing each successful put from the
+// batch. The first error encountered is returned
+func (b *Batch) commitPuts(ctx context.Context) error {
+	errs := b.ds.putMany(ctx, b.puts)
+	for key := range b.puts {
+		if _, failed := errs[key]; !failed {
+			delete(b.puts, key)
+		}
+	}
+	for _, err := range errs {
+		return err
+	}
+	return nil
+}
+
+// deleteObjects removes keys from the store with as few DeleteObjects requests as possible.
+// Invalid keys and keys S3 fails to delete are reported with KeyErrors once every chunk
+// has been sent
+func (ds *Datastore) deleteObjects(ctx context.Context, keys []datastore.Key) error {
+	errs := KeyErrors{}
+	valid := make([]datastore.Key, 0, len(keys))
+	for _, key := range keys {
+		if err := validKey(key); err != nil {
+			errs[key] = err
+			continue
+		}
+		valid = append(valid, key)
+	}
+	keys = valid
+
+	if ds.dryRun {
+		for _, key := range keys {
+			ds.logDryRun("Delete", key)
+		}
+		if len(errs) > 0 {
+			return errs
+		}
+		return nil
+	}
+
+	c, err := ds.client()
+	if err != nil {
+		return err
+	}
+
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxDeleteObjects {
+			n = maxDeleteObjects
+		}
+
+		objs := make([]*awsS3.ObjectIdentifier, n)
+		for i, key := range keys[:n] {
+			objs[i] = &awsS3.ObjectIdentifier{Key: aws.String(ds.path(key))}
+		}
+
+		reqCtx, cancel := ds.withTimeout(ctx)
+		res, err := c.DeleteObjectsWithContext(reqCtx, &awsS3.DeleteObjectsInput{
+			Bucket:       aws.String(ds.Bucket),
+			RequestPayer: ds.requestPayer(),
+			Delete: &awsS3.Delete{
+				Objects: objs,
+				// only report errors in the response
+				Quiet: aws.Bool(true),
+			},
+		})
+		cancel()
+		if err != nil {
+			return ctxErr(reqCtx, err)
+		}
+		for _, e := range res.Errors {
+			errs[ds.key(aws.StringValue(e.Key))] = awserr.New(aws.StringValue(e.Code), aws.StringValue(e.Message), nil)
+		}
+
+		keys = keys[n:]
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
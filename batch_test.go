@@ -0,0 +1,144 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func TestBatchPutDeferred(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newMockDS()
+
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range testcases {
+		if err := b.Put(ctx, ds.NewKey("/batch/put"+k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := d.Get(ctx, ds.NewKey("/batch/put/a")); err != ds.ErrNotFound {
+		t.Fatalf("expected batched put to be invisible before commit. expected: %s, got: %v", ds.ErrNotFound, err)
+	}
+
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range testcases {
+		got, err := d.Get(ctx, ds.NewKey("/batch/put"+k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != v {
+			t.Errorf("%s values differ: '%s' != '%s'", k, v, got)
+		}
+	}
+}
+
+func TestBatchDeleteChunks(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
+
+	// seed more keys than fit in a single DeleteObjects request
+	keys := map[string]string{}
+	for i := 0; i < maxDeleteObjects+100; i++ {
+		keys[fmt.Sprintf("/batch/delete/%04d", i)] = "delete me"
+	}
+	addTestCases(t, d, keys)
+
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range keys {
+		if err := b.Delete(ctx, ds.NewKey(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// deleting an absent key in a batch is not an error
+	if err := b.Delete(ctx, ds.NewKey("/batch/delete/absent")); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, err := d.Has(ctx, ds.NewKey("/batch/delete/0000")); err != nil || !has {
+		t.Fatalf("expected batched delete to be deferred until commit. has: %t, err: %v", has, err)
+	}
+
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.deletes) != 2 {
+		t.Errorf("delete request count mismatch. expected: 2, got: %d", len(m.deletes))
+	}
+	total := 0
+	for i, n := range m.deletes {
+		if n > maxDeleteObjects {
+			t.Errorf("request %d deleted too many keys. expected at most: %d, got: %d", i, maxDeleteObjects, n)
+		}
+		total += n
+	}
+	if total != len(keys)+1 {
+		t.Errorf("deleted key count mismatch. expected: %d, got: %d", len(keys)+1, total)
+	}
+
+	rs, err := d.Query(ctx, dsq.Query{Prefix: "/batch/delete/", KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{}, rs)
+}
+
+func TestBatchFlush(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
+
+	batch, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := batch.(*Batch)
+	for _, k := range []string{"a", "b"} {
+		if err := b.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.puts) != 0 {
+		t.Errorf("expected flush to empty the batch, got %d pending puts", len(b.puts))
+	}
+	for _, k := range []string{"a", "b"} {
+		if _, ok := m.objects[k]; !ok {
+			t.Errorf("expected flushed key %s to be written", k)
+		}
+	}
+
+	// the batch accepts more operations after flushing
+	if err := b.Put(ctx, ds.NewKey("c"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, ds.NewKey("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.objects["c"]; ok {
+		t.Error("expected put after flush to be deferred until commit")
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]bool{"a": false, "b": true, "c": true}
+	for k, exists := range expect {
+		if _, ok := m.objects[k]; ok != exists {
+			t.Errorf("key %s existence mismatch. expected: %t, got: %t", k, exists, ok)
+		}
+	}
+}
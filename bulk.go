@@ -0,0 +1,176 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	datastore "github.com/ipfs/go-datastore"
+)
+
+// GetMany fetches the values of keys concurrently, fetching at most QueryConcurrency
+// values at once. Values and errors are aligned with keys by index. A missing key sets
+// its error to datastore.ErrNotFound without affecting the other keys
+func (ds *Datastore) GetMany(ctx context.Context, keys []datastore.Key) ([][]byte, []error) {
+	n := ds.queryConcurrency
+	if n < 1 {
+		n = 1
+	}
+
+	var (
+		wg     sync.WaitGroup
+		values = make([][]byte, len(keys))
+		errs   = make([]error, len(keys))
+		slots  = make(chan struct{}, n)
+	)
+
+	for i, key := range keys {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, key datastore.Key) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			values[i], errs[i] = ds.Get(ctx, key)
+		}(i, key)
+	}
+	wg.Wait()
+
+	return values, errs
+}
+
+// HasMany checks for the presence of keys concurrently, checking at most QueryConcurrency
+// keys at once. Flags are aligned with keys by index, missing keys are false. The first
+// error checking any key stops the check and is returned
+func (ds *Datastore) HasMany(ctx context.Context, keys []datastore.Key) ([]bool, error) {
+	n := ds.queryConcurrency
+	if n < 1 {
+		n = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg     sync.WaitGroup
+		once   sync.Once
+		err    error
+		exists = make([]bool, len(keys))
+		slots  = make(chan struct{}, n)
+	)
+
+	for i, key := range keys {
+		slots <- struct{}{}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, key datastore.Key) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			has, hasErr := ds.Has(ctx, key)
+			if hasErr != nil {
+				once.Do(func() {
+					err = hasErr
+					cancel()
+				})
+				return
+			}
+			exists[i] = has
+		}(i, key)
+	}
+	wg.Wait()
+
+	if err == nil {
+		// the parent context was canceled before every key was checked
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return exists, nil
+}
+
+// KeyErrors reports the keys a bulk operation failed on, and the error each failed with
+type KeyErrors map[datastore.Key]error
+
+// Error implements the error interface, listing failed keys in order
+func (e KeyErrors) Error() string {
+	keys := make([]datastore.Key, 0, len(e))
+	for key := range e {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+
+	msgs := make([]string, len(keys))
+	for i, key := range keys {
+		msgs[i] = fmt.Sprintf("%s: %s", key, e[key])
+	}
+	return fmt.Sprintf("%d keys failed: %s", len(keys), strings.Join(msgs, "; "))
+}
+
+// DeleteMany removes keys from the store, sending DeleteObjects requests of up to 1000
+// keys each. Like Batch.Commit, deleting a key that doesn't exist is not an error. Invalid
+// keys and keys S3 fails to delete are reported with KeyErrors
+func (ds *Datastore) DeleteMany(ctx context.Context, keys []datastore.Key) error {
+	if ds.readOnly {
+		return ErrReadOnly
+	}
+
+	return ds.deleteObjects(ctx, keys)
+}
+
+// PutMany writes items concurrently, writing at most PutConcurrency values at once.
+// Every item is attempted. If any put fails PutMany returns KeyErrors naming each key
+// that wasn't written
+func (ds *Datastore) PutMany(ctx context.Context, items map[datastore.Key][]byte) error {
+	if ds.readOnly {
+		return ErrReadOnly
+	}
+
+	if errs := ds.putMany(ctx, items); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// putMany writes items with a bounded pool of concurrent requests, returning the error
+// for each key that failed
+func (ds *Datastore) putMany(ctx context.Context, items map[datastore.Key][]byte) KeyErrors {
+	n := ds.putConcurrency
+	if n < 1 {
+		n = 1
+	}
+
+	var (
+		wg    sync.WaitGroup
+		lk    sync.Mutex
+		errs  = KeyErrors{}
+		slots = make(chan struct{}, n)
+	)
+
+	for key, value := range items {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(key datastore.Key, value []byte) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			if err := ds.Put(ctx, key, value); err != nil {
+				lk.Lock()
+				errs[key] = err
+				lk.Unlock()
+			}
+		}(key, value)
+	}
+	wg.Wait()
+
+	return errs
+}
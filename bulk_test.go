@@ -0,0 +1,157 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestGetMany(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS(func(o *Options) {
+		o.QueryConcurrency = 2
+	})
+	m.addObjects(map[string]string{"a": "a", "b/c": "c", "fail": "x"})
+	m.fail = map[string]bool{"fail": true}
+
+	keys := []ds.Key{ds.NewKey("/a"), ds.NewKey("/missing"), ds.NewKey("/b/c"), ds.NewKey("/fail")}
+	values, errs := d.GetMany(ctx, keys)
+	if len(values) != len(keys) || len(errs) != len(keys) {
+		t.Fatalf("result length mismatch. expected: %d, got: %d values & %d errors", len(keys), len(values), len(errs))
+	}
+
+	cases := []struct {
+		value string
+		err   string
+	}{
+		{"a", ""},
+		{"", ds.ErrNotFound.Error()},
+		{"c", ""},
+		{"", "InternalError"},
+	}
+	for i, c := range cases {
+		if string(values[i]) != c.value {
+			t.Errorf("case %d value mismatch. expected: %q, got: %q", i, c.value, values[i])
+		}
+		if c.err == "" && errs[i] != nil {
+			t.Errorf("case %d error mismatch. expected: nil, got: %s", i, errs[i])
+		} else if c.err != "" && (errs[i] == nil || !strings.Contains(errs[i].Error(), c.err)) {
+			t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.err, errs[i])
+		}
+	}
+	if errs[1] != ds.ErrNotFound {
+		t.Errorf("expected missing key to return ErrNotFound, got: %v", errs[1])
+	}
+}
+
+func TestHasMany(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS(func(o *Options) {
+		o.QueryConcurrency = 2
+	})
+	m.addObjects(map[string]string{"a": "a", "b/c": "c", "fail": "x"})
+	m.fail = map[string]bool{"fail": true}
+
+	keys := []ds.Key{ds.NewKey("/a"), ds.NewKey("/missing"), ds.NewKey("/b/c"), ds.NewKey("/b")}
+	exists, err := d.HasMany(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := "[true false true false]"; fmt.Sprint(exists) != expect {
+		t.Errorf("presence mismatch. expected: %s, got: %v", expect, exists)
+	}
+
+	if exists, err := d.HasMany(ctx, []ds.Key{}); err != nil || len(exists) != 0 {
+		t.Errorf("expected no flags for no keys, got: %v, %v", exists, err)
+	}
+
+	// errors other than missing keys abort the check
+	if _, err := d.HasMany(ctx, append(keys, ds.NewKey("/fail"))); err == nil {
+		t.Error("expected an error checking a failing key")
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	ctx := context.Background()
+
+	// span more than one DeleteObjects request
+	objects := map[string]string{}
+	keys := []ds.Key{}
+	for i := 0; i < maxDeleteObjects+100; i++ {
+		path := fmt.Sprintf("delete/%04d", i)
+		objects[path] = "delete me"
+		keys = append(keys, ds.NewKey(path))
+	}
+	objects["keep"] = "keep me"
+	objects["fail"] = "can't delete me"
+	keys = append(keys, ds.NewKey("/absent"), ds.NewKey("/fail"), ds.NewKey("/"), ds.Key{})
+
+	d, m := newMockDS()
+	m.addObjects(objects)
+	m.fail = map[string]bool{"fail": true}
+
+	err := d.DeleteMany(ctx, keys)
+	errs, ok := err.(KeyErrors)
+	if !ok {
+		t.Fatalf("expected KeyErrors, got: %T %v", err, err)
+	}
+	if len(errs) != 3 || errs[ds.NewKey("/fail")] == nil {
+		t.Errorf("expected /fail and invalid keys to fail, got: %v", errs)
+	}
+	for _, key := range []ds.Key{ds.NewKey("/"), {}} {
+		if err := errs[key]; err == nil || err.Error() != validKey(key).Error() {
+			t.Errorf("invalid key %q error mismatch. expected: %s, got: %v", key, validKey(key), err)
+		}
+	}
+	if deletes := m.requestCount("DeleteObjects"); deletes != 2 {
+		t.Errorf("DeleteObjects request count mismatch. expected: 2, got: %d", deletes)
+	}
+
+	expect := []string{"fail", "keep"}
+	remaining := []string{}
+	for k := range m.objects {
+		remaining = append(remaining, k)
+	}
+	sort.Strings(remaining)
+	if strings.Join(remaining, ",") != strings.Join(expect, ",") {
+		t.Errorf("remaining objects mismatch. expected: %v, got: %v", expect, remaining)
+	}
+}
+
+func TestPutMany(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
+	m.fail = map[string]bool{"fail/a": true, "fail/b": true}
+
+	items := map[ds.Key][]byte{
+		ds.NewKey("/a"):      []byte("a"),
+		ds.NewKey("/b"):      []byte("b"),
+		ds.NewKey("/fail/a"): []byte("x"),
+		ds.NewKey("/fail/b"): []byte("x"),
+	}
+
+	err := d.PutMany(ctx, items)
+	errs, ok := err.(KeyErrors)
+	if !ok {
+		t.Fatalf("expected KeyErrors, got: %T %v", err, err)
+	}
+	if len(errs) != 2 || errs[ds.NewKey("/fail/a")] == nil || errs[ds.NewKey("/fail/b")] == nil {
+		t.Errorf("expected failed keys /fail/a & /fail/b, got: %v", errs)
+	}
+	if !strings.HasPrefix(err.Error(), "2 keys failed: /fail/a: ") || !strings.Contains(err.Error(), "; /fail/b: ") {
+		t.Errorf("unexpected error message: %s", err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if string(m.objects[k]) != k {
+			t.Errorf("expected %s to be written, got: %q", k, m.objects[k])
+		}
+	}
+
+	if err := d.PutMany(ctx, map[ds.Key][]byte{ds.NewKey("/c"): []byte("c")}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
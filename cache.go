@@ -0,0 +1,249 @@
+package s3
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	datastore "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+)
+
+// CachedDatastore wraps a Datastore, keeping recently read values in memory. Writes &
+// deletes made through the CachedDatastore evict cached values, including values read
+// while they're written, writes made to the
+// underlying Datastore directly (or by other processes) aren't seen until the cached
+// value is evicted. Cached values are shared between callers and must not be modified
+type CachedDatastore struct {
+	ds       *Datastore
+	maxBytes int64
+
+	lk      sync.Mutex
+	size    int64
+	lru     *list.List
+	values  map[datastore.Key]*list.Element
+	fetches map[datastore.Key]*cacheFetch
+}
+
+// assert *CachedDatastore satisfies datastore.Batching interface at compile time
+var _ datastore.Batching = (*CachedDatastore)(nil)
+
+// cacheEntry is a cached value, stored in the LRU list
+type cacheEntry struct {
+	key   datastore.Key
+	value []byte
+}
+
+// cacheFetch tracks reads of a key in flight. Writes & deletes of the key bump gen, so
+// reads that started before them don't cache the value they replaced
+type cacheFetch struct {
+	readers int
+	gen     uint64
+}
+
+// NewCachedDatastore wraps ds with a least-recently-used cache of values read with Get,
+// holding up to maxBytes of values. Values larger than maxBytes are never cached
+func NewCachedDatastore(ds *Datastore, maxBytes int64) *CachedDatastore {
+	return &CachedDatastore{
+		ds:       ds,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		values:   map[datastore.Key]*list.Element{},
+		fetches:  map[datastore.Key]*cacheFetch{},
+	}
+}
+
+// Put writes a value to the underlying datastore, evicting any cached value for key
+func (c *CachedDatastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	defer c.evict(key)
+	return c.ds.Put(ctx, key, value)
+}
+
+// Get returns a cached value, reading through to the underlying datastore on a miss
+func (c *CachedDatastore) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	if value, ok := c.cached(key); ok {
+		return value, nil
+	}
+
+	gen := c.startFetch(key)
+	value, err := c.ds.Get(ctx, key)
+	c.endFetch(key, gen, value, err == nil)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Has answers from the cache when key is cached, checking the underlying datastore otherwise
+func (c *CachedDatastore) Has(ctx context.Context, key datastore.Key) (bool, error) {
+	if _, ok := c.cached(key); ok {
+		return true, nil
+	}
+	return c.ds.Has(ctx, key)
+}
+
+// GetSize answers from the cache when key is cached, checking the underlying datastore otherwise
+func (c *CachedDatastore) GetSize(ctx context.Context, key datastore.Key) (int, error) {
+	if value, ok := c.cached(key); ok {
+		return len(value), nil
+	}
+	return c.ds.GetSize(ctx, key)
+}
+
+// Delete removes key from the underlying datastore, evicting any cached value
+func (c *CachedDatastore) Delete(ctx context.Context, key datastore.Key) error {
+	defer c.evict(key)
+	return c.ds.Delete(ctx, key)
+}
+
+// Query the underlying datastore. Query results aren't cached
+func (c *CachedDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	return c.ds.Query(ctx, q)
+}
+
+// Sync the underlying datastore
+func (c *CachedDatastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	return c.ds.Sync(ctx, prefix)
+}
+
+// Close drops all cached values and closes the underlying datastore
+func (c *CachedDatastore) Close() error {
+	c.lk.Lock()
+	c.size = 0
+	c.lru.Init()
+	c.values = map[datastore.Key]*list.Element{}
+	c.lk.Unlock()
+
+	return c.ds.Close()
+}
+
+// Batch creates a batch of operations on the underlying datastore. Committing the batch
+// evicts every key it wrote or deleted
+func (c *CachedDatastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	b, err := c.ds.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedBatch{Batch: b, cache: c, keys: map[datastore.Key]struct{}{}}, nil
+}
+
+// cached returns the value cached for key, marking it as recently used
+func (c *CachedDatastore) cached(key datastore.Key) ([]byte, bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	el, ok := c.values[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+// startFetch registers a read of key, returning the generation of the key it reads
+func (c *CachedDatastore) startFetch(key datastore.Key) uint64 {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	f, ok := c.fetches[key]
+	if !ok {
+		f = &cacheFetch{}
+		c.fetches[key] = f
+	}
+	f.readers++
+	return f.gen
+}
+
+// endFetch finishes a read of key started at gen, caching value if the read succeeded
+// and key hasn't been written or deleted since
+func (c *CachedDatastore) endFetch(key datastore.Key, gen uint64, value []byte, ok bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	f := c.fetches[key]
+	if f.readers--; f.readers == 0 {
+		delete(c.fetches, key)
+	}
+	if ok && f.gen == gen {
+		c.add(key, value)
+	}
+}
+
+// add caches value, evicting least recently used values until the cache fits in maxBytes.
+// Callers must hold c.lk
+func (c *CachedDatastore) add(key datastore.Key, value []byte) {
+	size := int64(len(value))
+	if size > c.maxBytes {
+		return
+	}
+
+	if el, ok := c.values[key]; ok {
+		c.remove(el)
+	}
+	c.values[key] = c.lru.PushFront(&cacheEntry{key: key, value: value})
+	c.size += size
+
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// evict drops any value cached for key, stopping reads in flight from caching the
+// value they read
+func (c *CachedDatastore) evict(key datastore.Key) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if f, ok := c.fetches[key]; ok {
+		f.gen++
+	}
+	if el, ok := c.values[key]; ok {
+		c.remove(el)
+	}
+}
+
+// remove drops a cached value. Callers must hold c.lk
+func (c *CachedDatastore) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.values, e.key)
+	c.size -= int64(len(e.value))
+}
+
+// cachedBatch tracks the keys a batch modifies, so they can be evicted on commit
+type cachedBatch struct {
+	datastore.Batch
+	cache *CachedDatastore
+	keys  map[datastore.Key]struct{}
+}
+
+// Put adds a value to the batch
+func (b *cachedBatch) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	if err := b.Batch.Put(ctx, key, value); err != nil {
+		return err
+	}
+	b.keys[key] = struct{}{}
+	return nil
+}
+
+// Delete adds a key removal to the batch
+func (b *cachedBatch) Delete(ctx context.Context, key datastore.Key) error {
+	if err := b.Batch.Delete(ctx, key); err != nil {
+		return err
+	}
+	b.keys[key] = struct{}{}
+	return nil
+}
+
+// Commit writes the batch, evicting every key it modified. Keys are evicted even if
+// the commit fails, as a failed commit may have written some keys
+func (b *cachedBatch) Commit(ctx context.Context) error {
+	err := b.Batch.Commit(ctx)
+	for key := range b.keys {
+		b.cache.evict(key)
+	}
+	if err != nil {
+		return err
+	}
+	b.keys = map[datastore.Key]struct{}{}
+	return nil
+}
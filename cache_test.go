@@ -0,0 +1,161 @@
+package s3
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestCachedDatastoreHits(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
+	m.addObjects(map[string]string{"a": "aaaa", "b": "bbbb", "c": "cccc"})
+	c := NewCachedDatastore(d, 8)
+
+	for i := 0; i < 3; i++ {
+		v, err := c.Get(ctx, ds.NewKey("/a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != "aaaa" {
+			t.Errorf("value mismatch. expected: aaaa, got: %s", v)
+		}
+	}
+	if gets := m.requestCount("GetObject"); gets != 1 {
+		t.Errorf("expected repeat gets to be cached. expected: 1 request, got: %d", gets)
+	}
+
+	if has, err := c.Has(ctx, ds.NewKey("/a")); err != nil || !has {
+		t.Errorf("has mismatch. expected: true, got: %t, err: %v", has, err)
+	}
+	if size, err := c.GetSize(ctx, ds.NewKey("/a")); err != nil || size != 4 {
+		t.Errorf("size mismatch. expected: 4, got: %d, err: %v", size, err)
+	}
+
+	// reading b & c overflows the cache, evicting the least recently used value
+	for _, k := range []string{"/b", "/a", "/c", "/a"} {
+		if _, err := c.Get(ctx, ds.NewKey(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gets := m.requestCount("GetObject"); gets != 3 {
+		t.Errorf("expected a to stay cached. expected: 3 requests, got: %d", gets)
+	}
+	if _, err := c.Get(ctx, ds.NewKey("/b")); err != nil {
+		t.Fatal(err)
+	}
+	if gets := m.requestCount("GetObject"); gets != 4 {
+		t.Errorf("expected b to be evicted. expected: 4 requests, got: %d", gets)
+	}
+
+	if _, err := c.Get(ctx, ds.NewKey("/missing")); err != ds.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got: %v", err)
+	}
+}
+
+func TestCachedDatastoreEvicts(t *testing.T) {
+	ctx := context.Background()
+	key := ds.NewKey("/a")
+	d, m := newMockDS()
+	m.addObjects(map[string]string{"a": "a"})
+	c := NewCachedDatastore(d, 1<<10)
+
+	expectValue := func(expect string) {
+		t.Helper()
+		v, err := c.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != expect {
+			t.Errorf("value mismatch. expected: %s, got: %s", expect, v)
+		}
+	}
+
+	expectValue("a")
+	if err := c.Put(ctx, key, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	expectValue("b")
+
+	b, err := c.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, key, []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	expectValue("b")
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectValue("c")
+
+	if err := c.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, key); err != ds.ErrNotFound {
+		t.Errorf("expected deleted key to be evicted, got: %v", err)
+	}
+	if has, err := c.Has(ctx, key); err != nil || has {
+		t.Errorf("has mismatch. expected: false, got: %t, err: %v", has, err)
+	}
+}
+
+// blockedGets pauses GetObject requests after they read an object, until released
+type blockedGets struct {
+	s3iface.S3API
+	read, release chan struct{}
+}
+
+func (c *blockedGets) GetObjectWithContext(ctx aws.Context, input *awsS3.GetObjectInput, opts ...request.Option) (*awsS3.GetObjectOutput, error) {
+	res, err := c.S3API.GetObjectWithContext(ctx, input, opts...)
+	c.read <- struct{}{}
+	<-c.release
+	return res, err
+}
+
+func TestCachedDatastoreConcurrentPut(t *testing.T) {
+	ctx := context.Background()
+	key := ds.NewKey("/a")
+	m := newMockS3()
+	blocked := &blockedGets{S3API: m, read: make(chan struct{}), release: make(chan struct{})}
+	c := NewCachedDatastore(NewDatastore(bucketName, func(o *Options) {
+		o.S3API = blocked
+	}), 1<<10)
+	if err := c.Put(ctx, key, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a read of the old value finishing after a write must not cache the old value
+	for _, write := range []func() error{
+		func() error { return c.Put(ctx, key, []byte("b")) },
+		func() error { return c.Delete(ctx, key) },
+	} {
+		done := make(chan error)
+		go func() {
+			_, err := c.Get(ctx, key)
+			done <- err
+		}()
+		<-blocked.read
+		if err := write(); err != nil {
+			t.Fatal(err)
+		}
+		close(blocked.release)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		if v, ok := c.cached(key); ok {
+			t.Errorf("expected the value read before the write to be dropped, got: %q", v)
+		}
+		if len(c.fetches) != 0 {
+			t.Errorf("expected finished reads to be forgotten, got: %d", len(c.fetches))
+		}
+		blocked.read, blocked.release = make(chan struct{}), make(chan struct{})
+	}
+}
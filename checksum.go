@@ -0,0 +1,59 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// contentMD5 returns the base64-encoded MD5 of a request body, for use as Content-MD5
+func contentMD5(body []byte) string {
+	sum := md5.Sum(body)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// etagIsMD5 reports whether the ETag of an object is the MD5 of its contents, which is
+// only the case for objects uploaded in a single part and not encrypted with KMS or
+// customer-provided keys
+func etagIsMD5(res *awsS3.GetObjectOutput) bool {
+	return !strings.Contains(aws.StringValue(res.ETag), "-") &&
+		aws.StringValue(res.ServerSideEncryption) != awsS3.ServerSideEncryptionAwsKms &&
+		res.SSECustomerAlgorithm == nil
+}
+
+// md5ReadCloser checks the MD5 of an object body against the object's ETag once the
+// body has been read to the end
+type md5ReadCloser struct {
+	io.ReadCloser
+	hash hash.Hash
+	etag string
+}
+
+// newMD5ReadCloser wraps an object body, verifying it against etag
+func newMD5ReadCloser(body io.ReadCloser, etag string) *md5ReadCloser {
+	return &md5ReadCloser{
+		ReadCloser: body,
+		hash:       md5.New(),
+		etag:       strings.Trim(etag, `"`),
+	}
+}
+
+// Read from the object body, returning an error in place of io.EOF if the body doesn't
+// match the ETag
+func (r *md5ReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if sum := hex.EncodeToString(r.hash.Sum(nil)); sum != r.etag {
+			return n, fmt.Errorf("checksum mismatch. ETag: %s, MD5: %s", r.etag, sum)
+		}
+	}
+	return n, err
+}
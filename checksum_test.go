@@ -0,0 +1,150 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// corruptingS3 is a mockS3 that flips the first byte of every value written
+type corruptingS3 struct {
+	*mockS3
+}
+
+func (m corruptingS3) PutObjectWithContext(ctx aws.Context, input *awsS3.PutObjectInput, opts ...request.Option) (*awsS3.PutObjectOutput, error) {
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	body[0] ^= 0xff
+	input.Body = bytes.NewReader(body)
+	return m.mockS3.PutObjectWithContext(ctx, input, opts...)
+}
+
+func TestContentMD5(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS(func(o *Options) {
+		o.VerifyUploads = true
+	})
+
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// base64 of md5("hello")
+	if md5 := m.md5s["a"]; md5 != "XUFAKrxLKna5cZ2REBfFkg==" {
+		t.Errorf("ContentMD5 mismatch. expected: %s, got: %s", "XUFAKrxLKna5cZ2REBfFkg==", md5)
+	}
+
+	// compressed values are hashed as stored
+	d, m = newMockDS(func(o *Options) {
+		o.VerifyUploads = true
+		o.Compression = "gzip"
+	})
+	if err := d.Put(ctx, ds.NewKey("/a"), bytes.Repeat([]byte("hello"), 100)); err != nil {
+		t.Fatal(err)
+	}
+	if md5 := m.md5s["a"]; md5 != contentMD5(m.objects["a"]) {
+		t.Errorf("compressed ContentMD5 mismatch. expected: %s, got: %s", contentMD5(m.objects["a"]), md5)
+	}
+
+	// values corrupted in flight are rejected
+	corrupt := newMockS3()
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.S3API = corruptingS3{corrupt}
+		o.VerifyUploads = true
+	})
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("hello")); err == nil || !strings.Contains(err.Error(), "BadDigest") {
+		t.Errorf("expected corrupted put to be rejected, got: %v", err)
+	}
+	if _, ok := corrupt.objects["a"]; ok {
+		t.Error("expected corrupted value not to be stored")
+	}
+
+	// without VerifyUploads the corruption goes unnoticed
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.S3API = corruptingS3{corrupt}
+	})
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("hello")); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestVerifyReads(t *testing.T) {
+	ctx := context.Background()
+
+	// store "hello" twice, corrupt with the ETag of a different value
+	d, m := newMockDS(func(o *Options) {
+		o.VerifyReads = true
+	})
+	m.addObjects(map[string]string{"intact": "hello", "corrupt": "hello"})
+	m.etags["corrupt"] = `"7d793037a0760186574b0282f2f435e7"`
+
+	got, err := d.Get(ctx, ds.NewKey("/intact"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("value mismatch. expected: %q, got: %q", "hello", got)
+	}
+
+	if _, err := d.Get(ctx, ds.NewKey("/corrupt")); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch error, got: %v", err)
+	}
+}
+
+// truncatingS3 is a mockS3 that silently drops the last byte of every value written
+type truncatingS3 struct {
+	*mockS3
+}
+
+func (m truncatingS3) PutObjectWithContext(ctx aws.Context, input *awsS3.PutObjectInput, opts ...request.Option) (*awsS3.PutObjectOutput, error) {
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	input.Body = bytes.NewReader(body[:len(body)-1])
+	return m.mockS3.PutObjectWithContext(ctx, input, opts...)
+}
+
+func TestVerifyAfterPut(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		api s3iface.S3API
+		err string
+	}{
+		{newMockS3(), ""},
+		{&laggyS3{mockS3: newMockS3(), lag: 1, hidden: map[string]int{}}, "verifying put of /a: object not found after writing"},
+		{truncatingS3{newMockS3()}, "verifying put of /a: wrote 5 bytes, but the stored object is 4 bytes"},
+	}
+
+	for i, c := range cases {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.S3API = c.api
+			o.VerifyAfterPut = true
+		})
+		err := d.Put(ctx, ds.NewKey("/a"), []byte("hello"))
+		if c.err == "" && err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+		} else if c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.err, err)
+		}
+	}
+
+	// compressed values are checked against their stored size
+	d, _ := newMockDS(func(o *Options) {
+		o.Compression = "gzip"
+		o.VerifyAfterPut = true
+	})
+	if err := d.Put(ctx, ds.NewKey("/a"), bytes.Repeat([]byte("hello"), 100)); err != nil {
+		t.Errorf("unexpected error verifying compressed put: %s", err)
+	}
+}
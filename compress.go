@@ -0,0 +1,136 @@
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	datastore "github.com/ipfs/go-datastore"
+)
+
+const (
+	// gzipEncoding is the Content-Encoding of gzip compressed objects
+	gzipEncoding = "gzip"
+	// valueSizeKey is the user metadata key the uncompressed size of compressed values is
+	// stored under
+	valueSizeKey = "value-size"
+)
+
+// compressSampleSize is the length of the prefix of each value CompressSampled compresses
+const compressSampleSize = 4 << 10
+
+// CompressSampled is a CompressFunc that compresses values when compressing their first
+// 4KB saves at least a tenth of the sample, skipping values that are already compressed
+// or encrypted for the cost of compressing the sample
+func CompressSampled(key datastore.Key, contentType string, value []byte) bool {
+	sample := value
+	if len(sample) > compressSampleSize {
+		sample = sample[:compressSampleSize]
+	}
+	compressed, err := gzipBytes(sample)
+	return err == nil && len(compressed) <= len(sample)*9/10
+}
+
+// CompressContentTypes returns a CompressFunc that compresses values with one of types,
+// eg. "text/" or "application/json". Types ending in a slash match every subtype
+func CompressContentTypes(types ...string) func(key datastore.Key, contentType string, value []byte) bool {
+	return func(key datastore.Key, contentType string, value []byte) bool {
+		// ignore parameters like charset
+		if i := strings.IndexByte(contentType, ';'); i >= 0 {
+			contentType = contentType[:i]
+		}
+		contentType = strings.TrimSpace(strings.ToLower(contentType))
+		for _, t := range types {
+			if contentType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// valueSize returns the uncompressed size stored in user metadata md, if any. Like inline
+// values, keys are matched regardless of case
+func valueSize(md map[string]*string) (int, bool) {
+	for k, v := range md {
+		if strings.EqualFold(k, valueSizeKey) {
+			size, err := strconv.Atoi(aws.StringValue(v))
+			return size, err == nil && size >= 0
+		}
+	}
+	return 0, false
+}
+
+// gzipBytes compresses a value
+func gzipBytes(value []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write(value); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipStream compresses r as it's read from the returned reader. Closing the returned
+// reader stops compression, waiting for the compressing goroutine to exit
+func gzipStream(r io.Reader) *gzipPipe {
+	pr, pw := io.Pipe()
+	p := &gzipPipe{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, r)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return p
+}
+
+// gzipPipe is the reading half of a gzipStream
+type gzipPipe struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close stops compression, waiting for the compressing goroutine to exit
+func (p *gzipPipe) Close() error {
+	return p.CloseWithError(nil)
+}
+
+// CloseWithError stops compression, failing the compressing goroutine's writes with err
+func (p *gzipPipe) CloseWithError(err error) error {
+	p.PipeReader.CloseWithError(err)
+	<-p.done
+	return nil
+}
+
+// gzipReadCloser decompresses a gzipped object body
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+// newGzipReadCloser wraps a gzipped object body, closing body if it isn't valid gzip
+func newGzipReadCloser(body io.ReadCloser) (io.ReadCloser, error) {
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: gz, body: body}, nil
+}
+
+// Close the decompressor & the underlying object body
+func (r *gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.body.Close()
+}
@@ -0,0 +1,190 @@
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestCompressionInput(t *testing.T) {
+	value := bytes.Repeat([]byte("compressible "), 100)
+
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Compression = "gzip"
+	})
+	input, err := d.putObjectInput(ds.NewKey("/a"), value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(input.ContentEncoding) != "gzip" {
+		t.Errorf("ContentEncoding mismatch. expected: %q, got: %q", "gzip", aws.StringValue(input.ContentEncoding))
+	}
+	if size := aws.StringValue(input.Metadata[valueSizeKey]); size != "1300" {
+		t.Errorf("stored size mismatch. expected: %q, got: %q", "1300", size)
+	}
+	gz, err := gzip.NewReader(input.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Error("compressed body doesn't decompress to the original value")
+	}
+
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.Compression = "lz4"
+	})
+	if _, err := d.putObjectInput(ds.NewKey("/a"), value); err == nil || err.Error() != `unsupported compression: "lz4"` {
+		t.Errorf("unsupported compression error mismatch: %v", err)
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	plain, m := newMockDS()
+	compressed := NewDatastore(bucketName, func(o *Options) {
+		o.S3API = m
+		o.Compression = "gzip"
+	})
+
+	value := bytes.Repeat([]byte("compressible "), 100)
+	if err := compressed.Put(ctx, ds.NewKey("/compression/gzip"), value); err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Put(ctx, ds.NewKey("/compression/plain"), value); err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{"compression/gzip": gzipEncoding, "compression/plain": ""}
+	for k, encoding := range expect {
+		if got := m.encodings[k]; got != encoding {
+			t.Errorf("%s encoding mismatch. expected: %q, got: %q", k, encoding, got)
+		}
+	}
+	if len(m.objects["compression/gzip"]) >= len(value) {
+		t.Errorf("expected stored object to be compressed. value size: %d, stored size: %d", len(value), len(m.objects["compression/gzip"]))
+	}
+
+	// reads decide whether to decompress using the stored encoding, so a mixed bucket
+	// reads back correctly regardless of the reader's compression option
+	for _, d := range []*Datastore{compressed, plain} {
+		for _, k := range []string{"/compression/gzip", "/compression/plain"} {
+			got, err := d.Get(ctx, ds.NewKey(k))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, value) {
+				t.Errorf("%s value mismatch (compression: %q)", k, d.compression)
+			}
+		}
+	}
+
+	size, err := plain.GetSize(ctx, ds.NewKey("/compression/gzip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len(value) {
+		t.Errorf("expected compressed value to be sized uncompressed. value size: %d, got: %d", len(value), size)
+	}
+}
+
+func TestCompressedSize(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS(func(o *Options) {
+		o.Compression = "gzip"
+	})
+	value := bytes.Repeat([]byte("compressible "), 100)
+	if err := d.Put(ctx, ds.NewKey("/a"), value); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.objects["a"]) >= len(value) {
+		t.Fatalf("expected stored object to be compressed. value size: %d, stored size: %d", len(value), len(m.objects["a"]))
+	}
+
+	m.reads = 0
+	if size, err := d.GetSize(ctx, ds.NewKey("/a")); err != nil || size != len(value) {
+		t.Errorf("size mismatch. expected: %d, got: %d, %v", len(value), size, err)
+	}
+	if m.reads != 1 {
+		t.Errorf("expected the stored size to be read with a single request, got: %d", m.reads)
+	}
+	md, err := d.GetMetadata(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := md[valueSizeKey]; ok {
+		t.Errorf("expected the stored size to be omitted from metadata, got: %v", md)
+	}
+
+	// streams are written before their size is known
+	input, err := d.putObjectInput(ds.NewKey("/stream"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := input.Metadata[valueSizeKey]; ok {
+		t.Errorf("expected streams to be written without a size, got: %v", input.Metadata)
+	}
+	// compressed values without a stored size are read whole
+	delete(m.metadata, "a")
+	m.reads = 0
+	if size, err := d.GetSize(ctx, ds.NewKey("/a")); err != nil || size != len(value) {
+		t.Errorf("unsized value size mismatch. expected: %d, got: %d, %v", len(value), size, err)
+	}
+	if m.reads != 2 {
+		t.Errorf("expected unsized values to be read, got: %d requests", m.reads)
+	}
+}
+
+func TestCompressFunc(t *testing.T) {
+	ctx := context.Background()
+	text := bytes.Repeat([]byte("compressible "), 1000)
+	random := make([]byte, 8<<10)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		compressFn  func(key ds.Key, contentType string, value []byte) bool
+		contentType string
+		value       []byte
+		encoding    string
+	}{
+		{nil, "", random, "gzip"},
+		{CompressSampled, "", text, "gzip"},
+		{CompressSampled, "", random, ""},
+		{CompressSampled, "", []byte{}, ""},
+		{CompressContentTypes("text/", "application/json"), "text/plain; charset=utf-8", text, "gzip"},
+		{CompressContentTypes("text/", "application/json"), "application/json", text, "gzip"},
+		{CompressContentTypes("text/", "application/json"), "image/png", text, ""},
+		{CompressContentTypes("text/", "application/json"), "", text, ""},
+	}
+
+	for i, c := range cases {
+		d, m := newMockDS(func(o *Options) {
+			o.Compression = "gzip"
+			o.CompressFunc = c.compressFn
+			o.ContentType = c.contentType
+		})
+		if err := d.Put(ctx, ds.NewKey("/a"), c.value); err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if got := m.encodings["a"]; got != c.encoding {
+			t.Errorf("case %d encoding mismatch. expected: %q, got: %q", i, c.encoding, got)
+		}
+		got, err := d.Get(ctx, ds.NewKey("/a"))
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if !bytes.Equal(got, c.value) {
+			t.Errorf("case %d value mismatch. expected %d bytes, got %d", i, len(c.value), len(got))
+		}
+	}
+}
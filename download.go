@@ -0,0 +1,204 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	datastore "github.com/ipfs/go-datastore"
+)
+
+// GetParallel reads key like Get, downloading objects larger than DownloadPartSize with
+// ranged requests for each part, fetching DownloadConcurrency parts at once. Objects no
+// larger than a single part are read with one request. Compressed values are decompressed,
+// but aren't checked against their ETag with VerifyReads
+func (ds *Datastore) GetParallel(ctx context.Context, key datastore.Key) ([]byte, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	// the downloader doesn't return response headers, so capture the encoding of each part
+	svc, err := ds.client()
+	if err != nil {
+		return nil, err
+	}
+	c := &encodingClient{S3API: ds.withProgress(svc, key, -1)}
+	downloader := s3manager.NewDownloaderWithClient(c, func(d *s3manager.Downloader) {
+		if ds.getPartSize > 0 {
+			d.PartSize = ds.getPartSize
+		}
+		if ds.getConcurrency > 0 {
+			d.Concurrency = ds.getConcurrency
+		}
+	})
+
+	buf := aws.NewWriteAtBuffer([]byte{})
+	if _, err := downloader.DownloadWithContext(ctx, buf, ds.getObjectInput(key, "")); err != nil {
+		if isNotFound(err) {
+			return nil, datastore.ErrNotFound
+		}
+		return nil, ctxErr(ctx, err)
+	}
+	// empty objects may hold inline values, which are stored in metadata the downloader
+	// doesn't return. Inline values are read regardless of InlineSmallValues
+	if len(buf.Bytes()) == 0 {
+		return ds.Get(ctx, key)
+	}
+
+	if c.encoding() == gzipEncoding {
+		body, err := newGzipReadCloser(ioutil.NopCloser(bytes.NewReader(buf.Bytes())))
+		if err != nil {
+			return nil, err
+		}
+		return readBody(body)
+	}
+	return buf.Bytes(), nil
+}
+
+// GetRange reads length bytes of the value at key starting at offset, requesting only the
+// range from S3. Ranges extending past the end of the value are cut short, while ranges
+// starting after the end return ErrInvalidRange. Objects are checked for compression as
+// they're read, whatever Compression is set to, and compressed values are downloaded whole
+// to be decompressed, then sliced, as are inline values. Ranges aren't checked against
+// ETags with VerifyReads
+func (ds *Datastore) GetRange(ctx context.Context, key datastore.Key, offset, length int64) ([]byte, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	if offset < 0 || length < 1 {
+		return nil, fmt.Errorf("invalid range: offset %d, length %d", offset, length)
+	}
+	input := ds.getObjectInput(key, "")
+	input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	reqCtx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	c, err := ds.client()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.GetObjectWithContext(reqCtx, input)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, datastore.ErrNotFound
+		}
+		// every range of an empty object is invalid, including inline objects, as are
+		// ranges of compressed objects past the end of their compressed value
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidRange" {
+			return ds.rejectedRange(ctx, key, offset, length)
+		}
+		return nil, ctxErr(reqCtx, err)
+	}
+	if aws.Int64Value(res.ContentLength) == 0 {
+		res.Body.Close()
+		if value, ok, err := inlineValue(res.Metadata); err != nil || ok {
+			if err != nil {
+				return nil, err
+			}
+			return sliceBytes(value, offset, length)
+		}
+		return nil, ErrInvalidRange
+	}
+	// ranges of compressed objects aren't ranges of their values
+	if aws.StringValue(res.ContentEncoding) == gzipEncoding {
+		res.Body.Close()
+		return ds.sliceValue(ctx, key, offset, length)
+	}
+
+	value, err := readBody(res.Body)
+	if err != nil {
+		return nil, ctxErr(reqCtx, err)
+	}
+	return value, nil
+}
+
+// rejectedRange reads a range of the value at key after S3 rejected the range of its
+// object, which for inline and compressed objects isn't the range of their value
+func (ds *Datastore) rejectedRange(ctx context.Context, key datastore.Key, offset, length int64) ([]byte, error) {
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	c, err := ds.client()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.HeadObjectWithContext(ctx, &awsS3.HeadObjectInput{
+		Bucket:       aws.String(ds.Bucket),
+		RequestPayer: ds.requestPayer(),
+		Key:          aws.String(ds.path(key)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, datastore.ErrNotFound
+		}
+		return nil, ctxErr(ctx, err)
+	}
+	if aws.StringValue(res.ContentEncoding) == gzipEncoding {
+		return ds.sliceValue(ctx, key, offset, length)
+	}
+	value, ok, err := inlineValue(res.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidRange
+	}
+	return sliceBytes(value, offset, length)
+}
+
+// sliceValue reads a range of the value at key by reading the entire value
+func (ds *Datastore) sliceValue(ctx context.Context, key datastore.Key, offset, length int64) ([]byte, error) {
+	value, err := ds.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return sliceBytes(value, offset, length)
+}
+
+// sliceBytes returns length bytes of value starting at offset, cut short at its end
+func sliceBytes(value []byte, offset, length int64) ([]byte, error) {
+	if offset >= int64(len(value)) {
+		return nil, ErrInvalidRange
+	}
+	if end := offset + length; end < int64(len(value)) {
+		return value[offset:end], nil
+	}
+	return value[offset:], nil
+}
+
+// encodingClient wraps a client to record the Content-Encoding of the objects the
+// s3manager Downloader reads through it
+type encodingClient struct {
+	s3iface.S3API
+	lk  sync.Mutex
+	enc string
+}
+
+func (c *encodingClient) GetObjectWithContext(ctx aws.Context, input *awsS3.GetObjectInput, opts ...request.Option) (*awsS3.GetObjectOutput, error) {
+	res, err := c.S3API.GetObjectWithContext(ctx, input, opts...)
+	if err == nil {
+		c.lk.Lock()
+		c.enc = aws.StringValue(res.ContentEncoding)
+		c.lk.Unlock()
+	}
+	return res, err
+}
+
+// encoding returns the Content-Encoding of the last object read
+func (c *encodingClient) encoding() string {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.enc
+}
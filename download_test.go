@@ -0,0 +1,139 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestGetParallel(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS(func(o *Options) {
+		o.DownloadPartSize = 1024
+		o.DownloadConcurrency = 3
+	})
+
+	cases := []struct {
+		size  int
+		parts int
+	}{
+		{10, 1},
+		{1024, 1},
+		{1025, 2},
+		{10 * 1024, 10},
+	}
+
+	for i, c := range cases {
+		value := bytes.Repeat([]byte("0123456789"), c.size/10+1)[:c.size]
+		if err := d.Put(ctx, ds.NewKey("/large"), value); err != nil {
+			t.Fatal(err)
+		}
+
+		m.ranges = nil
+		got, err := d.GetParallel(ctx, ds.NewKey("/large"))
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("case %d value mismatch. expected %d bytes, got %d", i, len(value), len(got))
+		}
+		if len(m.ranges) != c.parts {
+			t.Errorf("case %d part count mismatch. expected: %d, got: %d %v", i, c.parts, len(m.ranges), m.ranges)
+		}
+	}
+
+	if _, err := d.GetParallel(ctx, ds.NewKey("/missing")); err != ds.ErrNotFound {
+		t.Errorf("missing key error mismatch. expected: %s, got: %v", ds.ErrNotFound, err)
+	}
+
+	// compressed objects are decompressed whatever the client
+	d, _ = newMockDS(func(o *Options) {
+		o.Compression = "gzip"
+		o.DownloadPartSize = 1024
+	})
+	value := bytes.Repeat([]byte("compressible "), 1000)
+	if err := d.Put(ctx, ds.NewKey("/compressed"), value); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.GetParallel(ctx, ds.NewKey("/compressed")); err != nil || !bytes.Equal(got, value) {
+		t.Errorf("compressed value mismatch. expected %d bytes, got %d, %v", len(value), len(got), err)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		offset, length int64
+		expect         string
+		err            error
+	}{
+		{0, 10, "0123456789", nil},
+		{3, 4, "3456", nil},
+		{8, 10, "89", nil},
+		{9, 1, "9", nil},
+		{10, 1, "", ErrInvalidRange},
+	}
+
+	for _, compression := range []string{"", "gzip"} {
+		d, m := newMockDS(func(o *Options) {
+			o.Compression = compression
+		})
+		if err := d.Put(ctx, ds.NewKey("/a"), []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, c := range cases {
+			m.ranges = nil
+			got, err := d.GetRange(ctx, ds.NewKey("/a"), c.offset, c.length)
+			if err != c.err {
+				t.Errorf("case %d compression %q error mismatch. expected: %v, got: %v", i, compression, c.err, err)
+				continue
+			}
+			if string(got) != c.expect {
+				t.Errorf("case %d compression %q value mismatch. expected: %q, got: %q", i, compression, c.expect, got)
+			}
+			if len(m.ranges) < 1 {
+				t.Errorf("case %d compression %q expected a ranged request", i, compression)
+			}
+			if compression == "" && len(m.ranges) != 1 {
+				t.Errorf("case %d expected a single ranged request, got: %v", i, m.ranges)
+			}
+		}
+
+		if _, err := d.GetRange(ctx, ds.NewKey("/missing"), 0, 1); err != ds.ErrNotFound {
+			t.Errorf("missing key error mismatch. expected: %s, got: %v", ds.ErrNotFound, err)
+		}
+		if _, err := d.GetRange(ctx, ds.NewKey("/a"), -1, 1); err == nil {
+			t.Error("expected an error for a negative offset")
+		}
+	}
+
+	// compression is detected per object, so mixed buckets read correctly either way
+	plain, m := newMockDS()
+	compressed := NewDatastore(bucketName, func(o *Options) {
+		o.S3API = m
+		o.Compression = "gzip"
+	})
+	value := bytes.Repeat([]byte("0123456789"), 100)
+	if err := plain.Put(ctx, ds.NewKey("/plain"), value); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressed.Put(ctx, ds.NewKey("/compressed"), value); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []*Datastore{plain, compressed} {
+		for _, k := range []string{"/plain", "/compressed"} {
+			m.ranges = nil
+			// the offset is past the end of the compressed object
+			got, err := d.GetRange(ctx, ds.NewKey(k), 900, 5)
+			if err != nil || string(got) != "01234" {
+				t.Errorf("key %s compression %q value mismatch. expected: %q, got: %q, %v", k, d.compression, "01234", got, err)
+			}
+			if k == "/plain" && len(m.ranges) != 1 {
+				t.Errorf("key %s compression %q expected a single ranged request, got: %v", k, d.compression, m.ranges)
+			}
+		}
+	}
+}
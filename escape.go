@@ -0,0 +1,47 @@
+package s3
+
+import (
+	"net/url"
+	"strings"
+)
+
+// PercentEscape is a KeyEscapeFunc that percent-encodes spaces, unicode & other characters
+// that aren't safe in URL paths, like url.PathEscape
+func PercentEscape(segment string) string {
+	return url.PathEscape(segment)
+}
+
+// PercentUnescape is the KeyUnescapeFunc inverting PercentEscape. Segments that aren't
+// valid escapes, like those of objects written without escaping, are returned unchanged
+func PercentUnescape(segment string) string {
+	s, err := url.PathUnescape(segment)
+	if err != nil {
+		return segment
+	}
+	return s
+}
+
+// escape applies KeyEscapeFunc to each segment of the slash-separated path p
+func (ds *Datastore) escape(p string) string {
+	return mapSegments(p, ds.escapeFn)
+}
+
+// unescape applies KeyUnescapeFunc to each segment of the slash-separated path p
+func (ds *Datastore) unescape(p string) string {
+	return mapSegments(p, ds.unescapeFn)
+}
+
+// mapSegments replaces each non-empty segment of the slash-separated path p with fn of it,
+// returning p unchanged if fn is nil
+func mapSegments(p string, fn func(string) string) string {
+	if fn == nil || p == "" {
+		return p
+	}
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		if s != "" {
+			segments[i] = fn(s)
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,88 @@
+package s3
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func TestKeyEscapeFunc(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS(func(o *Options) {
+		o.KeyEscapeFunc = PercentEscape
+		o.KeyUnescapeFunc = PercentUnescape
+	})
+
+	cases := []struct {
+		key, path string
+	}{
+		{"/with space", "with%20space"},
+		{"/café/naïve", "caf%C3%A9/na%C3%AFve"},
+		{"/café/50%", "caf%C3%A9/50%25"},
+		{"/plain/key", "plain/key"},
+	}
+
+	for i, c := range cases {
+		if err := d.Put(ctx, ds.NewKey(c.key), []byte(c.key)); err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if _, ok := m.objects[c.path]; !ok {
+			t.Errorf("case %d expected object at escaped path %q", i, c.path)
+		}
+		got, err := d.Get(ctx, ds.NewKey(c.key))
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if string(got) != c.key {
+			t.Errorf("case %d value mismatch. expected: %q, got: %q", i, c.key, got)
+		}
+	}
+
+	queries := []struct {
+		prefix string
+		expect []string
+	}{
+		{"", []string{"/café/50%", "/café/naïve", "/plain/key", "/with space"}},
+		{"/café", []string{"/café/50%", "/café/naïve"}},
+		{"/with sp", []string{}},
+	}
+	for i, c := range queries {
+		res, err := d.Query(ctx, dsq.Query{Prefix: c.prefix, KeysOnly: true})
+		if err != nil {
+			t.Fatalf("query %d unexpected error: %s", i, err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatalf("query %d unexpected error: %s", i, err)
+		}
+		keys := make([]string, len(entries))
+		for j, e := range entries {
+			keys[j] = e.Key
+		}
+		sort.Strings(keys)
+		if len(keys) != len(c.expect) {
+			t.Errorf("query %d keys mismatch. expected: %v, got: %v", i, c.expect, keys)
+			continue
+		}
+		for j := range keys {
+			if keys[j] != c.expect[j] {
+				t.Errorf("query %d keys mismatch. expected: %v, got: %v", i, c.expect, keys)
+				break
+			}
+		}
+	}
+
+	if got := PercentUnescape("100%zz"); got != "100%zz" {
+		t.Errorf("invalid escape mismatch. expected: %q, got: %q", "100%zz", got)
+	}
+	if _, err := NewDatastoreWithError(bucketName, func(o *Options) {
+		o.S3API = m
+		o.AccessKey, o.AccessSecret = "key", "secret"
+		o.KeyEscapeFunc = PercentEscape
+	}); err == nil || err.Error() != "KeyEscapeFunc and KeyUnescapeFunc must be set together" {
+		t.Errorf("unpaired escape func error mismatch. got: %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+module github.com/qri-io/go-ds-s3
+
+go 1.17
+
+require (
+	github.com/aws/aws-sdk-go v1.44.0
+	github.com/ipfs/go-datastore v0.5.1
+	github.com/jbenet/goprocess v0.1.4
+)
+
+require (
+	github.com/google/uuid v1.1.1 // indirect
+	github.com/ipfs/go-detect-race v0.0.1 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+)
@@ -0,0 +1,38 @@
+package s3
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const (
+	// inlineValueKey is the user metadata key inline values are stored under
+	inlineValueKey = "inline-value"
+	// maxInlineValueSize is the largest InlineSmallValues threshold. S3 limits user metadata
+	// to 2KB, and base64 grows values by a third
+	maxInlineValueSize = 1024
+)
+
+// inline reports whether value should be stored in metadata. nil values are streamed
+// writes, which are never inlined
+func (ds *Datastore) inline(value []byte) bool {
+	return value != nil && len(value) < ds.inlineValues
+}
+
+// inlineValue returns the value stored in user metadata md, if any. The SDK canonicalizes
+// metadata keys read from response headers, so keys are matched regardless of case
+func inlineValue(md map[string]*string) ([]byte, bool, error) {
+	for k, v := range md {
+		if strings.EqualFold(k, inlineValueKey) {
+			value, err := base64.StdEncoding.DecodeString(aws.StringValue(v))
+			if err != nil {
+				return nil, false, fmt.Errorf("decoding inline value: %s", err)
+			}
+			return value, true, nil
+		}
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,121 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestInlineSmallValues(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		size   int
+		inline bool
+	}{
+		{1, true},
+		{99, true},
+		{100, false},
+		{101, false},
+	}
+
+	for _, compression := range []string{"", "gzip"} {
+		d, m := newMockDS(func(o *Options) {
+			o.InlineSmallValues = 100
+			o.Compression = compression
+			o.Metadata = map[string]string{"owner": "test"}
+		})
+
+		for i, c := range cases {
+			key := ds.NewKey("/a")
+			value := bytes.Repeat([]byte("v"), c.size)
+			if err := d.Put(ctx, key, value); err != nil {
+				t.Fatal(err)
+			}
+			if stored := len(m.objects["a"]) == 0; stored != c.inline {
+				t.Errorf("case %d compression %q expected inline %t, got body of %d bytes", i, compression, c.inline, len(m.objects["a"]))
+			}
+			if c.inline && m.encodings["a"] != "" {
+				t.Errorf("case %d expected inline values not to be compressed", i)
+			}
+
+			got, err := d.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("case %d unexpected error: %s", i, err)
+			}
+			if !bytes.Equal(got, value) {
+				t.Errorf("case %d compression %q value mismatch. expected: %q, got: %q", i, compression, value, got)
+			}
+
+			r, err := d.GetStream(ctx, key)
+			if err != nil {
+				t.Fatalf("case %d unexpected error: %s", i, err)
+			}
+			streamed, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(streamed, value) {
+				t.Errorf("case %d streamed value mismatch. expected: %q, got: %q, %v", i, value, streamed, err)
+			}
+
+			if parallel, err := d.GetParallel(ctx, key); err != nil || !bytes.Equal(parallel, value) {
+				t.Errorf("case %d parallel value mismatch. expected: %q, got: %q, %v", i, value, parallel, err)
+			}
+			expect := value[:1]
+			if c.size > 1 {
+				expect = value[1:2]
+			}
+			if ranged, err := d.GetRange(ctx, key, int64(c.size-1), 2); err != nil || !bytes.Equal(ranged, expect) {
+				t.Errorf("case %d range mismatch. expected: %q, got: %q, %v", i, expect, ranged, err)
+			}
+			if _, err := d.GetRange(ctx, key, int64(c.size), 1); err != ErrInvalidRange {
+				t.Errorf("case %d range past the end error mismatch. expected: %s, got: %v", i, ErrInvalidRange, err)
+			}
+
+			if size, err := d.GetSize(ctx, key); c.inline && (err != nil || size != c.size) {
+				t.Errorf("case %d size mismatch. expected: %d, got: %d, %v", i, c.size, size, err)
+			}
+
+			md, err := d.GetMetadata(ctx, key)
+			if err != nil {
+				t.Fatalf("case %d unexpected error: %s", i, err)
+			}
+			if _, ok := md[inlineValueKey]; ok || md["owner"] != "test" {
+				t.Errorf("case %d expected only user metadata, got: %v", i, md)
+			}
+		}
+	}
+
+	// inline values are read whether or not the option is set
+	d, m := newMockDS(func(o *Options) {
+		o.InlineSmallValues = 100
+	})
+	if err := d.Put(ctx, ds.NewKey("/b"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	plain := NewDatastore(bucketName, func(o *Options) {
+		o.S3API = m
+	})
+	if got, err := plain.Get(ctx, ds.NewKey("/b")); err != nil || string(got) != "b" {
+		t.Errorf("expected inline value to be read without the option, got: %q, %v", got, err)
+	}
+	if got, err := plain.GetParallel(ctx, ds.NewKey("/b")); err != nil || string(got) != "b" {
+		t.Errorf("expected inline value to be downloaded without the option, got: %q, %v", got, err)
+	}
+	if got, err := plain.GetRange(ctx, ds.NewKey("/b"), 0, 10); err != nil || string(got) != "b" {
+		t.Errorf("expected inline range to be read without the option, got: %q, %v", got, err)
+	}
+	if _, err := plain.GetRange(ctx, ds.NewKey("/b"), 1, 1); err != ErrInvalidRange {
+		t.Errorf("inline range past the end error mismatch. expected: %s, got: %v", ErrInvalidRange, err)
+	}
+
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.Region = "us-east-1"
+		o.InlineSmallValues = 2048
+	})
+	expect := "InlineSmallValues can't exceed 1024 bytes, got: 2048"
+	if err := d.configError(); err == nil || err.Error() != expect {
+		t.Errorf("config error mismatch. expected: %s, got: %v", expect, err)
+	}
+}
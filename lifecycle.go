@@ -0,0 +1,97 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+	datastore "github.com/ipfs/go-datastore"
+)
+
+// expirationRuleID prefixes the IDs of lifecycle rules SetExpiration installs
+const expirationRuleID = "go-ds-s3-expire:"
+
+// SetExpiration installs a bucket lifecycle rule that makes S3 delete objects under prefix
+// days after they're written, eg. to give a cache a TTL. Like ListKeys the prefix matches
+// keys as strings. Other lifecycle rules on the bucket are kept, while any rule
+// SetExpiration installed for prefix before is replaced, and rules using the deprecated
+// top-level Prefix are rewritten to an equivalent Filter. Setting days to zero removes the
+// rule. S3 applies lifecycle rules asynchronously, usually within a day. Requires the
+// s3:GetLifecycleConfiguration and s3:PutLifecycleConfiguration permissions
+func (ds *Datastore) SetExpiration(ctx context.Context, prefix string, days int) error {
+	if ds.readOnly {
+		return ErrReadOnly
+	}
+	if days < 0 {
+		return errors.New("expiration days can't be negative")
+	}
+	// keys under prefix are spread across every shard
+	if ds.shardFn != nil && strings.Trim(prefix, "/") != "" {
+		return errors.New("SetExpiration can't expire a prefix of a sharded datastore")
+	}
+
+	path := ds.stringPath(prefix)
+	id := expirationRuleID + path
+
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	c, err := ds.client()
+	if err != nil {
+		return err
+	}
+	rules := []*awsS3.LifecycleRule{}
+	res, err := c.GetBucketLifecycleConfigurationWithContext(ctx, &awsS3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(ds.Bucket),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "NoSuchLifecycleConfiguration" {
+			return ctxErr(ctx, err)
+		}
+	} else {
+		for _, rule := range res.Rules {
+			if aws.StringValue(rule.ID) == id {
+				continue
+			}
+			// S3 rejects configurations mixing rules with a Filter and legacy rules with a
+			// top-level Prefix, which apply to the same objects as a Filter of that Prefix
+			if rule.Filter == nil {
+				legacy := *rule
+				legacy.Filter = &awsS3.LifecycleRuleFilter{Prefix: aws.String(aws.StringValue(rule.Prefix))}
+				legacy.Prefix = nil
+				rule = &legacy
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	if days > 0 {
+		rules = append(rules, &awsS3.LifecycleRule{
+			ID:         aws.String(id),
+			Status:     aws.String(awsS3.ExpirationStatusEnabled),
+			Filter:     &awsS3.LifecycleRuleFilter{Prefix: aws.String(path)},
+			Expiration: &awsS3.LifecycleExpiration{Days: aws.Int64(int64(days))},
+		})
+	}
+
+	if ds.dryRun {
+		ds.logDryRun("SetExpiration", datastore.NewKey(prefix))
+		return nil
+	}
+
+	// S3 rejects lifecycle configurations without rules
+	if len(rules) == 0 {
+		_, err = c.DeleteBucketLifecycleWithContext(ctx, &awsS3.DeleteBucketLifecycleInput{
+			Bucket: aws.String(ds.Bucket),
+		})
+		return ctxErr(ctx, err)
+	}
+	_, err = c.PutBucketLifecycleConfigurationWithContext(ctx, &awsS3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(ds.Bucket),
+		LifecycleConfiguration: &awsS3.BucketLifecycleConfiguration{Rules: rules},
+	})
+	return ctxErr(ctx, err)
+}
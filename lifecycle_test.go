@@ -0,0 +1,127 @@
+package s3
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestSetExpiration(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS(func(o *Options) {
+		o.Path = "folder"
+	})
+	other := &awsS3.LifecycleRule{
+		ID:     aws.String("abort-uploads"),
+		Status: aws.String(awsS3.ExpirationStatusEnabled),
+		Filter: &awsS3.LifecycleRuleFilter{Prefix: aws.String("")},
+		AbortIncompleteMultipartUpload: &awsS3.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int64(1),
+		},
+	}
+	m.lifecycle = &awsS3.BucketLifecycleConfiguration{Rules: []*awsS3.LifecycleRule{other}}
+
+	// expect checks the bucket has the other rule plus an expiration of days for each
+	// expected prefix, in order
+	expect := func(step string, prefixes []string, days []int64) {
+		if m.lifecycle == nil {
+			t.Fatalf("%s: expected a lifecycle configuration", step)
+		}
+		rules := m.lifecycle.Rules
+		if len(rules) != len(prefixes)+1 || rules[0] != other {
+			t.Fatalf("%s: expected other rule to be kept & %d expiration rules, got: %v", step, len(prefixes), rules)
+		}
+		for i, rule := range rules[1:] {
+			if id := aws.StringValue(rule.ID); id != expirationRuleID+prefixes[i] {
+				t.Errorf("%s: rule %d ID mismatch. expected: %s, got: %s", step, i, expirationRuleID+prefixes[i], id)
+			}
+			if p := aws.StringValue(rule.Filter.Prefix); p != prefixes[i] {
+				t.Errorf("%s: rule %d prefix mismatch. expected: %s, got: %s", step, i, prefixes[i], p)
+			}
+			if n := aws.Int64Value(rule.Expiration.Days); n != days[i] {
+				t.Errorf("%s: rule %d days mismatch. expected: %d, got: %d", step, i, days[i], n)
+			}
+			if aws.StringValue(rule.Status) != awsS3.ExpirationStatusEnabled {
+				t.Errorf("%s: rule %d expected to be enabled", step, i)
+			}
+		}
+	}
+
+	if err := d.SetExpiration(ctx, "/cache", 7); err != nil {
+		t.Fatal(err)
+	}
+	expect("set", []string{"folder/cache"}, []int64{7})
+
+	if err := d.SetExpiration(ctx, "/tmp/", 1); err != nil {
+		t.Fatal(err)
+	}
+	expect("add", []string{"folder/cache", "folder/tmp/"}, []int64{7, 1})
+
+	if err := d.SetExpiration(ctx, "/cache", 30); err != nil {
+		t.Fatal(err)
+	}
+	expect("replace", []string{"folder/tmp/", "folder/cache"}, []int64{1, 30})
+
+	if err := d.SetExpiration(ctx, "/cache", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetExpiration(ctx, "/tmp/", 0); err != nil {
+		t.Fatal(err)
+	}
+	expect("remove", nil, nil)
+
+	// removing the last rule removes the configuration
+	m.lifecycle.Rules = nil
+	if err := d.SetExpiration(ctx, "/cache", 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetExpiration(ctx, "/cache", 0); err != nil {
+		t.Fatal(err)
+	}
+	if m.lifecycle != nil {
+		t.Errorf("expected lifecycle configuration to be removed, got: %v", m.lifecycle)
+	}
+
+	sharded, _ := newMockDS(func(o *Options) {
+		o.ShardFunc = ShardNextToLast(2)
+	})
+	if err := sharded.SetExpiration(ctx, "/cache", 7); err == nil {
+		t.Error("expected an error expiring a prefix of a sharded datastore")
+	}
+	if err := d.SetExpiration(ctx, "/cache", -1); err == nil {
+		t.Error("expected an error for negative days")
+	}
+}
+
+func TestSetExpirationLegacyRules(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
+	// legacy rules have a top-level Prefix in place of a Filter
+	legacy := &awsS3.LifecycleRule{
+		ID:         aws.String("expire-logs"),
+		Status:     aws.String(awsS3.ExpirationStatusEnabled),
+		Prefix:     aws.String("logs/"),
+		Expiration: &awsS3.LifecycleExpiration{Days: aws.Int64(90)},
+	}
+	m.lifecycle = &awsS3.BucketLifecycleConfiguration{Rules: []*awsS3.LifecycleRule{legacy}}
+
+	if err := d.SetExpiration(ctx, "/cache", 7); err != nil {
+		t.Fatal(err)
+	}
+	rules := m.lifecycle.Rules
+	if len(rules) != 2 {
+		t.Fatalf("expected legacy rule to be kept & an expiration rule, got: %v", rules)
+	}
+	rule := rules[0]
+	if aws.StringValue(rule.ID) != "expire-logs" || aws.Int64Value(rule.Expiration.Days) != 90 {
+		t.Errorf("expected legacy rule to be kept, got: %v", rule)
+	}
+	if rule.Prefix != nil || rule.Filter == nil || aws.StringValue(rule.Filter.Prefix) != "logs/" {
+		t.Errorf("expected legacy rule prefix to be moved to a filter, got: %v", rule)
+	}
+	if aws.StringValue(legacy.Prefix) != "logs/" || legacy.Filter != nil {
+		t.Errorf("expected the listed rule to be left unmodified, got: %v", legacy)
+	}
+}
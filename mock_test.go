@@ -0,0 +1,544 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// mockS3 is an in-memory implementation of the S3 API, keyed by object path within the
+// bucket. Calling a method mockS3 doesn't implement panics
+type mockS3 struct {
+	s3iface.S3API
+
+	lk      sync.Mutex
+	objects map[string][]byte
+	// encodings holds the Content-Encoding each object was written with
+	encodings map[string]string
+	// md5s holds the Content-MD5 each object was written with
+	md5s map[string]string
+	// tags holds the URL-encoded tag set each object was written with
+	tags map[string]string
+	// metadata holds the user metadata of each object, with keys canonicalized like the
+	// SDK reads them from response headers
+	metadata map[string]map[string]*string
+	// requests records the operation name of every request made
+	requests []string
+	// lists records every list request made
+	lists []*awsS3.ListObjectsV2Input
+	// deletes records the number of keys in every DeleteObjects request made
+	deletes []int
+	// reads counts GetObject & HeadObject requests
+	reads int
+	// ranges records the Range of every ranged GetObject request
+	ranges []string
+	// lifecycle is the bucket's lifecycle configuration, if any
+	lifecycle *awsS3.BucketLifecycleConfiguration
+	// uploads holds the parts of in-progress multipart uploads by upload ID
+	uploads map[string]map[int64][]byte
+	// creates holds the requests that started in-progress multipart uploads by upload ID
+	creates map[string]*awsS3.CreateMultipartUploadInput
+	// parts records the number of parts each completed multipart upload was joined from
+	parts map[string]int
+	// aborts counts aborted multipart uploads
+	aborts int
+	// failPart is a part number UploadPart fails to write, if nonzero
+	failPart int64
+	// fail holds paths every request for fails with an internal error
+	fail map[string]bool
+	// etags overrides the ETag of objects, eg. to simulate corruption
+	etags map[string]string
+	// modified overrides the time objects are listed as last modified at
+	modified map[string]time.Time
+	// versioned keeps every value written to a key, identifying versions by their position
+	// in the key's history
+	versioned bool
+	versions  map[string][][]byte
+}
+
+func newMockS3() *mockS3 {
+	return &mockS3{
+		objects:   map[string][]byte{},
+		encodings: map[string]string{},
+		md5s:      map[string]string{},
+		tags:      map[string]string{},
+		metadata:  map[string]map[string]*string{},
+		uploads:   map[string]map[int64][]byte{},
+		creates:   map[string]*awsS3.CreateMultipartUploadInput{},
+		parts:     map[string]int{},
+		fail:      map[string]bool{},
+		etags:     map[string]string{},
+		modified:  map[string]time.Time{},
+		versions:  map[string][][]byte{},
+	}
+}
+
+// newMockDS creates a datastore backed by a mockS3
+func newMockDS(options ...func(o *Options)) (*Datastore, *mockS3) {
+	m := newMockS3()
+	return NewDatastore(bucketName, append([]func(o *Options){func(o *Options) {
+		o.S3API = m
+	}}, options...)...), m
+}
+
+func (m *mockS3) PutObjectWithContext(ctx aws.Context, input *awsS3.PutObjectInput, opts ...request.Option) (*awsS3.PutObjectOutput, error) {
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	if input.ContentMD5 != nil && aws.StringValue(input.ContentMD5) != contentMD5(body) {
+		return nil, awserr.NewRequestFailure(awserr.New("BadDigest", "The Content-MD5 you specified did not match what we received.", nil), http.StatusBadRequest, "")
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "PutObject")
+	if m.fail[aws.StringValue(input.Key)] {
+		return nil, errInjected
+	}
+	if _, ok := m.objects[aws.StringValue(input.Key)]; ok && requestHeaders(opts).Get("If-None-Match") == "*" {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil), http.StatusPreconditionFailed, "")
+	}
+	m.objects[aws.StringValue(input.Key)] = body
+	delete(m.parts, aws.StringValue(input.Key))
+	m.encodings[aws.StringValue(input.Key)] = aws.StringValue(input.ContentEncoding)
+	m.md5s[aws.StringValue(input.Key)] = aws.StringValue(input.ContentMD5)
+	m.tags[aws.StringValue(input.Key)] = aws.StringValue(input.Tagging)
+	md := map[string]*string{}
+	for k, v := range input.Metadata {
+		md[http.CanonicalHeaderKey(k)] = v
+	}
+	m.metadata[aws.StringValue(input.Key)] = md
+
+	res := &awsS3.PutObjectOutput{ETag: aws.String(m.etag(aws.StringValue(input.Key)))}
+	if m.versioned {
+		m.versions[aws.StringValue(input.Key)] = append(m.versions[aws.StringValue(input.Key)], body)
+		res.VersionId = aws.String(fmt.Sprintf("v%d", len(m.versions[aws.StringValue(input.Key)])))
+	}
+	return res, nil
+}
+
+// requestCount returns the number of requests made for an operation
+func (m *mockS3) requestCount(op string) int {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	n := 0
+	for _, r := range m.requests {
+		if r == op {
+			n++
+		}
+	}
+	return n
+}
+
+// addObjects writes objects to the mock, keyed by their path within the bucket
+func (m *mockS3) addObjects(objects map[string]string) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	for k, v := range objects {
+		m.objects[k] = []byte(v)
+	}
+}
+
+// etag returns the ETag of the object at path: the MD5 of its contents, or of its parts
+// suffixed with the part count for multipart uploads. Callers must hold m.lk
+func (m *mockS3) etag(path string) string {
+	if etag, ok := m.etags[path]; ok {
+		return etag
+	}
+	if parts := m.parts[path]; parts > 0 {
+		return fmt.Sprintf(`"%x-%d"`, md5.Sum(m.objects[path]), parts)
+	}
+	return fmt.Sprintf(`"%x"`, md5.Sum(m.objects[path]))
+}
+
+// version returns the value of the object at path, or of one of its versions
+func (m *mockS3) version(path string, versionID *string) ([]byte, bool) {
+	if versionID == nil {
+		v, ok := m.objects[path]
+		return v, ok
+	}
+	history := m.versions[path]
+	i := 0
+	fmt.Sscanf(aws.StringValue(versionID), "v%d", &i)
+	if i < 1 || i > len(history) {
+		return nil, false
+	}
+	return history[i-1], true
+}
+
+// errInjected is the error requests for paths in mockS3.fail fail with
+var errInjected = awserr.NewRequestFailure(awserr.New("InternalError", "injected failure", nil), http.StatusInternalServerError, "")
+
+// requestHeaders returns the headers opts set on a request
+func requestHeaders(opts []request.Option) http.Header {
+	r := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+	r.ApplyOptions(opts...)
+	return r.HTTPRequest.Header
+}
+
+func (m *mockS3) GetObjectWithContext(ctx aws.Context, input *awsS3.GetObjectInput, opts ...request.Option) (*awsS3.GetObjectOutput, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "GetObject")
+	m.reads++
+	if m.fail[aws.StringValue(input.Key)] {
+		return nil, errInjected
+	}
+
+	v, ok := m.version(aws.StringValue(input.Key), input.VersionId)
+	if !ok {
+		return nil, awserr.New(awsS3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+
+	res := &awsS3.GetObjectOutput{
+		ETag:     aws.String(m.etag(aws.StringValue(input.Key))),
+		Metadata: m.metadata[aws.StringValue(input.Key)],
+	}
+	if encoding := m.encodings[aws.StringValue(input.Key)]; encoding != "" {
+		res.ContentEncoding = aws.String(encoding)
+	}
+	if input.Range != nil {
+		m.ranges = append(m.ranges, aws.StringValue(input.Range))
+		var start, end int
+		if _, err := fmt.Sscanf(aws.StringValue(input.Range), "bytes=%d-%d", &start, &end); err != nil {
+			return nil, err
+		}
+		if start >= len(v) {
+			return nil, awserr.NewRequestFailure(awserr.New("InvalidRange", "The requested range is not satisfiable", nil), http.StatusRequestedRangeNotSatisfiable, "")
+		}
+		if end >= len(v) {
+			end = len(v) - 1
+		}
+		res.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(v)))
+		v = v[start : end+1]
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(v))
+	res.ContentLength = aws.Int64(int64(len(v)))
+	return res, nil
+}
+
+func (m *mockS3) CreateMultipartUploadWithContext(ctx aws.Context, input *awsS3.CreateMultipartUploadInput, opts ...request.Option) (*awsS3.CreateMultipartUploadOutput, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "CreateMultipartUpload")
+
+	id := fmt.Sprintf("upload-%d", len(m.uploads))
+	m.uploads[id] = map[int64][]byte{}
+	m.creates[id] = input
+	return &awsS3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (m *mockS3) UploadPartWithContext(ctx aws.Context, input *awsS3.UploadPartInput, opts ...request.Option) (*awsS3.UploadPartOutput, error) {
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "UploadPart")
+	parts, ok := m.uploads[aws.StringValue(input.UploadId)]
+	if !ok {
+		return nil, awserr.New(awsS3.ErrCodeNoSuchUpload, "The specified upload does not exist.", nil)
+	}
+	if m.failPart != 0 && aws.Int64Value(input.PartNumber) == m.failPart {
+		return nil, awserr.New("InternalError", "We encountered an internal error. Please try again.", nil)
+	}
+	parts[aws.Int64Value(input.PartNumber)] = body
+	return &awsS3.UploadPartOutput{ETag: aws.String(fmt.Sprintf(`"part-%d"`, aws.Int64Value(input.PartNumber)))}, nil
+}
+
+// CompleteMultipartUploadWithContext joins the uploaded parts in the order listed
+func (m *mockS3) CompleteMultipartUploadWithContext(ctx aws.Context, input *awsS3.CompleteMultipartUploadInput, opts ...request.Option) (*awsS3.CompleteMultipartUploadOutput, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "CompleteMultipartUpload")
+
+	parts, ok := m.uploads[aws.StringValue(input.UploadId)]
+	if !ok {
+		return nil, awserr.New(awsS3.ErrCodeNoSuchUpload, "The specified upload does not exist.", nil)
+	}
+	var body []byte
+	for _, part := range input.MultipartUpload.Parts {
+		body = append(body, parts[aws.Int64Value(part.PartNumber)]...)
+	}
+	create := m.creates[aws.StringValue(input.UploadId)]
+	delete(m.uploads, aws.StringValue(input.UploadId))
+	delete(m.creates, aws.StringValue(input.UploadId))
+	m.parts[aws.StringValue(input.Key)] = len(input.MultipartUpload.Parts)
+	m.objects[aws.StringValue(input.Key)] = body
+	m.encodings[aws.StringValue(input.Key)] = aws.StringValue(create.ContentEncoding)
+	md := map[string]*string{}
+	for k, v := range create.Metadata {
+		md[http.CanonicalHeaderKey(k)] = v
+	}
+	m.metadata[aws.StringValue(input.Key)] = md
+	return &awsS3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *mockS3) AbortMultipartUploadWithContext(ctx aws.Context, input *awsS3.AbortMultipartUploadInput, opts ...request.Option) (*awsS3.AbortMultipartUploadOutput, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "AbortMultipartUpload")
+
+	m.aborts++
+	delete(m.uploads, aws.StringValue(input.UploadId))
+	delete(m.creates, aws.StringValue(input.UploadId))
+	return &awsS3.AbortMultipartUploadOutput{}, nil
+}
+
+// GetObjectRequest builds requests with a real client, for the Uploader to presign the
+// location of uploaded objects. The requests are never sent
+func (m *mockS3) GetObjectRequest(input *awsS3.GetObjectInput) (*request.Request, *awsS3.GetObjectOutput) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.AnonymousCredentials,
+	}))
+	return awsS3.New(sess).GetObjectRequest(input)
+}
+
+// CopyObjectWithContext copies objects within the mock, which ignores the bucket
+func (m *mockS3) CopyObjectWithContext(ctx aws.Context, input *awsS3.CopyObjectInput, opts ...request.Option) (*awsS3.CopyObjectOutput, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "CopyObject")
+
+	source, err := url.PathUnescape(aws.StringValue(input.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	source = source[strings.IndexByte(source, '/')+1:]
+	if m.fail[source] || m.fail[aws.StringValue(input.Key)] {
+		return nil, errInjected
+	}
+	v, ok := m.objects[source]
+	if !ok {
+		return nil, awserr.New(awsS3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	m.objects[aws.StringValue(input.Key)] = v
+	delete(m.parts, aws.StringValue(input.Key))
+	m.encodings[aws.StringValue(input.Key)] = m.encodings[source]
+	m.metadata[aws.StringValue(input.Key)] = m.metadata[source]
+	m.tags[aws.StringValue(input.Key)] = m.tags[source]
+	return &awsS3.CopyObjectOutput{}, nil
+}
+
+func (m *mockS3) HeadObjectWithContext(ctx aws.Context, input *awsS3.HeadObjectInput, opts ...request.Option) (*awsS3.HeadObjectOutput, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "HeadObject")
+	m.reads++
+	if m.fail[aws.StringValue(input.Key)] {
+		return nil, errInjected
+	}
+
+	v, ok := m.version(aws.StringValue(input.Key), input.VersionId)
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "")
+	}
+	res := &awsS3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(v))),
+		ETag:          aws.String(m.etag(aws.StringValue(input.Key))),
+		Metadata:      m.metadata[aws.StringValue(input.Key)],
+	}
+	if encoding := m.encodings[aws.StringValue(input.Key)]; encoding != "" {
+		res.ContentEncoding = aws.String(encoding)
+	}
+	return res, nil
+}
+
+func (m *mockS3) GetObjectTaggingWithContext(ctx aws.Context, input *awsS3.GetObjectTaggingInput, opts ...request.Option) (*awsS3.GetObjectTaggingOutput, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "GetObjectTagging")
+
+	if _, ok := m.objects[aws.StringValue(input.Key)]; !ok {
+		return nil, awserr.New(awsS3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	tags, err := url.ParseQuery(m.tags[aws.StringValue(input.Key)])
+	if err != nil {
+		return nil, err
+	}
+	res := &awsS3.GetObjectTaggingOutput{TagSet: []*awsS3.Tag{}}
+	for k := range tags {
+		res.TagSet = append(res.TagSet, &awsS3.Tag{Key: aws.String(k), Value: aws.String(tags.Get(k))})
+	}
+	return res, nil
+}
+
+func (m *mockS3) DeleteObjectWithContext(ctx aws.Context, input *awsS3.DeleteObjectInput, opts ...request.Option) (*awsS3.DeleteObjectOutput, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "DeleteObject")
+	if m.fail[aws.StringValue(input.Key)] {
+		return nil, errInjected
+	}
+
+	delete(m.objects, aws.StringValue(input.Key))
+	return &awsS3.DeleteObjectOutput{}, nil
+}
+
+func (m *mockS3) DeleteObjectsWithContext(ctx aws.Context, input *awsS3.DeleteObjectsInput, opts ...request.Option) (*awsS3.DeleteObjectsOutput, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "DeleteObjects")
+
+	m.deletes = append(m.deletes, len(input.Delete.Objects))
+	res := &awsS3.DeleteObjectsOutput{}
+	for _, obj := range input.Delete.Objects {
+		if m.fail[aws.StringValue(obj.Key)] {
+			res.Errors = append(res.Errors, &awsS3.Error{Key: obj.Key, Code: aws.String("InternalError"), Message: aws.String("injected failure")})
+			continue
+		}
+		delete(m.objects, aws.StringValue(obj.Key))
+	}
+	return res, nil
+}
+
+// ListObjectsV2WithContext lists objects in key order, grouping keys by Delimiter into
+// CommonPrefixes. The last key or prefix of a page is used as the continuation token
+func (m *mockS3) ListObjectsV2WithContext(ctx aws.Context, input *awsS3.ListObjectsV2Input, opts ...request.Option) (*awsS3.ListObjectsV2Output, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "ListObjectsV2")
+	m.lists = append(m.lists, input)
+
+	prefix, delim := aws.StringValue(input.Prefix), aws.StringValue(input.Delimiter)
+	names := []string{}
+	prefixes := map[string]bool{}
+	for k := range m.objects {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		name := k
+		if i := strings.Index(k[len(prefix):], delim); delim != "" && i >= 0 {
+			name = k[:len(prefix)+i+len(delim)]
+			if prefixes[name] {
+				continue
+			}
+			prefixes[name] = true
+		}
+		if name > aws.StringValue(input.ContinuationToken) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	res := &awsS3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	if max := int(aws.Int64Value(input.MaxKeys)); max > 0 && len(names) > max {
+		names = names[:max]
+		res.IsTruncated = aws.Bool(true)
+		res.NextContinuationToken = aws.String(names[max-1])
+	}
+	for _, name := range names {
+		if prefixes[name] {
+			res.CommonPrefixes = append(res.CommonPrefixes, &awsS3.CommonPrefix{Prefix: aws.String(name)})
+			continue
+		}
+		modified, ok := m.modified[name]
+		if !ok {
+			modified = time.Now()
+		}
+		res.Contents = append(res.Contents, &awsS3.Object{
+			Key:          aws.String(name),
+			Size:         aws.Int64(int64(len(m.objects[name]))),
+			ETag:         aws.String(m.etag(name)),
+			LastModified: aws.Time(modified),
+		})
+	}
+	return res, nil
+}
+
+// ListObjectVersionsWithContext lists a version per value written to versioned objects, and
+// a "null" version of unversioned ones. Pages end on key boundaries of at most 1000 versions
+func (m *mockS3) ListObjectVersionsWithContext(ctx aws.Context, input *awsS3.ListObjectVersionsInput, opts ...request.Option) (*awsS3.ListObjectVersionsOutput, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "ListObjectVersions")
+
+	names := []string{}
+	for k := range m.objects {
+		if strings.HasPrefix(k, aws.StringValue(input.Prefix)) && k > aws.StringValue(input.KeyMarker) {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	max := int(aws.Int64Value(input.MaxKeys))
+	if max == 0 {
+		max = 1000
+	}
+	res := &awsS3.ListObjectVersionsOutput{IsTruncated: aws.Bool(false)}
+	for _, name := range names {
+		ids := []string{"null"}
+		if history := m.versions[name]; len(history) > 0 {
+			ids = ids[:0]
+			for i := range history {
+				ids = append(ids, fmt.Sprintf("v%d", i+1))
+			}
+		}
+		if len(res.Versions) > 0 && len(res.Versions)+len(ids) > max {
+			res.IsTruncated = aws.Bool(true)
+			break
+		}
+		for _, id := range ids {
+			res.Versions = append(res.Versions, &awsS3.ObjectVersion{Key: aws.String(name), VersionId: aws.String(id)})
+		}
+		res.NextKeyMarker = aws.String(name)
+	}
+	return res, nil
+}
+
+func (m *mockS3) GetBucketLifecycleConfigurationWithContext(ctx aws.Context, input *awsS3.GetBucketLifecycleConfigurationInput, opts ...request.Option) (*awsS3.GetBucketLifecycleConfigurationOutput, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "GetBucketLifecycleConfiguration")
+
+	if m.lifecycle == nil {
+		return nil, awserr.New("NoSuchLifecycleConfiguration", "The lifecycle configuration does not exist", nil)
+	}
+	return &awsS3.GetBucketLifecycleConfigurationOutput{Rules: m.lifecycle.Rules}, nil
+}
+
+func (m *mockS3) PutBucketLifecycleConfigurationWithContext(ctx aws.Context, input *awsS3.PutBucketLifecycleConfigurationInput, opts ...request.Option) (*awsS3.PutBucketLifecycleConfigurationOutput, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "PutBucketLifecycleConfiguration")
+
+	// S3 rejects configurations mixing legacy rules with a top-level Prefix and rules with a Filter
+	legacy, filtered := false, false
+	for _, rule := range input.LifecycleConfiguration.Rules {
+		legacy = legacy || rule.Filter == nil
+		filtered = filtered || rule.Filter != nil
+	}
+	if legacy && filtered {
+		return nil, awserr.NewRequestFailure(awserr.New("MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema", nil), http.StatusBadRequest, "")
+	}
+	m.lifecycle = input.LifecycleConfiguration
+	return &awsS3.PutBucketLifecycleConfigurationOutput{}, nil
+}
+
+func (m *mockS3) DeleteBucketLifecycleWithContext(ctx aws.Context, input *awsS3.DeleteBucketLifecycleInput, opts ...request.Option) (*awsS3.DeleteBucketLifecycleOutput, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requests = append(m.requests, "DeleteBucketLifecycle")
+
+	m.lifecycle = nil
+	return &awsS3.DeleteBucketLifecycleOutput{}, nil
+}
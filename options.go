@@ -0,0 +1,32 @@
+package s3
+
+// WithRegion returns an option setting the region the bucket is in
+func WithRegion(region string) func(o *Options) {
+	return func(o *Options) {
+		o.Region = region
+	}
+}
+
+// WithPath returns an option scoping the datastore to path within the bucket
+func WithPath(path string) func(o *Options) {
+	return func(o *Options) {
+		o.Path = path
+	}
+}
+
+// WithCredentials returns an option setting static credentials. token may be empty for
+// long-term credentials
+func WithCredentials(key, secret, token string) func(o *Options) {
+	return func(o *Options) {
+		o.AccessKey = key
+		o.AccessSecret = secret
+		o.AccessToken = token
+	}
+}
+
+// WithEndpoint returns an option sending requests to endpoint, eg. an S3-compatible store
+func WithEndpoint(endpoint string) func(o *Options) {
+	return func(o *Options) {
+		o.Endpoint = endpoint
+	}
+}
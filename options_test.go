@@ -0,0 +1,35 @@
+package s3
+
+import (
+	"testing"
+)
+
+func TestOptionHelpers(t *testing.T) {
+	cases := []struct {
+		option func(o *Options)
+		check  func(o *Options) bool
+	}{
+		{WithRegion("eu-west-1"), func(o *Options) bool { return o.Region == "eu-west-1" }},
+		{WithPath("folder/sub"), func(o *Options) bool { return o.Path == "folder/sub" }},
+		{WithCredentials("key", "secret", "token"), func(o *Options) bool {
+			return o.AccessKey == "key" && o.AccessSecret == "secret" && o.AccessToken == "token"
+		}},
+		{WithEndpoint("http://localhost:9000"), func(o *Options) bool { return o.Endpoint == "http://localhost:9000" }},
+	}
+
+	for i, c := range cases {
+		o := DefaultOptions()
+		c.option(o)
+		if !c.check(o) {
+			t.Errorf("case %d option not set: %#v", i, o)
+		}
+	}
+
+	// helpers mix with closures, applied in order
+	d := NewDatastore(bucketName, WithRegion("eu-west-1"), WithPath("folder"), func(o *Options) {
+		o.Path = "other"
+	})
+	if d.Region != "eu-west-1" || d.Path != "other" {
+		t.Errorf("expected region eu-west-1 & path other, got: %s & %s", d.Region, d.Path)
+	}
+}
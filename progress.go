@@ -0,0 +1,131 @@
+package s3
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	datastore "github.com/ipfs/go-datastore"
+)
+
+// progress accumulates the bytes transferred for a single key, reporting the running
+// total to fn. Reports are made while holding the lock, so concurrent parts are reported
+// in increasing order
+type progress struct {
+	lk          sync.Mutex
+	fn          func(key datastore.Key, bytesTransferred, total int64)
+	key         datastore.Key
+	transferred int64
+	total       int64
+}
+
+// add counts n more bytes as transferred
+func (p *progress) add(n int64) {
+	if n <= 0 {
+		return
+	}
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.transferred += n
+	p.fn(p.key, p.transferred, p.total)
+}
+
+// setTotal records the size of the transfer once it's known
+func (p *progress) setTotal(total int64) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.total = total
+}
+
+// progressClient wraps a client to report the parts uploaded & downloaded through it by
+// the s3manager Uploader & Downloader
+type progressClient struct {
+	s3iface.S3API
+	progress *progress
+}
+
+// withProgress wraps client to report the transfer of key to ProgressFunc, if set. total
+// is the size of the transfer, or -1 if it isn't known yet
+func (ds *Datastore) withProgress(client s3iface.S3API, key datastore.Key, total int64) s3iface.S3API {
+	if ds.progressFn == nil {
+		return client
+	}
+	return &progressClient{
+		S3API:    client,
+		progress: &progress{fn: ds.progressFn, key: key, total: total},
+	}
+}
+
+func (c *progressClient) UploadPartWithContext(ctx aws.Context, input *awsS3.UploadPartInput, opts ...request.Option) (*awsS3.UploadPartOutput, error) {
+	size, err := seekerLen(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.S3API.UploadPartWithContext(ctx, input, opts...)
+	if err == nil {
+		c.progress.add(size)
+	}
+	return res, err
+}
+
+// PutObjectRequest is used by the Uploader for streams that fit in a single part
+func (c *progressClient) PutObjectRequest(input *awsS3.PutObjectInput) (*request.Request, *awsS3.PutObjectOutput) {
+	req, res := c.S3API.PutObjectRequest(input)
+	size, err := seekerLen(input.Body)
+	if err == nil {
+		req.Handlers.Complete.PushBack(func(r *request.Request) {
+			if r.Error == nil {
+				c.progress.add(size)
+			}
+		})
+	}
+	return req, res
+}
+
+func (c *progressClient) GetObjectWithContext(ctx aws.Context, input *awsS3.GetObjectInput, opts ...request.Option) (*awsS3.GetObjectOutput, error) {
+	res, err := c.S3API.GetObjectWithContext(ctx, input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var start, end, total int64
+	if _, err := fmt.Sscanf(aws.StringValue(res.ContentRange), "bytes %d-%d/%d", &start, &end, &total); err == nil {
+		c.progress.setTotal(total)
+	}
+	res.Body = &progressReadCloser{ReadCloser: res.Body, progress: c.progress}
+	return res, nil
+}
+
+// progressReadCloser reports bytes as they're read from a response body
+type progressReadCloser struct {
+	io.ReadCloser
+	progress *progress
+}
+
+func (r *progressReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.progress.add(int64(n))
+	return n, err
+}
+
+// seekerLen returns the number of bytes remaining in r, leaving its position unchanged
+func seekerLen(r io.ReadSeeker) (int64, error) {
+	if r == nil {
+		return 0, nil
+	}
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.Seek(pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return end - pos, nil
+}
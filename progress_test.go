@@ -0,0 +1,81 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// progressLog records the calls made to a ProgressFunc
+type progressLog struct {
+	lk    sync.Mutex
+	calls [][2]int64
+}
+
+func (l *progressLog) report(key ds.Key, bytesTransferred, total int64) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.calls = append(l.calls, [2]int64{bytesTransferred, total})
+}
+
+// check fails t unless bytes transferred increased to total with every call
+func (l *progressLog) check(t *testing.T, op string, total int64) {
+	t.Helper()
+	if len(l.calls) < 2 {
+		t.Fatalf("%s expected progress to be reported for each part, got: %v", op, l.calls)
+	}
+	var last int64
+	for i, call := range l.calls {
+		if call[0] <= last {
+			t.Errorf("%s call %d bytes transferred didn't increase. previous: %d, got: %d", op, i, last, call[0])
+		}
+		if call[1] != total {
+			t.Errorf("%s call %d total mismatch. expected: %d, got: %d", op, i, total, call[1])
+		}
+		last = call[0]
+	}
+	if last != total {
+		t.Errorf("%s bytes transferred mismatch. expected: %d, got: %d", op, total, last)
+	}
+}
+
+func TestProgressFunc(t *testing.T) {
+	ctx := context.Background()
+	log := &progressLog{}
+	d, _ := newMockDS(func(o *Options) {
+		o.MultipartThreshold = s3manager.MinUploadPartSize
+		o.MultipartPartSize = s3manager.MinUploadPartSize
+		o.DownloadPartSize = s3manager.MinUploadPartSize
+		o.ProgressFunc = log.report
+	})
+
+	// large enough to be split into three parts
+	value := bytes.Repeat([]byte("progress"), int(s3manager.MinUploadPartSize)*5/16)
+	if err := d.Put(ctx, ds.NewKey("/large"), value); err != nil {
+		t.Fatal(err)
+	}
+	log.check(t, "put", int64(len(value)))
+
+	log.calls = nil
+	got, err := d.GetParallel(ctx, ds.NewKey("/large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("value mismatch. expected %d bytes, got %d", len(value), len(got))
+	}
+	log.check(t, "get", int64(len(value)))
+
+	// values written in a single request aren't reported
+	log.calls = nil
+	if err := d.Put(ctx, ds.NewKey("/small"), []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if len(log.calls) != 0 {
+		t.Errorf("expected no progress for a single request put, got: %v", log.calls)
+	}
+}
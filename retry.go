@@ -0,0 +1,131 @@
+package s3
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	datastore "github.com/ipfs/go-datastore"
+)
+
+// retryThrottled calls fn, retrying up to ThrottleRetries times while it fails with a
+// throttling error. The last error is returned once retries are exhausted
+func (ds *Datastore) retryThrottled(ctx context.Context, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if attempt >= ds.throttleRetries || !isThrottled(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(ds.throttleDelay(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// throttleDelay picks a random delay before a retry, up to a bound that doubles with each
+// attempt from the base delay until it reaches the max delay
+func (ds *Datastore) throttleDelay(attempt int) time.Duration {
+	bound := ds.throttleBase
+	for i := 0; i < attempt && bound < ds.throttleMax; i++ {
+		bound *= 2
+	}
+	if bound > ds.throttleMax {
+		bound = ds.throttleMax
+	}
+	if bound <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(bound)))
+}
+
+// isThrottled reports whether err means S3 is shedding load and the request should be
+// retried later
+func isThrottled(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch awsErr.Code() {
+	case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequests", "ServiceUnavailable":
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusServiceUnavailable || reqErr.StatusCode() == http.StatusTooManyRequests
+	}
+	return false
+}
+
+const (
+	// readAfterWriteWindow is how long after writing a key reads that don't find it are retried
+	readAfterWriteWindow = 10 * time.Second
+	// readAfterWriteDelay is the delay before the first retried read, doubling each retry
+	readAfterWriteDelay = 50 * time.Millisecond
+)
+
+// writeLog records when object paths were last written, so reads that miss a recent
+// write can be retried
+type writeLog struct {
+	lk    sync.Mutex
+	times map[string]time.Time
+	// prune is the size times can grow to before expired writes are dropped
+	prune int
+}
+
+// record notes path was written now
+func (l *writeLog) record(path string) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	now := time.Now()
+	if l.times == nil {
+		l.times = map[string]time.Time{}
+	}
+	l.times[path] = now
+
+	if len(l.times) > l.prune {
+		for p, t := range l.times {
+			if now.Sub(t) >= readAfterWriteWindow {
+				delete(l.times, p)
+			}
+		}
+		l.prune = 2*len(l.times) + 64
+	}
+}
+
+// recent reports whether path was written within readAfterWriteWindow
+func (l *writeLog) recent(path string) bool {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	t, ok := l.times[path]
+	return ok && time.Since(t) < readAfterWriteWindow
+}
+
+// recordWrite notes a successful write of key when reads of recent writes are retried
+func (ds *Datastore) recordWrite(key datastore.Key) {
+	if ds.readRetries > 0 {
+		ds.writes.record(ds.path(key))
+	}
+}
+
+// retryReadAfterWrite calls fn, retrying up to ReadAfterWriteRetries times while it fails
+// with datastore.ErrNotFound for a key written within readAfterWriteWindow
+func (ds *Datastore) retryReadAfterWrite(ctx context.Context, key datastore.Key, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err != datastore.ErrNotFound || attempt >= ds.readRetries || !ds.writes.recent(ds.path(key)) {
+			return err
+		}
+
+		select {
+		case <-time.After(readAfterWriteDelay << uint(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestRetryThrottled(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		failures int
+		retries  int
+		attempts int
+		err      bool
+	}{
+		{0, 3, 1, false},
+		{2, 3, 3, false},
+		{3, 3, 4, false},
+		{5, 3, 4, true},
+		{1, 0, 1, true},
+	}
+
+	for i, c := range cases {
+		// respond with SlowDown to the first c.failures requests
+		attempts := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts <= c.failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprint(w, `<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`)
+				return
+			}
+			w.Write([]byte("value"))
+		}))
+
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.Endpoint = srv.URL
+			o.ForcePathStyle = true
+			o.AccessKey = "key"
+			o.AccessSecret = "secret"
+			o.MaxRetries = 0
+			o.ThrottleRetries = c.retries
+			o.ThrottleBaseDelay = time.Millisecond
+			o.ThrottleMaxDelay = 4 * time.Millisecond
+		})
+		_, err := d.Get(ctx, ds.NewKey("/a"))
+		srv.Close()
+
+		if c.err && (err == nil || !isThrottled(err)) {
+			t.Errorf("case %d expected throttling error, got: %v", i, err)
+		} else if !c.err && err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+		}
+		if attempts != c.attempts {
+			t.Errorf("case %d attempt count mismatch. expected: %d, got: %d", i, c.attempts, attempts)
+		}
+	}
+}
+
+func TestThrottleDelay(t *testing.T) {
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.ThrottleBaseDelay = 100 * time.Millisecond
+		o.ThrottleMaxDelay = time.Second
+	})
+
+	bounds := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for attempt, bound := range bounds {
+		for i := 0; i < 20; i++ {
+			if delay := d.throttleDelay(attempt); delay < 0 || delay >= bound {
+				t.Errorf("attempt %d delay out of range. expected: [0, %s), got: %s", attempt, bound, delay)
+			}
+		}
+	}
+}
+
+// laggyS3 is a mockS3 that hides each object from the first lag reads after it's written,
+// like a store that doesn't make writes visible immediately
+type laggyS3 struct {
+	*mockS3
+	lag    int
+	hidden map[string]int
+}
+
+func (m *laggyS3) PutObjectWithContext(ctx aws.Context, input *awsS3.PutObjectInput, opts ...request.Option) (*awsS3.PutObjectOutput, error) {
+	res, err := m.mockS3.PutObjectWithContext(ctx, input, opts...)
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.hidden[aws.StringValue(input.Key)] = m.lag
+	return res, err
+}
+
+func (m *laggyS3) GetObjectWithContext(ctx aws.Context, input *awsS3.GetObjectInput, opts ...request.Option) (*awsS3.GetObjectOutput, error) {
+	if m.hide(aws.StringValue(input.Key)) {
+		return nil, awserr.New(awsS3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return m.mockS3.GetObjectWithContext(ctx, input, opts...)
+}
+
+func (m *laggyS3) HeadObjectWithContext(ctx aws.Context, input *awsS3.HeadObjectInput, opts ...request.Option) (*awsS3.HeadObjectOutput, error) {
+	if m.hide(aws.StringValue(input.Key)) {
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "")
+	}
+	return m.mockS3.HeadObjectWithContext(ctx, input, opts...)
+}
+
+// hide reports whether a read of path should miss, counting the read
+func (m *laggyS3) hide(path string) bool {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if m.hidden[path] > 0 {
+		m.hidden[path]--
+		m.reads++
+		return true
+	}
+	return false
+}
+
+func TestReadAfterWriteRetries(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		lag     int
+		retries int
+		found   bool
+	}{
+		{0, 0, true},
+		{1, 0, false},
+		{1, 2, true},
+		{2, 2, true},
+		{3, 2, false},
+	}
+
+	for i, c := range cases {
+		m := &laggyS3{mockS3: newMockS3(), lag: c.lag, hidden: map[string]int{}}
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.S3API = m
+			o.ReadAfterWriteRetries = c.retries
+		})
+
+		if err := d.Put(ctx, ds.NewKey("/get"), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		value, err := d.Get(ctx, ds.NewKey("/get"))
+		if c.found && (err != nil || string(value) != "value") {
+			t.Errorf("case %d expected get to find value, got: %q, %v", i, value, err)
+		} else if !c.found && err != ds.ErrNotFound {
+			t.Errorf("case %d get error mismatch. expected: %s, got: %v", i, ds.ErrNotFound, err)
+		}
+
+		if err := d.Put(ctx, ds.NewKey("/has"), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if has, err := d.Has(ctx, ds.NewKey("/has")); err != nil || has != c.found {
+			t.Errorf("case %d has mismatch. expected: %t, got: %t, %v", i, c.found, has, err)
+		}
+	}
+
+	// keys that weren't recently written aren't retried
+	m := &laggyS3{mockS3: newMockS3(), hidden: map[string]int{}}
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.S3API = m
+		o.ReadAfterWriteRetries = 3
+	})
+	if _, err := d.Get(ctx, ds.NewKey("/missing")); err != ds.ErrNotFound {
+		t.Errorf("missing key error mismatch. expected: %s, got: %v", ds.ErrNotFound, err)
+	}
+	if has, err := d.Has(ctx, ds.NewKey("/missing")); err != nil || has {
+		t.Errorf("expected missing key to be absent, got: %t, %v", has, err)
+	}
+	if m.reads != 2 {
+		t.Errorf("read count mismatch. expected: 2, got: %d", m.reads)
+	}
+}
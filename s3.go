@@ -2,257 +2,2856 @@ package s3
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sts"
 	datastore "github.com/ipfs/go-datastore"
 	query "github.com/ipfs/go-datastore/query"
+	goprocess "github.com/jbenet/goprocess"
+	goprocessctx "github.com/jbenet/goprocess/context"
 )
 
+// ErrClosed is returned by operations on a datastore that has been closed
+var ErrClosed = errors.New("datastore closed")
+
+// ErrReadOnly is returned by writes & deletes on a datastore created with ReadOnly set
+var ErrReadOnly = errors.New("datastore is read-only")
+
+// ErrInvalidRange is returned by GetRange for ranges starting beyond the end of a value
+var ErrInvalidRange = errors.New("range starts beyond the end of the value")
+
+// ErrValueTooLarge is returned by writes of values too large for a single PutObject request
+// when multipart uploads are disabled
+var ErrValueTooLarge = errors.New("value exceeds the 5GiB limit of a single PutObject request, set MultipartThreshold to upload it in parts")
+
+// RequestError is returned when S3 fails a request, recording the operation, key & the IDs
+// AWS support needs to trace the request. RequestError implements awserr.RequestFailure, so
+// error codes & status codes can be checked directly, and Unwrap returns the SDK's error
+type RequestError struct {
+	awserr.RequestFailure
+	// Op is the S3 operation that failed, eg. "GetObject"
+	Op string
+	// Key is the datastore key the request was for, empty for requests that don't act on a
+	// single object
+	Key string
+	// HostID is the extended request ID S3 responded with, if any
+	HostID string
+}
+
+// Error implements the error interface
+func (e *RequestError) Error() string {
+	op := "s3 " + e.Op
+	if e.Key != "" {
+		op += " " + e.Key
+	}
+	return fmt.Sprintf("%s: %s: %s (status code: %d, request id: %s, host id: %s)", op, e.Code(), e.Message(), e.StatusCode(), e.RequestID(), e.HostID)
+}
+
+// Unwrap returns the SDK error
+func (e *RequestError) Unwrap() error {
+	return e.RequestFailure
+}
+
+// maxListPageSize is the most keys S3 returns from a single list request
+const maxListPageSize = 1000
+
 // Datastore is an implementation of the IPFS Datastore interface for Amazon S3 (Simple Storage Service)
+// Keys are stored as object paths under Path. Keys must be absolute & non-empty, and can't
+// contain empty, "." or ".." segments or control characters
 type Datastore struct {
-	Path         string
-	Bucket       string
-	Region       string
-	accessKey    string
-	accessSecret string
-	accessToken  string
-	s3           *awsS3.S3
+	Path               string
+	Bucket             string
+	Region             string
+	Endpoint           string
+	forcePathStyle     bool
+	disableSSL         bool
+	dualStack          bool
+	autoDetectRegion   bool
+	accelerate         bool
+	shardFn            func(key datastore.Key) string
+	sse                string
+	kmsKeyID           string
+	storageClass       string
+	acl                string
+	lockMode           string
+	lockUntil          time.Time
+	requesterPays      bool
+	contentType        string
+	contentTypeFn      func(key datastore.Key, value []byte) string
+	metadata           map[string]string
+	metadataFn         func(key datastore.Key, value []byte) map[string]string
+	tags               map[string]string
+	strictDelete       bool
+	hardDelete         bool
+	readOnly           bool
+	dryRun             bool
+	compression        string
+	compressFn         func(key datastore.Key, contentType string, value []byte) bool
+	inlineValues       int
+	verifyUploads      bool
+	verifyReads        bool
+	verifyAfterPut     bool
+	scrubBodies        bool
+	multipartThreshold int64
+	partSize           int64
+	partConcurrency    int
+	getPartSize        int64
+	getConcurrency     int
+	progressFn         func(key datastore.Key, bytesTransferred, total int64)
+	httpClient         *http.Client
+	caCertPEM          []byte
+	insecureSkipVerify bool
+	maxRetries         int
+	retryer            request.Retryer
+	throttleRetries    int
+	throttleBase       time.Duration
+	throttleMax        time.Duration
+	readRetries        int
+	timeout            time.Duration
+	queryConcurrency   int
+	putConcurrency     int
+	listPageSize       int
+	delimiter          string
+	keySuffix          string
+	escapeFn           func(string) string
+	unescapeFn         func(string) string
+	logger             func(format string, args ...interface{})
+	observer           Observer
+	accessKey          string
+	accessSecret       string
+	accessToken        string
+	useCredChain       bool
+	useWebIdentity     bool
+	profile            string
+	roleARN            string
+	roleSession        string
+	externalID         string
+	usageTTL           time.Duration
+	gcMaxAge           time.Duration
+	usage              *usageCache
+	writes             *writeLog
+	closed             uint32
+	// parent is the datastore a sub-store was created from with WithSubPath
+	parent     *Datastore
+	session    *session.Session
+	api        s3iface.S3API
+	s3         s3iface.S3API
+	clientOnce *sync.Once
+	clientLk   *sync.Mutex
+	clientErr  error
+	// ownHTTPClient is the HTTP client the datastore created for its own session, if any.
+	// Close releases its connections
+	ownHTTPClient *http.Client
+	replicas      []*Datastore
 }
 
 // assert *Datastore satisfies datastore.Datastore interface at compile time
 var _ datastore.Datastore = (*Datastore)(nil)
 
-// NewDatastore creates a new datastore, accepting zero or more functions that modify options
+// assert *Datastore satisfies datastore.Batching interface at compile time
+var _ datastore.Batching = (*Datastore)(nil)
+
+// assert *Datastore satisfies datastore.PersistentDatastore interface at compile time
+var _ datastore.PersistentDatastore = (*Datastore)(nil)
+
+// assert *Datastore satisfies datastore.CheckedDatastore interface at compile time
+var _ datastore.CheckedDatastore = (*Datastore)(nil)
+
+// assert *Datastore satisfies datastore.GCDatastore interface at compile time
+var _ datastore.GCDatastore = (*Datastore)(nil)
+
+// NewDatastoreWithError creates a new datastore like NewDatastore, validating options and
+// configuring the S3 client up front so invalid configuration is reported immediately.
+// Credentials read from a Profile or the default credential chain are resolved up front
+// too, so unknown or unreadable profiles fail construction
+func NewDatastoreWithError(bucketName string, options ...func(o *Options)) (*Datastore, error) {
+	ds := NewDatastore(bucketName, options...)
+	if err := ds.validate(); err != nil {
+		return nil, err
+	}
+	if err := ds.initClient(); err != nil {
+		return nil, err
+	}
+	if err := ds.resolveCredentials(); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// NewDatastore creates a new datastore, accepting zero or more functions that modify options.
+// NewDatastore never fails: invalid configuration is reported by each request made with the
+// datastore. Use NewDatastoreWithError to check configuration when creating a datastore
 func NewDatastore(bucketName string, options ...func(o *Options)) *Datastore {
 	opts := DefaultOptions()
 	// apply options
 	for _, fn := range options {
 		fn(opts)
 	}
+	if opts.Observer == nil {
+		opts.Observer = nopObserver{}
+	}
+
+	ds := &Datastore{
+		Path:               opts.Path,
+		Bucket:             bucketName,
+		Region:             opts.Region,
+		Endpoint:           opts.Endpoint,
+		forcePathStyle:     opts.ForcePathStyle,
+		disableSSL:         opts.DisableSSL,
+		dualStack:          opts.UseDualStack,
+		autoDetectRegion:   opts.AutoDetectRegion,
+		accelerate:         opts.UseAccelerate,
+		shardFn:            opts.ShardFunc,
+		sse:                opts.ServerSideEncryption,
+		kmsKeyID:           opts.KMSKeyID,
+		storageClass:       opts.StorageClass,
+		acl:                opts.ACL,
+		lockMode:           opts.ObjectLockMode,
+		lockUntil:          opts.ObjectLockRetainUntil,
+		requesterPays:      opts.RequesterPays,
+		contentType:        opts.ContentType,
+		contentTypeFn:      opts.ContentTypeFunc,
+		metadata:           opts.Metadata,
+		metadataFn:         opts.MetadataFunc,
+		tags:               opts.Tags,
+		strictDelete:       opts.StrictDelete,
+		hardDelete:         opts.HardDelete,
+		readOnly:           opts.ReadOnly,
+		dryRun:             opts.DryRun,
+		compression:        opts.Compression,
+		compressFn:         opts.CompressFunc,
+		inlineValues:       opts.InlineSmallValues,
+		verifyUploads:      opts.VerifyUploads,
+		verifyReads:        opts.VerifyReads,
+		verifyAfterPut:     opts.VerifyAfterPut,
+		scrubBodies:        opts.ScrubBodies,
+		multipartThreshold: opts.MultipartThreshold,
+		partSize:           opts.MultipartPartSize,
+		partConcurrency:    opts.MultipartConcurrency,
+		getPartSize:        opts.DownloadPartSize,
+		getConcurrency:     opts.DownloadConcurrency,
+		progressFn:         opts.ProgressFunc,
+		httpClient:         opts.HTTPClient,
+		caCertPEM:          opts.CACertPEM,
+		insecureSkipVerify: opts.InsecureSkipVerify,
+		maxRetries:         opts.MaxRetries,
+		retryer:            opts.Retryer,
+		throttleRetries:    opts.ThrottleRetries,
+		throttleBase:       opts.ThrottleBaseDelay,
+		throttleMax:        opts.ThrottleMaxDelay,
+		readRetries:        opts.ReadAfterWriteRetries,
+		timeout:            opts.Timeout,
+		queryConcurrency:   opts.QueryConcurrency,
+		putConcurrency:     opts.PutConcurrency,
+		listPageSize:       opts.ListPageSize,
+		delimiter:          opts.Delimiter,
+		keySuffix:          opts.KeySuffix,
+		escapeFn:           opts.KeyEscapeFunc,
+		unescapeFn:         opts.KeyUnescapeFunc,
+		logger:             opts.Logger,
+		observer:           opts.Observer,
+		accessKey:          opts.AccessKey,
+		accessSecret:       opts.AccessSecret,
+		accessToken:        opts.AccessToken,
+		useCredChain:       opts.UseDefaultCredentialChain,
+		useWebIdentity:     opts.UseWebIdentity,
+		usageTTL:           opts.DiskUsageCacheTTL,
+		usage:              &usageCache{},
+		writes:             &writeLog{},
+		gcMaxAge:           opts.GCMaxAge,
+		profile:            opts.Profile,
+		roleARN:            opts.RoleARN,
+		roleSession:        opts.RoleSessionName,
+		externalID:         opts.ExternalID,
+		session:            opts.Session,
+		api:                opts.S3API,
+		clientOnce:         &sync.Once{},
+		clientLk:           &sync.Mutex{},
+	}
+
+	for _, r := range opts.ReadReplicas {
+		replica := r
+		// cap options so each replica's options are appended to a copy
+		ds.replicas = append(ds.replicas, NewDatastore(replica.Bucket, append(options[:len(options):len(options)], func(o *Options) {
+			if replica.Region != "" {
+				o.Region = replica.Region
+			}
+			o.ReadReplicas = nil
+		})...))
+	}
+	return ds
+}
+
+// WithSubPath returns a datastore storing keys under sub within ds's Path, sharing ds's S3
+// client, credentials & options. The returned datastore is closed along with ds, and
+// closing it leaves ds open
+func (ds *Datastore) WithSubPath(sub string) *Datastore {
+	c, _ := ds.client()
 
-	return &Datastore{
-		Path:         opts.Path,
-		Bucket:       bucketName,
-		Region:       opts.Region,
-		accessKey:    opts.AccessKey,
-		accessSecret: opts.AccessSecret,
-		accessToken:  opts.AccessToken,
+	sds := *ds
+	sds.Path = ds.root() + strings.Trim(sub, "/")
+	sds.closed = 0
+	sds.parent = ds
+	sds.usage = &usageCache{}
+	sds.replicas = nil
+	// connections belong to ds, which releases them when it's closed
+	sds.ownHTTPClient = nil
+	for _, r := range ds.replicas {
+		sds.replicas = append(sds.replicas, r.WithSubPath(sub))
 	}
+	// requests share ds's configuration & connections, but check sds for closing
+	sds.clientOnce = &sync.Once{}
+	sds.clientLk = &sync.Mutex{}
+	sds.clientOnce.Do(func() {
+		if svc, ok := c.(*awsS3.S3); ok {
+			sds.s3 = sds.attachHandlers(svc)
+		}
+	})
+	return &sds
 }
 
 // Options configures a Datastore. DefaultOptions sets default values
 // which can be modified by passing func(s) to NewDatastore
 type Options struct {
-	// Scope to a specific "folder" within the bucket without leading or trailing slashes. eg "folder" or "folder/subfolder"
+	// Scope to a specific "folder" within the bucket, eg "folder" or "folder/subfolder". Leading
+	// and trailing slashes are ignored
 	Path string
 	// The AWS region this bucket is located in. Default regin since March 8, 2013 is "us-west-2"
 	// see: http://docs.aws.amazon.com/general/latest/gr/rande.html#s3_region for regions list
 	Region string
+	// AutoDetectRegion asks S3 which region the bucket is in when the client is created, using
+	// the detected region in place of Region. Buckets in a region other than Region otherwise
+	// fail every request with a PermanentRedirect error. Detection makes a HEAD request, and
+	// falls back to Region if it fails, logging the failure with Logger. Defaults to false
+	AutoDetectRegion bool
+	// Endpoint overrides the default AWS endpoint, for use with S3-compatible services like MinIO
+	// or DigitalOcean Spaces. eg "http://localhost:9000". Defaults to the AWS endpoint for Region
+	Endpoint string
+	// ForcePathStyle addresses buckets as endpoint/bucket/key instead of bucket.endpoint/key.
+	// Defaults to false. Most S3-compatible services (MinIO, Ceph, localstack) only support
+	// path-style addressing, so users setting a custom Endpoint almost always want this on
+	ForcePathStyle bool
+	// DisableSSL sends requests over plain HTTP, eg. to a local MinIO or localstack during
+	// development. Endpoints with an explicit https:// scheme still use TLS. Defaults to false
+	DisableSSL bool
+	// UseDualStack connects to S3's dual-stack endpoints, which support both IPv4 and IPv6.
+	// Defaults to false
+	UseDualStack bool
+	// UseAccelerate transfers data through S3 Transfer Acceleration endpoints. The bucket must
+	// have transfer acceleration enabled. Acceleration requires virtual-host style addressing,
+	// so it can't be combined with ForcePathStyle. Defaults to false
+	UseAccelerate bool
+	// ShardFunc spreads objects across prefixes by returning a path segment that's inserted
+	// between Path and each key, eg. ShardSuffix(2) stores "/CIQABC" as "BC/CIQABC". S3
+	// scales request rates per prefix, so sharding avoids throttling on large flat keyspaces.
+	// Segments must not contain slashes. ShardNextToLast & ParseShardFunc mirror flatfs
+	// sharding, which suits IPFS blockstore keys. Changing ShardFunc orphans existing objects.
+	// Defaults to nil, which stores keys unsharded
+	ShardFunc func(key datastore.Key) string
 	// a valid access key for the named bucket is required, defaults to AWS_ACCESS_KEY_ID ENV variable
 	AccessKey string
 	// a valid access key for the named bucket is required, defaults to AWS_SECRET_ACCESS_KEY ENV variable
 	AccessSecret string
 	// AccessToken is only required when using temporary credentials, defaults to AWS_SESSION_TOKEN ENV variable
 	AccessToken string
+	// UseDefaultCredentialChain falls back to the SDK's default credential chain when AccessKey
+	// is empty, picking up shared credentials files, EC2 instance profiles, ECS task roles and
+	// web identity tokens. Defaults to false. The chain is also used without this option when
+	// AccessKey is empty and the web identity variables described below are set
+	UseDefaultCredentialChain bool
+	// UseWebIdentity exchanges the OIDC token at AWS_WEB_IDENTITY_TOKEN_FILE for credentials
+	// of the role at AWS_ROLE_ARN, as set on EKS pods using IAM Roles for Service Accounts.
+	// RoleARN & RoleSessionName take precedence over AWS_ROLE_ARN & AWS_ROLE_SESSION_NAME.
+	// The token file is reread whenever credentials are refreshed, picking up rotated tokens.
+	// Web identity credentials take precedence over every other credential option.
+	// Defaults to false
+	UseWebIdentity bool
+	// Profile selects a named profile from the shared credentials & config files
+	// (~/.aws/credentials & ~/.aws/config). When set, the profile's credentials take
+	// precedence over AccessKey, AccessSecret and AccessToken
+	Profile string
+	// RoleARN is an IAM role to assume with STS before accessing the bucket, using the
+	// credentials configured above to make the AssumeRole call. Assumed role credentials
+	// are refreshed automatically as they expire
+	RoleARN string
+	// RoleSessionName identifies the assumed role session, defaults to a timestamp
+	RoleSessionName string
+	// ExternalID is passed to AssumeRole for roles that require an external ID
+	ExternalID string
+	// ServerSideEncryption encrypts objects at rest with S3-managed keys when set to "AES256",
+	// or KMS-managed keys when set to "aws:kms". Defaults to empty, which uses the bucket's
+	// default encryption settings
+	ServerSideEncryption string
+	// KMSKeyID is the ID of a customer-managed KMS key to encrypt objects with. Setting KMSKeyID
+	// implies a ServerSideEncryption of "aws:kms", and conflicts with "AES256"
+	KMSKeyID string
+	// StorageClass to write objects with, eg. "STANDARD_IA" or "INTELLIGENT_TIERING".
+	// Defaults to empty, which S3 treats as "STANDARD"
+	StorageClass string
+	// ACL is a canned access control list applied to written objects, eg. "private" or
+	// "public-read". Defaults to empty, which applies the bucket's default ACL
+	ACL string
+	// ObjectLockMode retains written objects under S3 object lock, either "GOVERNANCE" or
+	// "COMPLIANCE". The bucket must have object lock enabled. Requires ObjectLockRetainUntil
+	ObjectLockMode string
+	// ObjectLockRetainUntil is the date written objects are retained until. Locked object
+	// versions can't be deleted before this date, even with HardDelete
+	ObjectLockRetainUntil time.Time
+	// RequesterPays accepts the request charges of requester-pays buckets, which reject
+	// requests that don't with 403 Forbidden
+	RequesterPays bool
+	// ContentType is set on every written object, eg. "application/octet-stream".
+	// Defaults to empty, leaving S3 to choose a content type
+	ContentType string
+	// ContentTypeFunc detects the content type of individual objects, taking precedence
+	// over ContentType whenever it returns a non-empty string. Defaults to nil
+	ContentTypeFunc func(key datastore.Key, value []byte) string
+	// Metadata is stored as user-defined metadata on every written object
+	Metadata map[string]string
+	// MetadataFunc provides per-object metadata, merged over Metadata on each write
+	MetadataFunc func(key datastore.Key, value []byte) map[string]string
+	// Tags are applied to every written object, for use in lifecycle rules and cost allocation.
+	// S3 allows at most 10 tags per object. Keys can be up to 128 characters and values up to
+	// 256 characters of letters, numbers, spaces, and the symbols + - = . _ : / @
+	Tags map[string]string
+	// StrictDelete checks that a key exists before deleting it, so Delete can return
+	// datastore.ErrNotFound for missing keys at the cost of an extra HEAD request per
+	// delete. Defaults to false: S3 deletes are idempotent, so deleting a missing key succeeds
+	StrictDelete bool
+	// HardDelete permanently removes every version of a key on delete. Deleting from a bucket
+	// with versioning enabled normally adds a delete marker, hiding the key from reads while
+	// keeping earlier versions. Hard deletes list & delete each version individually, and
+	// require the s3:ListBucketVersions and s3:DeleteObjectVersion permissions. Batch deletes
+	// and DeleteMany always add delete markers. Defaults to false
+	HardDelete bool
+	// ReadOnly rejects every write and delete with ErrReadOnly without contacting S3.
+	// Reads and queries are unaffected. Defaults to false
+	ReadOnly bool
+	// DryRun logs each write and delete with Logger in place of sending it to S3, reporting
+	// success, eg. to check what CollectGarbage would delete before running it. Reads,
+	// queries & the checks writes make first, like StrictDelete's, still contact S3.
+	// Defaults to false
+	DryRun bool
+	// Compression compresses values before writing them when set to "gzip", storing objects
+	// with a Content-Encoding of gzip. Reads decompress any gzip-encoded object, regardless of
+	// this option. GetSize reports the uncompressed size of compressed values, while
+	// DiskUsage & KeysOnly queries report compressed sizes. Defaults to empty, which
+	// stores values uncompressed
+	Compression string
+	// CompressFunc chooses whether to compress each value when Compression is set, given the
+	// value's key, content type & value, eg. CompressSampled to skip values that don't
+	// compress. Reads decompress by Content-Encoding, so values stored either way read
+	// back the same. Defaults to nil, which compresses every value
+	CompressFunc func(key datastore.Key, contentType string, value []byte) bool
+	// InlineSmallValues stores values shorter than this many bytes base64 encoded in the user
+	// metadata of an empty object, saving reading a body. S3 limits user metadata to 2KB, so
+	// the threshold can't exceed 1KB, and shares the limit with Metadata & MetadataFunc.
+	// Inline values are never compressed, and are listed with a size of zero. Reads return
+	// inline values regardless of this option. Defaults to zero, which never inlines values
+	InlineSmallValues int
+	// VerifyUploads sends the MD5 of each written value to S3, which rejects writes that
+	// arrive corrupted. Multipart uploads are checked per-part by the SDK instead
+	VerifyUploads bool
+	// VerifyReads checks values read from S3 against their ETag, for objects whose ETag is
+	// an MD5 of their contents: those uploaded in a single part and not encrypted with KMS
+	VerifyReads bool
+	// VerifyAfterPut confirms each value written by Put, PutMany & batches landed, checking
+	// the stored object's size with a HEAD request after every write. Puts of objects that
+	// are missing or the wrong size fail. Defaults to false
+	VerifyAfterPut bool
+	// ScrubBodies makes Scrub download and verify every object instead of only checking each
+	// object's metadata. Defaults to false
+	ScrubBodies bool
+	// MultipartThreshold is the size in bytes above which values are written with a multipart
+	// upload instead of a single PutObject request. Values over the 5GiB PutObject limit are
+	// always uploaded in parts. Defaults to 64MiB, zero disables multipart, failing writes of
+	// values over 5GiB with ErrValueTooLarge
+	MultipartThreshold int64
+	// MultipartPartSize is the size of each part of a multipart upload, defaults to 5MiB
+	MultipartPartSize int64
+	// MultipartConcurrency is the number of parts of a single value uploaded at once, defaults to 5
+	MultipartConcurrency int
+	// DownloadPartSize is the size of each ranged request GetParallel downloads objects in,
+	// defaults to 5MiB
+	DownloadPartSize int64
+	// DownloadConcurrency is the number of parts of a single object GetParallel downloads at
+	// once, defaults to 5
+	DownloadConcurrency int
+	// ProgressFunc is called as the parts of multipart uploads & GetParallel downloads
+	// complete, with the bytes of key transferred so far. total is the number of bytes
+	// being transferred, which is the stored size of compressed values, or -1 when it isn't
+	// known, like for PutStream. Calls are serialized, with bytesTransferred increasing.
+	// Defaults to nil
+	ProgressFunc func(key datastore.Key, bytesTransferred, total int64)
+	// HTTPClient overrides the client used to make requests to S3, for configuring proxies,
+	// TLS settings or connection pooling. Defaults to nil, which uses the SDK default
+	HTTPClient *http.Client
+	// CACertPEM holds PEM-encoded certificates to trust in addition to the system roots,
+	// for self-hosted S3-compatible stores with a private certificate authority. Takes
+	// precedence over a CA bundle set with AWS_CA_BUNDLE
+	CACertPEM []byte
+	// InsecureSkipVerify disables verification of the server's TLS certificate. It leaves
+	// connections open to interception by anyone on the network & must only be used for
+	// testing. Defaults to false
+	InsecureSkipVerify bool
+	// MaxRetries is the number of times a failed request is retried, following SDK semantics:
+	// -1 (aws.UseServiceDefaultRetries) uses the S3 service default, 0 disables retries.
+	// Defaults to -1
+	MaxRetries int
+	// Retryer overrides the SDK's retry behavior entirely, taking precedence over MaxRetries.
+	// Defaults to nil
+	Retryer request.Retryer
+	// ThrottleRetries is the number of times Put, Get & Delete are retried after S3 responds
+	// with a throttling error like 503 SlowDown, on top of any retries made by the SDK.
+	// Retries back off exponentially from ThrottleBaseDelay up to ThrottleMaxDelay, with
+	// random jitter. Defaults to zero, which leaves retries to the SDK
+	ThrottleRetries int
+	// ThrottleBaseDelay is the longest delay before the first throttled retry, defaults to 100ms
+	ThrottleBaseDelay time.Duration
+	// ThrottleMaxDelay caps the delay before each throttled retry, defaults to 10s
+	ThrottleMaxDelay time.Duration
+	// ReadAfterWriteRetries is the number of times Get & Has are retried when they don't find
+	// a key the datastore wrote within the last 10 seconds, for S3-compatible stores that
+	// don't make writes visible to reads immediately. Retries back off exponentially from
+	// 50ms. S3 itself is strongly consistent, so defaults to zero, which never retries
+	ReadAfterWriteRetries int
+	// Timeout bounds the duration of each request made to S3. Defaults to zero, which sets no
+	// timeout beyond any deadline on the context passed to datastore methods
+	Timeout time.Duration
+	// DiskUsageCacheTTL caches the result of DiskUsage for the given duration. Calculating disk
+	// usage lists every object in the store, so callers that check usage often should set this.
+	// Defaults to zero, which disables caching
+	DiskUsageCacheTTL time.Duration
+	// GCMaxAge makes CollectGarbage delete every object last modified longer than GCMaxAge
+	// ago. Defaults to zero, which makes CollectGarbage a no-op, leaving expiry to bucket
+	// lifecycle rules
+	GCMaxAge time.Duration
+	// QueryConcurrency is the number of values a query or GetMany fetches at once, defaults to 16
+	QueryConcurrency int
+	// PutConcurrency is the number of values PutMany and Batch.Commit write at once, defaults to 16
+	PutConcurrency int
+	// ListPageSize is the number of keys requested per list request, between 1 and 1000.
+	// Smaller pages return sooner at the cost of more round trips. Defaults to 1000
+	ListPageSize int
+	// Delimiter groups keys when listing, eg. "/". Query & ListKeys skip keys nested below
+	// the next Delimiter after the prefix, which CommonPrefixes lists instead, so a prefix
+	// ending in Delimiter lists the keys directly "inside" it. Defaults to empty, which
+	// lists every key under the prefix. Can't be used with ShardFunc
+	Delimiter string
+	// KeySuffix is appended to the path of every object, eg. ".bin" so tools that expect
+	// file extensions can browse or serve objects. Keys never include the suffix. Changing
+	// KeySuffix orphans existing objects. Defaults to empty
+	KeySuffix string
+	// KeyEscapeFunc rewrites each slash-separated segment of keys in object paths, eg.
+	// PercentEscape to store spaces & unicode as URL-safe percent-encoded bytes.
+	// KeyUnescapeFunc must invert it, turning listed paths back into keys. Escaping must map
+	// characters independently, so escaped prefixes stay prefixes of escaped keys for
+	// queries. Changing KeyEscapeFunc orphans existing objects. Defaults to nil, which
+	// stores keys as they are
+	KeyEscapeFunc func(string) string
+	// KeyUnescapeFunc inverts KeyEscapeFunc, and must be set with it
+	KeyUnescapeFunc func(string) string
+	// Logger is called once each Put, Get, Has, Delete & Query completes with the operation,
+	// key, duration and any error, eg. log.Printf. Defaults to nil, which disables logging
+	Logger func(format string, args ...interface{})
+	// Observer is notified after every S3 request completes. Defaults to nil, which
+	// observes nothing
+	Observer Observer
+	// Session is used to create the S3 client in place of a session built from the
+	// datastore's connection & credential options, which are ignored. Defaults to nil
+	Session *session.Session
+	// ReadReplicas are buckets holding copies of the datastore's objects, eg. replicated to
+	// other regions with S3 cross-region replication. When a Get or Has fails with an error
+	// other than datastore.ErrNotFound, each replica is read in turn until one succeeds.
+	// Writes only go to the datastore's bucket. Replicas share every other option, including
+	// S3API & Session, which can't be used to reach replicas in other regions. Defaults to nil
+	ReadReplicas []Replica
+	// S3API is used to make every S3 request in place of a client the datastore creates,
+	// eg. to share a client or substitute a mock. Connection & credential options are
+	// ignored. Observer, Close & RequestError only apply to requests made by *s3.S3 clients
+	S3API s3iface.S3API
+}
+
+// Replica is a bucket holding a copy of a datastore's objects
+type Replica struct {
+	Bucket string
+	// Region is the region the replica is in, defaults to the datastore's Region
+	Region string
+}
+
+// Observer receives the outcome of each S3 request, eg. to collect metrics
+type Observer interface {
+	// ObserveOp is called with the S3 operation name (eg. "GetObject"), the time the
+	// request took including retries, and the error it failed with, if any
+	ObserveOp(op string, dur time.Duration, err error)
 }
 
+// nopObserver is an Observer that ignores all requests
+type nopObserver struct{}
+
+// ObserveOp implements Observer
+func (nopObserver) ObserveOp(op string, dur time.Duration, err error) {}
+
 // DefaultOptions is the base set of options provided to New()
 func DefaultOptions() *Options {
 	return &Options{
-		Region:       "us-west-2",
-		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
-		AccessSecret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		AccessToken:  os.Getenv("AWS_SESSION_TOKEN"),
+		Region:               "us-west-2",
+		MaxRetries:           aws.UseServiceDefaultRetries,
+		ThrottleBaseDelay:    100 * time.Millisecond,
+		ThrottleMaxDelay:     10 * time.Second,
+		MultipartThreshold:   64 << 20,
+		MultipartPartSize:    s3manager.DefaultUploadPartSize,
+		MultipartConcurrency: s3manager.DefaultUploadConcurrency,
+		DownloadPartSize:     s3manager.DefaultDownloadPartSize,
+		DownloadConcurrency:  s3manager.DefaultDownloadConcurrency,
+		QueryConcurrency:     16,
+		PutConcurrency:       16,
+		ListPageSize:         maxListPageSize,
+		AccessKey:            os.Getenv("AWS_ACCESS_KEY_ID"),
+		AccessSecret:         os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		AccessToken:          os.Getenv("AWS_SESSION_TOKEN"),
 	}
 }
 
 // Put an object into the store
-func (ds *Datastore) Put(key datastore.Key, value interface{}) error {
-	val, ok := value.([]byte)
-	if !ok {
-		return datastore.ErrInvalidType
+func (ds *Datastore) Put(ctx context.Context, key datastore.Key, value []byte) (err error) {
+	if ds.logger != nil {
+		defer ds.logOp("Put", key.String(), time.Now(), &err)
 	}
 
-	c := ds.client()
-	_, err := c.PutObject(&awsS3.PutObjectInput{
-		Bucket: aws.String(ds.Bucket),
-		Key:    aws.String(ds.path(key)),
-		Body:   bytes.NewReader(val),
+	return ds.retryThrottled(ctx, func() error {
+		_, err := ds.put(ctx, key, value)
+		return err
 	})
-
-	return err
 }
 
-// Get an object from the store
-func (ds *Datastore) Get(key datastore.Key) (value interface{}, err error) {
-	c := ds.client()
-	res, err := c.GetObject(&awsS3.GetObjectInput{
-		Key:    aws.String(ds.path(key)),
-		Bucket: aws.String(ds.Bucket),
+// PutVersioned writes value to key like Put, returning the ID of the object version the
+// write created. Version IDs are empty unless the bucket has versioning enabled
+func (ds *Datastore) PutVersioned(ctx context.Context, key datastore.Key, value []byte) (versionID string, err error) {
+	if ds.logger != nil {
+		defer ds.logOp("PutVersioned", key.String(), time.Now(), &err)
+	}
+
+	err = ds.retryThrottled(ctx, func() (err error) {
+		versionID, err = ds.put(ctx, key, value)
+		return err
 	})
+	return versionID, err
+}
+
+// put writes value to key, returning the created version ID
+func (ds *Datastore) put(ctx context.Context, key datastore.Key, value []byte) (string, error) {
+	if ds.readOnly {
+		return "", ErrReadOnly
+	}
+	if err := ds.checkSize(len(value)); err != nil {
+		return "", err
+	}
+
+	input, err := ds.putObjectInput(key, value)
 	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() == "NoSuchKey" {
-				return nil, datastore.ErrNotFound
-			}
+		return "", err
+	}
+	if ds.dryRun {
+		ds.logDryRun("Put", key)
+		return "", nil
+	}
+
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	// the body is the stored, possibly compressed, value
+	size := input.Body.(*bytes.Reader).Size()
+
+	var versionID string
+	if ds.multipart(len(value)) {
+		if versionID, err = ds.upload(ctx, key, uploadInput(input), size); err != nil {
+			return "", err
 		}
-		return nil, err
+	} else {
+		c, err := ds.client()
+		if err != nil {
+			return "", err
+		}
+		res, err := c.PutObjectWithContext(ctx, input)
+		if err != nil {
+			return "", ctxErr(ctx, err)
+		}
+		versionID = aws.StringValue(res.VersionId)
 	}
-	defer res.Body.Close()
+	ds.recordWrite(key)
 
-	buf := &bytes.Buffer{}
-	_, err = io.Copy(buf, res.Body)
+	if ds.verifyAfterPut {
+		if err := ds.verifyPut(ctx, key, versionID, size); err != nil {
+			return "", err
+		}
+	}
+	return versionID, nil
+}
 
-	return buf.Bytes(), err
+// verifyPut confirms the object written to key, or the given version of it, exists &
+// is size bytes long
+func (ds *Datastore) verifyPut(ctx context.Context, key datastore.Key, versionID string, size int64) error {
+	input := &awsS3.HeadObjectInput{
+		Bucket:       aws.String(ds.Bucket),
+		RequestPayer: ds.requestPayer(),
+		Key:          aws.String(ds.path(key)),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+
+	c, err := ds.client()
+	if err != nil {
+		return err
+	}
+	res, err := c.HeadObjectWithContext(ctx, input)
+	if err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("verifying put of %s: object not found after writing", key)
+		}
+		return ctxErr(ctx, err)
+	}
+	if stored := aws.Int64Value(res.ContentLength); stored != size {
+		return fmt.Errorf("verifying put of %s: wrote %d bytes, but the stored object is %d bytes", key, size, stored)
+	}
+	return nil
 }
 
-// Has checks for the presence of a key within the store
-func (ds *Datastore) Has(key datastore.Key) (exists bool, err error) {
-	c := ds.client()
-	_, err = c.HeadObject(&awsS3.HeadObjectInput{
-		Bucket: aws.String(ds.Bucket),
-		Key:    aws.String(ds.path(key)),
-	})
+// PutIfAbsent writes value to key only if key doesn't exist, reporting whether value was
+// written. The write is conditioned on an If-None-Match precondition, which S3 checks
+// atomically. Stores that don't support conditional writes, and values large enough to
+// require a multipart upload, fall back to the racier option of checking for key first
+func (ds *Datastore) PutIfAbsent(ctx context.Context, key datastore.Key, value []byte) (bool, error) {
+	if ds.readOnly {
+		return false, ErrReadOnly
+	}
+
+	if ds.multipart(len(value)) {
+		return ds.putIfAbsentUnconditional(ctx, key, value)
+	}
+	if err := ds.checkSize(len(value)); err != nil {
+		return false, err
+	}
+
+	input, err := ds.putObjectInput(key, value)
+	if err != nil {
+		return false, err
+	}
+	if ds.dryRun {
+		ds.logDryRun("PutIfAbsent", key)
+		return true, nil
+	}
 
+	reqCtx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	c, err := ds.client()
+	if err != nil {
+		return false, err
+	}
+	_, err = c.PutObjectWithContext(reqCtx, input, request.WithSetRequestHeaders(map[string]string{
+		"If-None-Match": "*",
+	}))
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() == "NotFound" {
+			switch awsErr.Code() {
+			case "PreconditionFailed":
 				return false, nil
+			case "NotImplemented":
+				return ds.putIfAbsentUnconditional(ctx, key, value)
 			}
 		}
+		return false, ctxErr(reqCtx, err)
+	}
+	ds.recordWrite(key)
+	return true, nil
+}
+
+// putIfAbsentUnconditional checks for key before writing value
+func (ds *Datastore) putIfAbsentUnconditional(ctx context.Context, key datastore.Key, value []byte) (bool, error) {
+	if has, err := ds.Has(ctx, key); err != nil || has {
+		return false, err
+	}
+	if err := ds.Put(ctx, key, value); err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
-// Delete a key from the store
-func (ds *Datastore) Delete(key datastore.Key) error {
-	c := ds.client()
+// Get an object from the store
+func (ds *Datastore) Get(ctx context.Context, key datastore.Key) (value []byte, err error) {
+	if ds.logger != nil {
+		defer ds.logOp("Get", key.String(), time.Now(), &err)
+	}
 
-	if has, err := ds.Has(key); has == false {
-		return datastore.ErrNotFound
-	} else if err != nil {
+	err = ds.retryReadAfterWrite(ctx, key, func() error {
+		return ds.retryThrottled(ctx, func() (err error) {
+			value, err = ds.get(ctx, key, "")
+			return err
+		})
+	})
+	err = ds.failover(ctx, err, func(replica *Datastore) (err error) {
+		value, err = replica.Get(ctx, key)
 		return err
+	})
+	return value, err
+}
+
+// GetVersioned reads a specific version of an object, as returned by PutVersioned. An
+// empty versionID reads the latest version, like Get
+func (ds *Datastore) GetVersioned(ctx context.Context, key datastore.Key, versionID string) ([]byte, error) {
+	return ds.get(ctx, key, versionID)
+}
+
+// GetIfModified reads key like Get unless the object's ETag matches etag, in which case
+// unchanged is true and no value is downloaded, for revalidating cached values. An empty
+// etag always reads the value. Objects written in a single part without KMS encryption
+// have the quoted hex MD5 of their contents as their ETag
+func (ds *Datastore) GetIfModified(ctx context.Context, key datastore.Key, etag string) (value []byte, unchanged bool, err error) {
+	if err := validKey(key); err != nil {
+		return nil, false, err
 	}
 
-	_, err := c.DeleteObject(&awsS3.DeleteObjectInput{
-		Key:    aws.String(ds.path(key)),
-		Bucket: aws.String(ds.Bucket),
-	})
+	input := ds.getObjectInput(key, "")
+	if etag != "" {
+		input.IfNoneMatch = aws.String(etag)
+	}
+	body, err := ds.openObject(ctx, input)
+	if isNotModified(err) {
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
 
-	return err
+	value, err = readBody(body)
+	return value, false, err
+}
+
+// get reads the contents of an object version into memory
+func (ds *Datastore) get(ctx context.Context, key datastore.Key, versionID string) ([]byte, error) {
+	body, err := ds.getStream(ctx, key, versionID)
+	if err != nil {
+		return nil, err
+	}
+	return readBody(body)
+}
+
+// readBody reads an object body into memory, closing it
+func readBody(body io.ReadCloser) ([]byte, error) {
+	defer body.Close()
+
+	buf := &bytes.Buffer{}
+	_, err := io.Copy(buf, body)
+
+	return buf.Bytes(), err
+}
+
+// GetStream returns a reader over the contents of an object, leaving the object body
+// unbuffered. The caller owns the returned reader and must close it
+func (ds *Datastore) GetStream(ctx context.Context, key datastore.Key) (io.ReadCloser, error) {
+	return ds.getStream(ctx, key, "")
+}
+
+// getStream opens an object version for reading. An empty versionID reads the latest version
+func (ds *Datastore) getStream(ctx context.Context, key datastore.Key, versionID string) (io.ReadCloser, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	return ds.openObject(ctx, ds.getObjectInput(key, versionID))
 }
 
-// Query the store
-func (ds *Datastore) Query(q query.Query) (query.Results, error) {
-	// TODO - support query Filters
-	if len(q.Filters) > 0 {
-		return nil, errors.New("s3 datastore queries do not support filters")
+// getObjectInput builds the request to read an object version. An empty versionID reads
+// the latest version
+func (ds *Datastore) getObjectInput(key datastore.Key, versionID string) *awsS3.GetObjectInput {
+	input := &awsS3.GetObjectInput{
+		Key:          aws.String(ds.path(key)),
+		Bucket:       aws.String(ds.Bucket),
+		RequestPayer: ds.requestPayer(),
 	}
-	// TODO - support query Orders
-	if len(q.Orders) > 0 {
-		return nil, errors.New("s3 datastore queries do note support ordering")
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
 	}
+	return input
+}
 
-	c := ds.client()
-	res, err := c.ListObjects(&awsS3.ListObjectsInput{
-		Bucket: aws.String(ds.Bucket),
-		Prefix: aws.String(ds.stringPath(q.Prefix)),
-	})
+// openObject sends a GetObject request, returning the object body decoded & verified as
+// configured. The request timeout applies until the body is closed
+func (ds *Datastore) openObject(ctx context.Context, input *awsS3.GetObjectInput) (io.ReadCloser, error) {
+	c, err := ds.client()
 	if err != nil {
 		return nil, err
 	}
+	ctx, cancel := ds.withTimeout(ctx)
 
-	if q.KeysOnly {
-		entries := []query.Entry{}
-		added := 0
-		for i, obj := range res.Contents {
-			if q.Offset > 0 && i <= q.Offset {
-				continue
-			}
-			if q.Limit > 0 && added == q.Limit {
-				break
+	res, err := c.GetObjectWithContext(ctx, input)
+	if err != nil {
+		cancel()
+		if isNotFound(err) {
+			return nil, datastore.ErrNotFound
+		}
+		return nil, ctxErr(ctx, err)
+	}
+	if aws.Int64Value(res.ContentLength) == 0 {
+		if value, ok, err := inlineValue(res.Metadata); err != nil || ok {
+			res.Body.Close()
+			cancel()
+			if err != nil {
+				return nil, err
 			}
+			return ioutil.NopCloser(bytes.NewReader(value)), nil
+		}
+	}
 
-			entries = append(entries, query.Entry{Key: ds.key(aws.StringValue(obj.Key)).String()})
-			added++
+	var body io.ReadCloser = &ctxReadCloser{ReadCloser: res.Body, ctx: ctx, cancel: cancel}
+	if ds.verifyReads && etagIsMD5(res) {
+		body = newMD5ReadCloser(body, aws.StringValue(res.ETag))
+	}
+	if aws.StringValue(res.ContentEncoding) == gzipEncoding {
+		return newGzipReadCloser(body)
+	}
+	return body, nil
+}
+
+// Has checks for the presence of a key within the store
+func (ds *Datastore) Has(ctx context.Context, key datastore.Key) (exists bool, err error) {
+	if ds.logger != nil {
+		defer ds.logOp("Has", key.String(), time.Now(), &err)
+	}
+
+	if err := validKey(key); err != nil {
+		return false, err
+	}
+
+	err = ds.retryReadAfterWrite(ctx, key, func() (err error) {
+		if exists, err = ds.has(ctx, key); err == nil && !exists {
+			return datastore.ErrNotFound
 		}
-		return query.ResultsWithEntries(q, entries), nil
+		return err
+	})
+	if err == datastore.ErrNotFound {
+		return false, nil
 	}
+	err = ds.failover(ctx, err, func(replica *Datastore) (err error) {
+		// replicas that haven't replicated key yet don't answer for the primary
+		if exists, err = replica.Has(ctx, key); err == nil && !exists {
+			return datastore.ErrNotFound
+		}
+		return err
+	})
+	return exists, err
+}
 
-	reschan := make(chan query.Result, query.NormalBufSize)
-	go func() {
-		defer close(reschan)
+// failover retries a read that failed with err against each replica in turn, returning
+// nil once a replica read succeeds. Missing keys, canceled reads & reads no replica serves
+// return err
+func (ds *Datastore) failover(ctx context.Context, err error, read func(replica *Datastore) error) error {
+	if err == nil || err == datastore.ErrNotFound || ctx.Err() != nil {
+		return err
+	}
+	for _, replica := range ds.replicas {
+		if read(replica) == nil {
+			return nil
+		}
+	}
+	return err
+}
 
-		added := 0
-		for i, obj := range res.Contents {
-			key := ds.key(aws.StringValue(obj.Key))
-			if q.Offset > 0 && i <= q.Offset {
-				continue
-			}
-			if q.Limit > 0 && added == q.Limit {
-				break
-			}
+// has checks for an object at key with a HEAD request
+func (ds *Datastore) has(ctx context.Context, key datastore.Key) (bool, error) {
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
 
-			value, err := ds.Get(key)
-			if err != nil {
-				reschan <- query.Result{Error: err}
-				break
-			}
+	c, err := ds.client()
+	if err != nil {
+		return false, err
+	}
+	_, err = c.HeadObjectWithContext(ctx, &awsS3.HeadObjectInput{
+		Bucket:       aws.String(ds.Bucket),
+		RequestPayer: ds.requestPayer(),
+		Key:          aws.String(ds.path(key)),
+	})
 
-			reschan <- query.Result{
-				Entry: query.Entry{
-					Key:   key.String(),
-					Value: value,
-				},
-			}
-			added++
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
 		}
-	}()
+		return false, ctxErr(ctx, err)
+	}
+	return true, nil
+}
+
+// GetSize returns the size of a value in bytes, using a HEAD request to avoid
+// fetching the object body. Compressed values are sized by the uncompressed size stored
+// with them when they're written, or read whole when it's missing, as it is for streams
+func (ds *Datastore) GetSize(ctx context.Context, key datastore.Key) (size int, err error) {
+	if err := validKey(key); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	c, err := ds.client()
+	if err != nil {
+		return 0, err
+	}
+	res, err := c.HeadObjectWithContext(ctx, &awsS3.HeadObjectInput{
+		Bucket:       aws.String(ds.Bucket),
+		RequestPayer: ds.requestPayer(),
+		Key:          aws.String(ds.path(key)),
+	})
+
+	if err != nil {
+		if isNotFound(err) {
+			return -1, datastore.ErrNotFound
+		}
+		return -1, ctxErr(ctx, err)
+	}
+	if aws.Int64Value(res.ContentLength) == 0 {
+		if value, ok, err := inlineValue(res.Metadata); err != nil {
+			return -1, err
+		} else if ok {
+			return len(value), nil
+		}
+	}
+	if aws.StringValue(res.ContentEncoding) == gzipEncoding {
+		if size, ok := valueSize(res.Metadata); ok {
+			return size, nil
+		}
+		value, err := ds.Get(ctx, key)
+		if err != nil {
+			return -1, err
+		}
+		return len(value), nil
+	}
+	return int(aws.Int64Value(res.ContentLength)), nil
+}
+
+// Copy writes the value of src to dst within the bucket, without transferring the value
+// through the client. Metadata & tags are copied from src, while dst is written with the
+// datastore's ACL, encryption, storage class & object lock options. Copying a missing src
+// returns datastore.ErrNotFound
+func (ds *Datastore) Copy(ctx context.Context, src, dst datastore.Key) error {
+	if ds.readOnly {
+		return ErrReadOnly
+	}
+	if err := validKey(src); err != nil {
+		return err
+	}
 
-	return query.ResultsWithChan(q, reschan), nil
+	put, err := ds.putObjectInput(dst, nil)
+	if err != nil {
+		return err
+	}
+	input := copyInput(ds.Bucket+"/"+ds.path(src), put)
+	if ds.dryRun {
+		ds.logDryRun("Copy", src, dst)
+		return nil
+	}
+
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	c, err := ds.client()
+	if err != nil {
+		return err
+	}
+	if _, err := c.CopyObjectWithContext(ctx, input); err != nil {
+		if isNotFound(err) {
+			return datastore.ErrNotFound
+		}
+		return ctxErr(ctx, err)
+	}
+	ds.recordWrite(dst)
+	return nil
 }
 
-// Batch is an additional required method of the Batching interface, currently unsupported
-// TODO - implement batching interface.
-func (ds *Datastore) Batch() (datastore.Batch, error) {
-	return nil, datastore.ErrBatchUnsupported
+// Move renames src to dst by copying src to dst, then deleting src once the copy succeeds.
+// Moves aren't atomic: readers may see both keys during a move, and a failed delete leaves
+// both in place. Moving a missing src returns datastore.ErrNotFound without copying
+func (ds *Datastore) Move(ctx context.Context, src, dst datastore.Key) error {
+	if ds.readOnly {
+		return ErrReadOnly
+	}
+
+	if has, err := ds.Has(ctx, src); err != nil {
+		return err
+	} else if !has {
+		return datastore.ErrNotFound
+	}
+
+	if err := ds.Copy(ctx, src, dst); err != nil {
+		return err
+	}
+	return ds.Delete(ctx, src)
 }
 
-// svc gives an aws.S3 client instance
-func (ds *Datastore) client() *awsS3.S3 {
-	if ds.s3 != nil {
-		return ds.s3
+// copyInput converts a PutObject request to a request copying source, a bucket & object
+// path, to the same destination with the same write options
+func copyInput(source string, input *awsS3.PutObjectInput) *awsS3.CopyObjectInput {
+	segments := strings.Split(source, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
 	}
 
-	ds.s3 = awsS3.New(session.New(&aws.Config{
-		Region:      aws.String(ds.Region),
-		Credentials: credentials.NewStaticCredentials(ds.accessKey, ds.accessSecret, ds.accessToken),
-	}))
-	return ds.s3
+	return &awsS3.CopyObjectInput{
+		ACL:                       input.ACL,
+		Bucket:                    input.Bucket,
+		CopySource:                aws.String(strings.Join(segments, "/")),
+		Key:                       input.Key,
+		ObjectLockMode:            input.ObjectLockMode,
+		ObjectLockRetainUntilDate: input.ObjectLockRetainUntilDate,
+		RequestPayer:              input.RequestPayer,
+		SSEKMSKeyId:               input.SSEKMSKeyId,
+		ServerSideEncryption:      input.ServerSideEncryption,
+		StorageClass:              input.StorageClass,
+	}
 }
 
-// path creates the full path to an object by appending the bucket path to key.Path
-func (ds *Datastore) path(key datastore.Key) string {
-	return strings.TrimLeft(ds.Path+key.String(), "/")
-	// return strings.TrimLeft(filepath.Join(ds.Path, key.String()), "/")
+// PresignGet returns a URL anyone can read key from until expiry passes, without
+// credentials. Compressed values are served compressed, with their Content-Encoding
+func (ds *Datastore) PresignGet(key datastore.Key, expiry time.Duration) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+
+	c, err := ds.client()
+	if err != nil {
+		return "", err
+	}
+	req, _ := c.GetObjectRequest(ds.getObjectInput(key, ""))
+	return req.Presign(expiry)
 }
 
-// path creates the full path to an object by appending the bucket path to key.Path
-func (ds *Datastore) stringPath(path string) string {
-	return strings.TrimLeft(ds.Path+path, "/")
+// PresignPut returns a URL anyone can write a value to key with until expiry passes,
+// without credentials. Values uploaded to the URL are stored as sent, so aren't compressed,
+// and can't be retained with object lock, which requires a Content-MD5 of the value
+func (ds *Datastore) PresignPut(key datastore.Key, expiry time.Duration) (string, error) {
+	if ds.readOnly {
+		return "", ErrReadOnly
+	}
+	if ds.lockMode != "" {
+		return "", errors.New("presigned puts can't be used with ObjectLockMode")
+	}
+
+	input, err := ds.putObjectInput(key, nil)
+	if err != nil {
+		return "", err
+	}
+	input.Body = nil
+	input.ContentMD5 = nil
+	input.ContentEncoding = nil
+
+	c, err := ds.client()
+	if err != nil {
+		return "", err
+	}
+	req, _ := c.PutObjectRequest(input)
+	return req.Presign(expiry)
 }
 
-// key returns a key from a full object path, removing the ds.Path prefix
-func (ds *Datastore) key(fullPath string) datastore.Key {
-	return datastore.NewKey(strings.TrimPrefix(fullPath, ds.Path))
+// GetMetadata reads the user-defined metadata stored with an object. S3 stores
+// metadata keys in lowercase, which is how they're returned
+func (ds *Datastore) GetMetadata(ctx context.Context, key datastore.Key) (map[string]string, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	c, err := ds.client()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.HeadObjectWithContext(ctx, &awsS3.HeadObjectInput{
+		Bucket:       aws.String(ds.Bucket),
+		RequestPayer: ds.requestPayer(),
+		Key:          aws.String(ds.path(key)),
+	})
+
+	if err != nil {
+		if isNotFound(err) {
+			return nil, datastore.ErrNotFound
+		}
+		return nil, ctxErr(ctx, err)
+	}
+
+	md := make(map[string]string, len(res.Metadata))
+	for k, v := range res.Metadata {
+		if k = strings.ToLower(k); k != inlineValueKey && k != valueSizeKey {
+			md[k] = aws.StringValue(v)
+		}
+	}
+	return md, nil
+}
+
+// GetTags reads the tags set on an object
+func (ds *Datastore) GetTags(ctx context.Context, key datastore.Key) (map[string]string, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	c, err := ds.client()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.GetObjectTaggingWithContext(ctx, &awsS3.GetObjectTaggingInput{
+		Bucket:       aws.String(ds.Bucket),
+		RequestPayer: ds.requestPayer(),
+		Key:          aws.String(ds.path(key)),
+	})
+
+	if err != nil {
+		if isNotFound(err) {
+			return nil, datastore.ErrNotFound
+		}
+		return nil, ctxErr(ctx, err)
+	}
+
+	tags := make(map[string]string, len(res.TagSet))
+	for _, tag := range res.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags, nil
+}
+
+// Delete a key from the store. Deleting a key that doesn't exist only returns
+// datastore.ErrNotFound if StrictDelete is set. On versioned buckets Delete adds a delete
+// marker, keeping previous versions unless HardDelete is set
+func (ds *Datastore) Delete(ctx context.Context, key datastore.Key) (err error) {
+	if ds.logger != nil {
+		defer ds.logOp("Delete", key.String(), time.Now(), &err)
+	}
+
+	if err := validKey(key); err != nil {
+		return err
+	}
+
+	if ds.readOnly {
+		return ErrReadOnly
+	}
+
+	return ds.retryThrottled(ctx, func() error {
+		return ds.delete(ctx, key)
+	})
+}
+
+// delete removes key from the store
+func (ds *Datastore) delete(ctx context.Context, key datastore.Key) error {
+	c, err := ds.client()
+	if err != nil {
+		return err
+	}
+
+	if ds.strictDelete {
+		if has, err := ds.Has(ctx, key); err != nil {
+			return err
+		} else if !has {
+			return datastore.ErrNotFound
+		}
+	}
+
+	if ds.dryRun {
+		ds.logDryRun("Delete", key)
+		return nil
+	}
+	if ds.hardDelete {
+		return ds.deleteVersions(ctx, key)
+	}
+
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	_, err = c.DeleteObjectWithContext(ctx, &awsS3.DeleteObjectInput{
+		Key:          aws.String(ds.path(key)),
+		Bucket:       aws.String(ds.Bucket),
+		RequestPayer: ds.requestPayer(),
+	})
+	// S3 deletes are idempotent, but some compatible stores report missing keys
+	if isNotFound(err) {
+		if ds.strictDelete {
+			return datastore.ErrNotFound
+		}
+		return nil
+	}
+	if isLocked(err) {
+		return fmt.Errorf("deleting %s: object is protected by object lock", key)
+	}
+
+	return ctxErr(ctx, err)
+}
+
+// deleteVersions permanently removes every version and delete marker of key
+func (ds *Datastore) deleteVersions(ctx context.Context, key datastore.Key) error {
+	c, err := ds.client()
+	if err != nil {
+		return err
+	}
+	path := ds.path(key)
+	input := &awsS3.ListObjectVersionsInput{
+		Bucket: aws.String(ds.Bucket),
+		Prefix: aws.String(path),
+	}
+	// ListObjectVersionsInput has no RequestPayer field in this version of the SDK, so the
+	// header is set directly
+	var opts []request.Option
+	if payer := ds.requestPayer(); payer != nil {
+		opts = append(opts, request.WithSetRequestHeaders(map[string]string{"X-Amz-Request-Payer": *payer}))
+	}
+
+	for {
+		versionIDs := []*string{}
+
+		reqCtx, cancel := ds.withTimeout(ctx)
+		res, err := c.ListObjectVersionsWithContext(reqCtx, input, opts...)
+		cancel()
+		if err != nil {
+			return ctxErr(reqCtx, err)
+		}
+		// prefix matches include longer keys that start with path
+		for _, v := range res.Versions {
+			if aws.StringValue(v.Key) == path {
+				versionIDs = append(versionIDs, v.VersionId)
+			}
+		}
+		for _, m := range res.DeleteMarkers {
+			if aws.StringValue(m.Key) == path {
+				versionIDs = append(versionIDs, m.VersionId)
+			}
+		}
+
+		for _, id := range versionIDs {
+			reqCtx, cancel := ds.withTimeout(ctx)
+			_, err := c.DeleteObjectWithContext(reqCtx, &awsS3.DeleteObjectInput{
+				Bucket:       aws.String(ds.Bucket),
+				RequestPayer: ds.requestPayer(),
+				Key:          aws.String(path),
+				VersionId:    id,
+			})
+			cancel()
+			if isLocked(err) {
+				return fmt.Errorf("deleting %s version %s: object is protected by object lock", key, aws.StringValue(id))
+			}
+			if err != nil {
+				return ctxErr(reqCtx, err)
+			}
+		}
+
+		// versions are listed in key order, so once the listing moves past path any later
+		// pages only hold longer keys
+		if !aws.BoolValue(res.IsTruncated) || aws.StringValue(res.NextKeyMarker) != path {
+			return nil
+		}
+		input.KeyMarker = res.NextKeyMarker
+		input.VersionIdMarker = res.NextVersionIdMarker
+	}
+}
+
+// Query the store. Canceling ctx stops the query, closing the results channel.
+// Prefixes are cleaned and match whole key segments like go-datastore's NaiveQueryApply,
+// so a Prefix of "/a" matches "/a/b" but not "/ab". Filters and Orders are applied before Offset and Limit. KeysOnly queries never fetch
+// values, so filters & orders that inspect entry values only work on queries that
+// return values. S3 lists keys in ascending order, any other order requires buffering
+// all matching entries in memory. Sharded stores list in shard order, so any order
+// buffers, and every query lists the whole store regardless of prefix. Entries with
+// values are sized by their value, while KeysOnly entries are sized by the stored size of
+// each object as listed, so KeysOnly queries setting ReturnsSizes get sizes without
+// fetching any values, but compressed and inline objects aren't sized by their value
+// length. A value that fails to fetch is delivered as a result with the entry's key & the
+// error, without ending the query. Buffered queries deliver failed values ahead of the
+// sorted entries. Closing the results or canceling ctx stops listing & fetching values
+func (ds *Datastore) Query(ctx context.Context, q query.Query) (results query.Results, err error) {
+	if ds.logger != nil {
+		defer ds.logOp("Query", q.Prefix, time.Now(), &err)
+	}
+	prefix := queryPrefix(q.Prefix)
+
+	// sharded listings aren't in key order
+	if !keyOrdered(q.Orders) || (ds.shardFn != nil && len(q.Orders) > 0) {
+		return ds.sortedQuery(ctx, q, prefix)
+	}
+
+	if q.KeysOnly {
+		entries := []query.Entry{}
+		skipped := 0
+		err := ds.eachObject(ctx, prefix, ds.delimiter, func(obj *awsS3.Object) bool {
+			if q.Limit > 0 && len(entries) == q.Limit {
+				return false
+			}
+
+			e := query.Entry{
+				Key:  ds.key(aws.StringValue(obj.Key)).String(),
+				Size: int(aws.Int64Value(obj.Size)),
+			}
+			if !matches(q.Filters, e) {
+				return true
+			}
+			if skipped < q.Offset {
+				skipped++
+				return true
+			}
+
+			entries = append(entries, e)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		return query.ResultsWithEntries(q, entries), nil
+	}
+
+	return query.ResultsWithProcess(q, func(worker goprocess.Process, out chan<- query.Result) {
+		// closing the results closes worker, canceling ctx. canceling on return stops any
+		// listing & fetching still in progress
+		ctx, cancel := context.WithCancel(goprocessctx.WithProcessClosing(ctx, worker))
+		defer cancel()
+
+		// send delivers a result, reporting false if ctx is canceled first
+		send := func(res query.Result) bool {
+			select {
+			case out <- res:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		skipped, added := 0, 0
+		for f := range ds.fetchEntries(ctx, prefix) {
+			if f.listing {
+				send(query.Result{Error: f.err})
+				return
+			}
+			// a value that can't be fetched doesn't end the query
+			if f.err != nil {
+				if !send(query.Result{Entry: query.Entry{Key: f.entry.Key}, Error: f.err}) {
+					return
+				}
+				continue
+			}
+			if !matches(q.Filters, f.entry) {
+				continue
+			}
+			if skipped < q.Offset {
+				skipped++
+				continue
+			}
+
+			if !send(query.Result{Entry: f.entry}) {
+				return
+			}
+			added++
+			if q.Limit > 0 && added == q.Limit {
+				return
+			}
+		}
+	}), nil
+}
+
+// ListKeys returns every key under prefix in ascending order, listing keys without the
+// filtering & sorting machinery of Query. The prefix matches keys as strings, so "/a"
+// matches both "/a/b" and "/ab"
+func (ds *Datastore) ListKeys(ctx context.Context, prefix string) ([]datastore.Key, error) {
+	keys := []datastore.Key{}
+	err := ds.eachObject(ctx, prefix, ds.delimiter, func(obj *awsS3.Object) bool {
+		keys = append(keys, ds.key(aws.StringValue(obj.Key)))
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ds.shardFn != nil {
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	}
+	return keys, nil
+}
+
+// CountPrefix returns the number of keys under prefix, listing every key. Like ListKeys
+// the prefix matches keys as strings. Keys nested below a Delimiter are counted
+func (ds *Datastore) CountPrefix(ctx context.Context, prefix string) (int, error) {
+	n := 0
+	err := ds.eachObject(ctx, prefix, "", func(obj *awsS3.Object) bool {
+		n++
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// HasPrefix reports whether any key exists under prefix, listing at most one key when the
+// datastore isn't sharded and has no KeySuffix. Like ListKeys the prefix matches keys as
+// strings
+func (ds *Datastore) HasPrefix(ctx context.Context, prefix string) (bool, error) {
+	found := false
+
+	// sharded & suffixed listings must be filtered, see eachObject
+	if ds.shardFn != nil || ds.keySuffix != "" {
+		err := ds.eachObject(ctx, prefix, "", func(obj *awsS3.Object) bool {
+			found = true
+			return false
+		})
+		return found, err
+	}
+
+	input := ds.listInput(prefix, "")
+	input.MaxKeys = aws.Int64(1)
+	err := ds.eachPage(ctx, input, func(res *awsS3.ListObjectsV2Output) bool {
+		found = len(res.Contents) > 0
+		return false
+	})
+	return found, err
+}
+
+// CommonPrefixes returns the "directories" directly under prefix: the distinct prefixes of
+// keys nested below the next Delimiter after prefix, ending in Delimiter, in ascending
+// order. With a Delimiter of "/", CommonPrefixes(ctx, "/a/") of keys "/a/b" & "/a/c/d"
+// returns "/a/c/". Requires the Delimiter option
+func (ds *Datastore) CommonPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	if ds.delimiter == "" {
+		return nil, errors.New("CommonPrefixes requires a Delimiter")
+	}
+
+	prefixes := []string{}
+	err := ds.eachPage(ctx, ds.listInput(prefix, ds.delimiter), func(res *awsS3.ListObjectsV2Output) bool {
+		for _, p := range res.CommonPrefixes {
+			prefixes = append(prefixes, "/"+ds.unescape(strings.TrimPrefix(aws.StringValue(p.Prefix), ds.root())))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+// entryFetch is the result of fetching the value of a listed object
+type entryFetch struct {
+	entry query.Entry
+	err   error
+	// listing is set when err failed the listing rather than a single fetch
+	listing bool
+}
+
+// queryPrefix cleans a query prefix, appending "/" so the prefix only lists keys below it
+func queryPrefix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	if prefix = path.Clean("/" + prefix); prefix == "/" {
+		return prefix
+	}
+	return prefix + "/"
+}
+
+// fetchEntries lists objects under prefix, fetching their values concurrently while
+// delivering entries in listing order. At most queryConcurrency values are fetched at
+// once. Listing runs a page ahead of fetching, so the next page is listed while values
+// from the current page are fetched. Failed fetches are delivered with their error &
+// listing continues. Listing stops after the first listing error, which is delivered as
+// the last fetch
+func (ds *Datastore) fetchEntries(ctx context.Context, prefix string) <-chan entryFetch {
+	n := ds.queryConcurrency
+	if n < 1 {
+		n = 1
+	}
+
+	// objects buffers a page of listed objects, letting listing continue to the next page
+	// as soon as a page is listed. listErr is set before objects is closed
+	var listErr error
+	objects := make(chan *awsS3.Object, ds.listPageSize)
+	go func() {
+		defer close(objects)
+		listErr = ds.eachObject(ctx, prefix, ds.delimiter, func(obj *awsS3.Object) bool {
+			select {
+			case objects <- obj:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	// each pending fetch yields a single result. the capacity of pending plus the fetch
+	// awaiting delivery bounds the number of fetches in flight
+	pending := make(chan chan entryFetch, n-1)
+	go func() {
+		defer close(pending)
+
+		for obj := range objects {
+			key := ds.key(aws.StringValue(obj.Key))
+			f := make(chan entryFetch, 1)
+			select {
+			case pending <- f:
+			case <-ctx.Done():
+				return
+			}
+
+			go func() {
+				value, err := ds.Get(ctx, key)
+				f <- entryFetch{entry: query.Entry{Key: key.String(), Value: value, Size: len(value)}, err: err}
+			}()
+		}
+		if listErr != nil {
+			f := make(chan entryFetch, 1)
+			f <- entryFetch{err: listErr, listing: true}
+			select {
+			case pending <- f:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	out := make(chan entryFetch)
+	go func() {
+		defer close(out)
+		for f := range pending {
+			res := <-f
+			select {
+			case out <- res:
+			case <-ctx.Done():
+				return
+			}
+			if res.listing {
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// sortedQuery collects all entries under prefix matching a query, sorting them before applying
+// offset and limit. Values are fetched like unsorted queries, and values that fail to
+// fetch are delivered with their error ahead of the sorted entries
+func (ds *Datastore) sortedQuery(ctx context.Context, q query.Query, prefix string) (query.Results, error) {
+	entries := []query.Entry{}
+	if q.KeysOnly {
+		err := ds.eachObject(ctx, prefix, ds.delimiter, func(obj *awsS3.Object) bool {
+			e := query.Entry{Key: ds.key(aws.StringValue(obj.Key)).String(), Size: int(aws.Int64Value(obj.Size))}
+			if matches(q.Filters, e) {
+				entries = append(entries, e)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		query.Sort(q.Orders, entries)
+		return query.ResultsWithEntries(q, limitEntries(q, entries)), nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	failed := []query.Result{}
+	for f := range ds.fetchEntries(ctx, prefix) {
+		if f.listing {
+			return nil, f.err
+		}
+		if f.err != nil {
+			failed = append(failed, query.Result{Entry: query.Entry{Key: f.entry.Key}, Error: f.err})
+			continue
+		}
+		if matches(q.Filters, f.entry) {
+			entries = append(entries, f.entry)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	query.Sort(q.Orders, entries)
+	results := failed
+	for _, e := range limitEntries(q, entries) {
+		results = append(results, query.Result{Entry: e})
+	}
+	return query.ResultsWithProcess(q, func(worker goprocess.Process, out chan<- query.Result) {
+		for _, res := range results {
+			select {
+			case out <- res:
+			case <-worker.Closing():
+				return
+			}
+		}
+	}), nil
+}
+
+// limitEntries applies the offset and limit of q to sorted entries
+func limitEntries(q query.Query, entries []query.Entry) []query.Entry {
+
+	if q.Offset > len(entries) {
+		entries = entries[:0]
+	} else {
+		entries = entries[q.Offset:]
+	}
+	if q.Limit > 0 && q.Limit < len(entries) {
+		entries = entries[:q.Limit]
+	}
+	return entries
+}
+
+// DiskUsage returns the total size in bytes of all objects in the store. DiskUsage
+// lists every object under Path, making one request per 1000 objects, which is slow
+// and costly for large stores. Set the DiskUsageCacheTTL option to reuse results
+func (ds *Datastore) DiskUsage(ctx context.Context) (uint64, error) {
+	if ds.isClosed() {
+		return 0, ErrClosed
+	}
+
+	ds.usage.lk.Lock()
+	defer ds.usage.lk.Unlock()
+
+	if ds.usageTTL > 0 && !ds.usage.at.IsZero() && time.Since(ds.usage.at) < ds.usageTTL {
+		return ds.usage.size, nil
+	}
+
+	var size uint64
+	err := ds.eachObject(ctx, "", "", func(obj *awsS3.Object) bool {
+		size += uint64(aws.Int64Value(obj.Size))
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ds.usage.size = size
+	ds.usage.at = time.Now()
+	return size, nil
+}
+
+// UsageForPrefix returns the total size in bytes & number of objects under prefix, eg. to
+// account for the storage of each tenant sharing a bucket. Like ListKeys the prefix matches
+// keys as strings. Every object under prefix is listed, ListPageSize objects at a time, and
+// results are never cached
+func (ds *Datastore) UsageForPrefix(ctx context.Context, prefix string) (size uint64, count int, err error) {
+	err = ds.eachObject(ctx, prefix, "", func(obj *awsS3.Object) bool {
+		size += uint64(aws.Int64Value(obj.Size))
+		count++
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, count, nil
+}
+
+// usageCache holds the last size reported by DiskUsage, reused for UsageTTL
+type usageCache struct {
+	lk   sync.Mutex
+	size uint64
+	at   time.Time
+}
+
+// Sync is a no-op. S3 writes are durable once PutObject returns
+func (ds *Datastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	if ds.isClosed() {
+		return ErrClosed
+	}
+	return nil
+}
+
+// CollectGarbage deletes objects last modified more than GCMaxAge ago, listing the
+// entire store. With no GCMaxAge set CollectGarbage does nothing
+func (ds *Datastore) CollectGarbage(ctx context.Context) error {
+	if ds.gcMaxAge <= 0 {
+		return nil
+	}
+	if ds.readOnly {
+		return ErrReadOnly
+	}
+
+	cutoff := time.Now().Add(-ds.gcMaxAge)
+	expired := []datastore.Key{}
+	err := ds.eachObject(ctx, "", "", func(obj *awsS3.Object) bool {
+		if aws.TimeValue(obj.LastModified).Before(cutoff) {
+			expired = append(expired, ds.key(aws.StringValue(obj.Key)))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return ds.deleteObjects(ctx, expired)
+}
+
+// Check confirms the bucket exists and the configured credentials can access it
+func (ds *Datastore) Check(ctx context.Context) error {
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	c, err := ds.client()
+	if err != nil {
+		return err
+	}
+	_, err = c.HeadBucketWithContext(ctx, &awsS3.HeadBucketInput{
+		Bucket: aws.String(ds.Bucket),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok {
+			switch awsErr.Code() {
+			case "NotFound", "NoSuchBucket":
+				return fmt.Errorf("checking bucket %s: bucket does not exist", ds.Bucket)
+			case "Forbidden", "AccessDenied":
+				return fmt.Errorf("checking bucket %s: access denied, check credentials and bucket permissions", ds.Bucket)
+			case request.ErrCodeRequestError:
+				if ctx.Err() == nil {
+					return fmt.Errorf("checking bucket %s: can't reach S3, check Endpoint and network access: %s", ds.Bucket, awsErr.OrigErr())
+				}
+			}
+		}
+		return ctxErr(ctx, err)
+	}
+	return nil
+}
+
+// Ping confirms the bucket is reachable with the configured credentials using a single
+// HEAD request, returning the same descriptive errors as Check. Daemons can ping the
+// datastore at startup to fail fast on misconfiguration, rather than on the first read
+func (ds *Datastore) Ping(ctx context.Context) error {
+	return ds.Check(ctx)
+}
+
+// Close releases idle connections held by an HTTP client the datastore created. Clients
+// passed in with HTTPClient, Session or S3API and clients of cached sessions are shared,
+// and left open. Every operation on a closed datastore fails with ErrClosed. Closing more
+// than once is a no-op
+func (ds *Datastore) Close() error {
+	if !atomic.CompareAndSwapUint32(&ds.closed, 0, 1) {
+		return nil
+	}
+	ds.clientLk.Lock()
+	hc := ds.ownHTTPClient
+	ds.clientLk.Unlock()
+	if hc != nil {
+		hc.CloseIdleConnections()
+	}
+	for _, r := range ds.replicas {
+		r.Close()
+	}
+	return nil
+}
+
+// isClosed reports whether Close has been called on ds or the datastore it's a sub-store of
+func (ds *Datastore) isClosed() bool {
+	return atomic.LoadUint32(&ds.closed) == 1 || (ds.parent != nil && ds.parent.isClosed())
+}
+
+// rejectClosed fails requests made after the datastore is closed
+func (ds *Datastore) rejectClosed(r *request.Request) {
+	if ds.isClosed() {
+		r.Error = ErrClosed
+	}
+}
+
+// Batch creates a batch of operations that are written to the store on Commit
+func (ds *Datastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	if ds.isClosed() {
+		return nil, ErrClosed
+	}
+	return newBatch(ds), nil
+}
+
+// putObjectInput builds the request to write value to key, applying configured write options
+func (ds *Datastore) putObjectInput(key datastore.Key, value []byte) (*awsS3.PutObjectInput, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+
+	input := &awsS3.PutObjectInput{
+		Bucket:       aws.String(ds.Bucket),
+		RequestPayer: ds.requestPayer(),
+		Key:          aws.String(ds.path(key)),
+	}
+
+	contentType := ds.contentType
+	if ds.contentTypeFn != nil {
+		if ct := ds.contentTypeFn(key, value); ct != "" {
+			contentType = ct
+		}
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+
+	body := value
+	switch ds.compression {
+	case "":
+	case gzipEncoding:
+		// inline values are stored in metadata instead of the body
+		if ds.inline(value) || (ds.compressFn != nil && !ds.compressFn(key, contentType, value)) {
+			break
+		}
+		compressed, err := gzipBytes(value)
+		if err != nil {
+			return nil, err
+		}
+		body = compressed
+		input.ContentEncoding = aws.String(gzipEncoding)
+	default:
+		return nil, fmt.Errorf("unsupported compression: %q", ds.compression)
+	}
+	if ds.inline(value) {
+		body = []byte{}
+	}
+	input.Body = bytes.NewReader(body)
+
+	switch ds.sse {
+	case "":
+	case awsS3.ServerSideEncryptionAes256, awsS3.ServerSideEncryptionAwsKms:
+		input.ServerSideEncryption = aws.String(ds.sse)
+	default:
+		return nil, fmt.Errorf("unsupported server side encryption: %q", ds.sse)
+	}
+
+	if ds.kmsKeyID != "" {
+		if ds.sse == awsS3.ServerSideEncryptionAes256 {
+			return nil, fmt.Errorf("KMSKeyID requires %q server side encryption, got: %q", awsS3.ServerSideEncryptionAwsKms, ds.sse)
+		}
+		input.ServerSideEncryption = aws.String(awsS3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(ds.kmsKeyID)
+	}
+
+	if ds.storageClass != "" {
+		if !contains(awsS3.StorageClass_Values(), ds.storageClass) {
+			return nil, fmt.Errorf("unsupported storage class: %q", ds.storageClass)
+		}
+		input.StorageClass = aws.String(ds.storageClass)
+	}
+
+	if ds.acl != "" {
+		if !contains(awsS3.ObjectCannedACL_Values(), ds.acl) {
+			return nil, fmt.Errorf("unsupported ACL: %q", ds.acl)
+		}
+		input.ACL = aws.String(ds.acl)
+	}
+
+	if ds.lockMode != "" {
+		if !contains(awsS3.ObjectLockMode_Values(), ds.lockMode) {
+			return nil, fmt.Errorf("unsupported object lock mode: %q", ds.lockMode)
+		}
+		if ds.lockUntil.IsZero() {
+			return nil, errors.New("ObjectLockMode requires ObjectLockRetainUntil")
+		}
+		input.ObjectLockMode = aws.String(ds.lockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(ds.lockUntil)
+	} else if !ds.lockUntil.IsZero() {
+		return nil, errors.New("ObjectLockRetainUntil requires ObjectLockMode")
+	}
+	// S3 requires a Content-MD5 on writes that lock objects. The SDK skips hashing bodies
+	// that already have one, and hashes the parts of multipart uploads itself
+	if (ds.verifyUploads || ds.lockMode != "") && !ds.multipart(len(value)) {
+		input.ContentMD5 = aws.String(contentMD5(body))
+	}
+
+	if ds.metadata != nil || ds.metadataFn != nil {
+		md := map[string]*string{}
+		for k, v := range ds.metadata {
+			md[k] = aws.String(v)
+		}
+		if ds.metadataFn != nil {
+			for k, v := range ds.metadataFn(key, value) {
+				md[k] = aws.String(v)
+			}
+		}
+		if len(md) > 0 {
+			input.Metadata = md
+		}
+	}
+	if ds.inline(value) {
+		if input.Metadata == nil {
+			input.Metadata = map[string]*string{}
+		}
+		input.Metadata[inlineValueKey] = aws.String(base64.StdEncoding.EncodeToString(value))
+	}
+	// streamed values are written before their size is known
+	if aws.StringValue(input.ContentEncoding) == gzipEncoding && value != nil {
+		if input.Metadata == nil {
+			input.Metadata = map[string]*string{}
+		}
+		input.Metadata[valueSizeKey] = aws.String(strconv.Itoa(len(value)))
+	}
+
+	if len(ds.tags) > 0 {
+		tagging, err := encodeTags(ds.tags)
+		if err != nil {
+			return nil, err
+		}
+		input.Tagging = aws.String(tagging)
+	}
+
+	return input, nil
+}
+
+// eachObject calls fn for every object stored under prefix, following ListObjectsV2
+// continuation tokens until the listing is exhausted. A non-empty delimiter skips objects
+// nested under prefix below the next delimiter. fn can stop iteration early by returning
+// false
+func (ds *Datastore) eachObject(ctx context.Context, prefix, delimiter string, fn func(obj *awsS3.Object) bool) error {
+	input := ds.listInput(prefix, delimiter)
+
+	// keys under prefix are spread across every shard, so list everything and filter
+	if ds.shardFn != nil {
+		input.Prefix = aws.String(ds.stringPath(""))
+	}
+	// suffixed paths can match prefixes their keys don't, eg. the path "a.bin" of "/a"
+	// matches "/a.b", so listings are filtered by key
+	if ds.shardFn != nil || ds.keySuffix != "" {
+		keyPrefix := "/" + strings.TrimLeft(prefix, "/")
+		next := fn
+		fn = func(obj *awsS3.Object) bool {
+			if !strings.HasPrefix(ds.key(aws.StringValue(obj.Key)).String(), keyPrefix) {
+				return true
+			}
+			return next(obj)
+		}
+	}
+
+	return ds.eachPage(ctx, input, func(res *awsS3.ListObjectsV2Output) bool {
+		for _, obj := range res.Contents {
+			if !fn(obj) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// listInput builds the request to list objects under prefix
+func (ds *Datastore) listInput(prefix, delimiter string) *awsS3.ListObjectsV2Input {
+	input := &awsS3.ListObjectsV2Input{
+		Bucket:       aws.String(ds.Bucket),
+		RequestPayer: ds.requestPayer(),
+		Prefix:       aws.String(ds.stringPath(prefix)),
+		MaxKeys:      aws.Int64(int64(ds.listPageSize)),
+	}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
+	}
+	return input
+}
+
+// eachPage calls fn with every page of a listing, following continuation tokens until
+// the listing is exhausted. fn can stop iteration early by returning false
+func (ds *Datastore) eachPage(ctx context.Context, input *awsS3.ListObjectsV2Input, fn func(res *awsS3.ListObjectsV2Output) bool) error {
+	c, err := ds.client()
+	if err != nil {
+		return err
+	}
+	for {
+		reqCtx, cancel := ds.withTimeout(ctx)
+		res, err := c.ListObjectsV2WithContext(reqCtx, input)
+		cancel()
+		if err != nil {
+			return ctxErr(reqCtx, err)
+		}
+
+		if !fn(res) || !aws.BoolValue(res.IsTruncated) {
+			return nil
+		}
+		input.ContinuationToken = res.NextContinuationToken
+	}
+}
+
+// keyOrdered reports whether orders are satisfied by the ascending key order S3
+// lists objects in
+func keyOrdered(orders []query.Order) bool {
+	if len(orders) == 0 {
+		return true
+	}
+	switch orders[0].(type) {
+	case query.OrderByKey, *query.OrderByKey:
+		// keys are unique, so any orders following a key order are irrelevant
+		return true
+	}
+	return false
+}
+
+// encodeTags validates tags against S3's restrictions, encoding them as URL query
+// parameters for use as PutObjectInput.Tagging
+func encodeTags(tags map[string]string) (string, error) {
+	if len(tags) > 10 {
+		return "", fmt.Errorf("objects can have at most 10 tags, got: %d", len(tags))
+	}
+
+	q := url.Values{}
+	for k, v := range tags {
+		if len(k) == 0 || len(k) > 128 || !validTag(k) {
+			return "", fmt.Errorf("invalid tag key: %q", k)
+		}
+		if len(v) > 256 || !validTag(v) {
+			return "", fmt.Errorf("invalid value for tag %q: %q", k, v)
+		}
+		q.Set(k, v)
+	}
+	return q.Encode(), nil
+}
+
+// validTag checks a tag key or value only contains characters S3 permits in tags
+func validTag(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.IsSpace(r) && !strings.ContainsRune("+-=._:/@", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// matches reports whether an entry passes all query filters
+func matches(filters []query.Filter, e query.Entry) bool {
+	for _, f := range filters {
+		if !f.Filter(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// contains checks if a string is present in a list of values
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ctxReadCloser is a response body read under a context, releasing the context when the
+// body is closed
+type ctxReadCloser struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Read from the response body, reporting context errors if the body read is interrupted
+func (r *ctxReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = ctxErr(r.ctx, err)
+	}
+	return n, err
+}
+
+// Close the response body & release the context
+func (r *ctxReadCloser) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// logOp logs the outcome of an operation started at start
+func (ds *Datastore) logOp(op, key string, start time.Time, err *error) {
+	ds.logger("s3 %s %s took %s, error: %v", op, key, time.Since(start), *err)
+}
+
+// logDryRun logs a write or delete of keys skipped in DryRun mode
+func (ds *Datastore) logDryRun(op string, keys ...datastore.Key) {
+	if ds.logger == nil {
+		return
+	}
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = key.String()
+	}
+	ds.logger("s3 dry run %s %s", op, strings.Join(names, " "))
+}
+
+// isNotFound reports whether err means an object doesn't exist. Stores disagree on how
+// missing objects are reported: S3 uses NoSuchKey for GETs & NotFound for HEAD requests,
+// which have no body to read a code from. Some compatible stores return a bare 404.
+// Missing buckets also 404, but are configuration errors rather than missing keys
+func isNotFound(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch awsErr.Code() {
+	case "NoSuchKey", "NotFound", "NoSuchVersion":
+		return true
+	case "NoSuchBucket":
+		return false
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusNotFound
+	}
+	return false
+}
+
+// isNotModified reports whether err is S3 responding 304 Not Modified to a conditional
+// request
+func isNotModified(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && reqErr.StatusCode() == http.StatusNotModified
+}
+
+// requestPayer returns the RequestPayer to set on object requests, accepting the charges
+// of requester-pays buckets when RequesterPays is set
+func (ds *Datastore) requestPayer() *string {
+	if ds.requesterPays {
+		return aws.String(awsS3.RequestPayerRequester)
+	}
+	return nil
+}
+
+// isLocked reports whether err is S3 refusing to delete an object version protected by
+// object lock retention or a legal hold
+func isLocked(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == "AccessDenied" && strings.Contains(strings.ToLower(awsErr.Message()), "object lock")
+}
+
+// withTimeout bounds ctx by the configured request timeout, if any
+func (ds *Datastore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ds.timeout == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, ds.timeout)
+}
+
+// ctxErr returns the context error in place of err once ctx is done. The SDK reports
+// cancellation as a "RequestCanceled" error, hiding context.Canceled from callers
+func ctxErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// credentialsProvider selects the provider used to sign requests. A nil provider leaves
+// credential resolution to the session, which uses the SDK's default credential chain
+func (ds *Datastore) credentialsProvider() credentials.Provider {
+	if ds.profile != "" || (ds.accessKey == "" && ds.useChain()) {
+		return nil
+	}
+
+	return &credentials.StaticProvider{Value: credentials.Value{
+		AccessKeyID:     ds.accessKey,
+		SecretAccessKey: ds.accessSecret,
+		SessionToken:    ds.accessToken,
+	}}
+}
+
+// S3Client returns the datastore's S3 client, creating it if needed, for operations the
+// datastore doesn't wrap. The client is shared with the datastore: changes made to its
+// handlers or to bucket state out-of-band are at the caller's risk. S3Client returns nil
+// when the S3API option is set to something other than an *s3.S3
+func (ds *Datastore) S3Client() *awsS3.S3 {
+	c, _ := ds.client()
+	svc, _ := c.(*awsS3.S3)
+	return svc
+}
+
+// client gives the S3 client & any error in creating it. Requests must not be made with a
+// client that failed to configure
+func (ds *Datastore) client() (s3iface.S3API, error) {
+	err := ds.initClient()
+	return ds.s3, err
+}
+
+// initClient creates the S3 client the first time it's called, so concurrent first
+// requests share a single client. Every call returns the error from creating it
+func (ds *Datastore) initClient() error {
+	ds.clientOnce.Do(func() {
+		ds.clientLk.Lock()
+		defer ds.clientLk.Unlock()
+		ds.clientErr = ds.newClient()
+	})
+	return ds.clientErr
+}
+
+// newClient creates the S3 client, returning any error in configuring it. The error is
+// returned by client, and attached to SDK clients so requests sent through S3Client fail
+// with it too
+func (ds *Datastore) newClient() error {
+	if ds.api != nil {
+		err := ds.configError()
+		ds.s3 = ds.api
+		if svc, ok := ds.api.(*awsS3.S3); ok {
+			svc = ds.attachHandlers(svc)
+			if err != nil {
+				svc.Handlers.Validate.PushBack(func(r *request.Request) {
+					r.Error = err
+				})
+			}
+			ds.s3 = svc
+		}
+		return err
+	}
+
+	cfg := &aws.Config{
+		Region:           aws.String(ds.Region),
+		S3ForcePathStyle: aws.Bool(ds.forcePathStyle),
+		S3UseAccelerate:  aws.Bool(ds.accelerate),
+		DisableSSL:       aws.Bool(ds.disableSSL),
+	}
+	if p := ds.credentialsProvider(); p != nil {
+		cfg.Credentials = credentials.NewCredentials(p)
+	}
+	if ds.Endpoint != "" {
+		cfg.Endpoint = aws.String(ds.Endpoint)
+	}
+	if ds.dualStack {
+		cfg.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+	if ds.httpClient != nil {
+		cfg.HTTPClient = ds.httpClient
+	}
+	if ds.maxRetries != aws.UseServiceDefaultRetries {
+		cfg.MaxRetries = aws.Int(ds.maxRetries)
+	}
+	if ds.retryer != nil {
+		cfg = request.WithRetryer(cfg, ds.retryer)
+	}
+	hc, tlsErr := ds.tlsHTTPClient()
+	if hc == nil && os.Getenv("AWS_CA_BUNDLE") != "" {
+		// the SDK loads AWS_CA_BUNDLE into the transport of the session's client in place, so
+		// it's given a copy, leaving HTTPClient & http.DefaultClient unmodified
+		hc = copyHTTPClient(ds.httpClient)
+	}
+	var roots *x509.CertPool
+	if hc != nil {
+		cfg.HTTPClient = hc
+		if t, ok := hc.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+			roots = t.TLSClientConfig.RootCAs
+		}
+	}
+
+	sess, err := ds.newSession(cfg)
+	if hc != nil && ds.session == nil && !ds.cachesSession() {
+		ds.ownHTTPClient = hc
+	}
+	// AWS_CA_BUNDLE replaces the root CAs of the transport, CACertPEM takes precedence
+	if roots != nil {
+		hc.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+	}
+	if err == nil {
+		err = tlsErr
+	}
+	if err == nil {
+		err = ds.configError()
+	}
+	if err != nil {
+		// cached sessions are shared, so only a copy can be made to fail
+		sess = sess.Copy()
+		failRequests(sess, err)
+	} else if ds.autoDetectRegion {
+		// requests use the configured region if detection fails
+		region, detectErr := ds.detectRegion(sess)
+		if detectErr != nil {
+			if ds.logger != nil {
+				ds.logger("s3 %s, using region %s", detectErr, ds.Region)
+			}
+		} else if region != ds.Region {
+			ds.Region = region
+			sess = sess.Copy(&aws.Config{Region: aws.String(region)})
+		}
+	}
+	var svc *awsS3.S3
+	if p := ds.assumeRoleProvider(sess); p != nil {
+		svc = awsS3.New(sess, &aws.Config{Credentials: credentials.NewCredentials(p)})
+	} else {
+		svc = awsS3.New(sess)
+	}
+	ds.s3 = ds.attachHandlers(svc)
+	return err
+}
+
+// names of the request handlers a Datastore adds to its client
+const (
+	rejectClosedHandler = "go-ds-s3.RejectClosed"
+	observeHandler      = "go-ds-s3.Observe"
+	requestErrorHandler = "go-ds-s3.RequestError"
+)
+
+// attachHandlers returns a copy of svc that rejects requests once ds is closed, returns
+// failures as RequestErrors & reports requests to ds's Observer, replacing handlers attached
+// for any other datastore. svc itself is left unmodified
+func (ds *Datastore) attachHandlers(svc *awsS3.S3) *awsS3.S3 {
+	c := &awsS3.S3{Client: &client.Client{
+		Config:     svc.Config,
+		ClientInfo: svc.ClientInfo,
+		Handlers:   svc.Handlers.Copy(),
+		Retryer:    svc.Retryer,
+	}}
+	c.Handlers.Validate.RemoveByName(rejectClosedHandler)
+	c.Handlers.Validate.PushBackNamed(request.NamedHandler{Name: rejectClosedHandler, Fn: ds.rejectClosed})
+	// AfterRetry is the last step run before a request that won't be retried returns its
+	// error. Errors can't be replaced once Complete handlers run
+	c.Handlers.AfterRetry.RemoveByName(requestErrorHandler)
+	c.Handlers.AfterRetry.PushBackNamed(request.NamedHandler{Name: requestErrorHandler, Fn: ds.wrapRequestError})
+	c.Handlers.Complete.RemoveByName(observeHandler)
+	c.Handlers.Complete.PushBackNamed(request.NamedHandler{Name: observeHandler, Fn: ds.observe})
+	return c
+}
+
+// detectRegion asks S3 which region the bucket is in
+func (ds *Datastore) detectRegion(sess *session.Session) (string, error) {
+	ctx, cancel := ds.withTimeout(context.Background())
+	defer cancel()
+
+	region, err := s3manager.GetBucketRegionWithClient(ctx, awsS3.New(sess), ds.Bucket)
+	if err != nil {
+		return "", fmt.Errorf("detecting region of bucket %s: %s", ds.Bucket, err)
+	}
+	return region, nil
+}
+
+// wrapRequestError replaces the error of a failed request with a RequestError
+func (ds *Datastore) wrapRequestError(r *request.Request) {
+	reqErr, ok := r.Error.(awserr.RequestFailure)
+	if _, wrapped := r.Error.(*RequestError); !ok || wrapped {
+		return
+	}
+
+	e := &RequestError{RequestFailure: reqErr, Op: r.Operation.Name}
+	if hostErr, ok := reqErr.(awsS3.RequestFailure); ok {
+		e.HostID = hostErr.HostID()
+	}
+	if values, err := awsutil.ValuesAtPath(r.Params, "Key"); err == nil && len(values) == 1 {
+		if path, ok := values[0].(*string); ok && path != nil {
+			e.Key = ds.key(*path).String()
+		}
+	}
+	r.Error = e
+}
+
+// observe reports a completed request to the observer
+func (ds *Datastore) observe(r *request.Request) {
+	ds.observer.ObserveOp(r.Operation.Name, time.Since(r.Time), r.Error)
+}
+
+// useChain reports whether credentials missing from the options are resolved by the
+// default credential chain, which is implied by web identity environment variables.
+// Without the variables the chain is ignored, failing fast instead of searching for
+// credentials that aren't there
+func (ds *Datastore) useChain() bool {
+	return ds.useCredChain || (os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "")
+}
+
+// webIdentityRole returns the token file, role & session name web identity credentials
+// are requested with, preferring options over the environment
+func (ds *Datastore) webIdentityRole() (tokenFile, roleARN, sessionName string) {
+	tokenFile, roleARN, sessionName = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), ds.roleARN, ds.roleSession
+	if roleARN == "" {
+		roleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+	if sessionName == "" {
+		sessionName = os.Getenv("AWS_ROLE_SESSION_NAME")
+	}
+	return tokenFile, roleARN, sessionName
+}
+
+// assumeRoleProvider returns a provider that assumes the configured IAM role using the
+// session's credentials, or with a web identity token if UseWebIdentity is set. It
+// returns nil if no role is configured
+func (ds *Datastore) assumeRoleProvider(sess *session.Session) credentials.Provider {
+	if ds.useWebIdentity {
+		tokenFile, roleARN, sessionName := ds.webIdentityRole()
+		if sessionName == "" {
+			sessionName = fmt.Sprintf("%d", time.Now().UTC().UnixNano())
+		}
+		return stscreds.NewWebIdentityRoleProviderWithOptions(sts.New(sess), roleARN, sessionName, stscreds.FetchTokenPath(tokenFile))
+	}
+	if ds.roleARN == "" {
+		return nil
+	}
+
+	p := &stscreds.AssumeRoleProvider{
+		Client:          sts.New(sess),
+		RoleARN:         ds.roleARN,
+		RoleSessionName: ds.roleSession,
+		Duration:        stscreds.DefaultDuration,
+	}
+	if p.RoleSessionName == "" {
+		p.RoleSessionName = fmt.Sprintf("%d", time.Now().UTC().UnixNano())
+	}
+	if ds.externalID != "" {
+		p.ExternalID = aws.String(ds.externalID)
+	}
+	return p
+}
+
+// sessions caches the sessions datastores create, so datastores with identical connection
+// & credential options share credentials & connection pools
+var sessions = struct {
+	sync.Mutex
+	m map[sessionKey]*session.Session
+}{m: map[sessionKey]*session.Session{}}
+
+// sessionKey identifies the options a session is created from. Static credentials are
+// identified by their hash, so the cache doesn't hold secrets. caBundle is the
+// AWS_CA_BUNDLE the session's client trusts
+type sessionKey struct {
+	region, endpoint                          string
+	credentials                               [sha256.Size]byte
+	caCertPEM, caBundle                       string
+	useCredChain, forcePathStyle, accelerate  bool
+	dualStack, disableSSL, insecureSkipVerify bool
+	maxRetries                                int
+	httpClient                                *http.Client
+}
+
+// cachesSession reports whether the datastore's session is shared with other datastores
+// configured the same way. Sessions with retryers, profiles or session tokens aren't cached
+func (ds *Datastore) cachesSession() bool {
+	return ds.session == nil && ds.retryer == nil && ds.profile == "" && ds.accessToken == ""
+}
+
+// newSession returns the session clients are built from, copying the Session option in
+// place of cfg if set. Sessions are shared by datastores with identical options, unless a
+// Retryer, Profile or AccessToken is set, as profiles are read from files that may change
+// and session tokens expire, so caching sessions for them would never free any. If the
+// configured profile can't be loaded newSession returns a session without it, along with
+// the error
+func (ds *Datastore) newSession(cfg *aws.Config) (*session.Session, error) {
+	if ds.session != nil {
+		return ds.session.Copy(), nil
+	}
+	if !ds.cachesSession() {
+		return ds.createSession(cfg)
+	}
+
+	key := sessionKey{
+		region:             ds.Region,
+		endpoint:           ds.Endpoint,
+		credentials:        sha256.Sum256([]byte(ds.accessKey + "\x00" + ds.accessSecret)),
+		caCertPEM:          string(ds.caCertPEM),
+		caBundle:           os.Getenv("AWS_CA_BUNDLE"),
+		useCredChain:       ds.useChain(),
+		forcePathStyle:     ds.forcePathStyle,
+		accelerate:         ds.accelerate,
+		dualStack:          ds.dualStack,
+		disableSSL:         ds.disableSSL,
+		insecureSkipVerify: ds.insecureSkipVerify,
+		maxRetries:         ds.maxRetries,
+		httpClient:         ds.httpClient,
+	}
+
+	sessions.Lock()
+	defer sessions.Unlock()
+	if sess, ok := sessions.m[key]; ok {
+		return sess, nil
+	}
+	sess, err := ds.createSession(cfg)
+	if err == nil {
+		sessions.m[key] = sess
+	}
+	return sess, err
+}
+
+// createSession creates a new session from cfg & the configured profile. Sessions resolve
+// credentials missing from cfg with the default credential chain, including web identity
+// tokens from the environment
+func (ds *Datastore) createSession(cfg *aws.Config) (*session.Session, error) {
+	if ds.profile == "" {
+		sess, err := session.NewSession(cfg)
+		if err != nil {
+			return session.New(cfg), err
+		}
+		return sess, nil
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *cfg,
+		Profile:           ds.profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return session.New(cfg), err
+	}
+	return sess, nil
+}
+
+// tlsHTTPClient returns a copy of the HTTP client requests are made with, with a transport
+// trusting CACertPEM & skipping verification if InsecureSkipVerify is set. tlsHTTPClient
+// returns nil if neither option is set
+func (ds *Datastore) tlsHTTPClient() (*http.Client, error) {
+	if len(ds.caCertPEM) == 0 && !ds.insecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{InsecureSkipVerify: ds.insecureSkipVerify}
+	if len(ds.caCertPEM) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(ds.caCertPEM) {
+			return nil, errors.New("CACertPEM contains no valid certificates")
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	hc := &http.Client{}
+	base := http.DefaultTransport
+	if ds.httpClient != nil {
+		*hc = *ds.httpClient
+		if hc.Transport != nil {
+			base = hc.Transport
+		}
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return nil, errors.New("CACertPEM and InsecureSkipVerify require HTTPClient to use an *http.Transport")
+	}
+	t = t.Clone()
+	t.TLSClientConfig = tlsCfg
+	hc.Transport = t
+	return hc, nil
+}
+
+// copyHTTPClient copies c, or http.DefaultClient if c is nil, along with its transport
+func copyHTTPClient(c *http.Client) *http.Client {
+	hc := &http.Client{}
+	if c != nil {
+		*hc = *c
+	}
+	if t, ok := hc.Transport.(*http.Transport); ok {
+		hc.Transport = t.Clone()
+	}
+	return hc
+}
+
+// failRequests causes every request made with sess to fail with err before being sent
+func failRequests(sess *session.Session, err error) {
+	sess.Handlers.Validate.PushBack(func(r *request.Request) {
+		r.Error = err
+	})
+}
+
+// validate checks for options that can't form a working client, which configError
+// doesn't report because NewDatastore has always accepted them
+func (ds *Datastore) validate() error {
+	if ds.Bucket == "" {
+		return errors.New("bucket name is required")
+	}
+	// S3API clients & sessions carry their own endpoint, region & credentials
+	if ds.api != nil || ds.session != nil {
+		return nil
+	}
+
+	if ds.Endpoint != "" {
+		if u, err := url.Parse(ds.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid Endpoint %q: must be an absolute url, eg. http://localhost:9000", ds.Endpoint)
+		}
+	} else if ds.Region == "" {
+		return errors.New("Region is required when no Endpoint is set")
+	} else if _, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), ds.Region); !ok {
+		return fmt.Errorf("unknown Region %q", ds.Region)
+	}
+
+	if ds.useWebIdentity {
+		tokenFile, roleARN, _ := ds.webIdentityRole()
+		if tokenFile == "" {
+			return errors.New("UseWebIdentity requires AWS_WEB_IDENTITY_TOKEN_FILE to be set")
+		}
+		if roleARN == "" {
+			return errors.New("UseWebIdentity requires RoleARN or AWS_ROLE_ARN to be set")
+		}
+	} else if ds.profile == "" && !ds.useChain() && (ds.accessKey == "" || ds.accessSecret == "") {
+		return errors.New("no credentials: set AccessKey and AccessSecret, Profile, or UseDefaultCredentialChain")
+	}
+	return nil
+}
+
+// resolveCredentials retrieves the credentials of a Profile or the default credential chain,
+// which are otherwise only read by the first request. Clients & sessions passed in carry
+// their own credentials
+func (ds *Datastore) resolveCredentials() error {
+	if ds.api != nil || ds.session != nil || (ds.profile == "" && !ds.useCredChain) {
+		return nil
+	}
+	svc, ok := ds.s3.(*awsS3.S3)
+	if !ok {
+		return nil
+	}
+	if _, err := svc.Config.Credentials.Get(); err != nil {
+		return fmt.Errorf("resolving credentials: %s", err)
+	}
+	return nil
+}
+
+// configError reports options that can't be used together
+func (ds *Datastore) configError() error {
+	if ds.accelerate && ds.forcePathStyle {
+		return errors.New("UseAccelerate and ForcePathStyle can't be used together: transfer acceleration requires virtual-host style addressing")
+	}
+	if ds.delimiter != "" && ds.shardFn != nil {
+		return errors.New("Delimiter and ShardFunc can't be used together: sharded keys don't share prefixes")
+	}
+	if ds.inlineValues > maxInlineValueSize {
+		return fmt.Errorf("InlineSmallValues can't exceed %d bytes, got: %d", maxInlineValueSize, ds.inlineValues)
+	}
+	if (ds.escapeFn == nil) != (ds.unescapeFn == nil) {
+		return errors.New("KeyEscapeFunc and KeyUnescapeFunc must be set together")
+	}
+	if strings.Contains(ds.keySuffix, "/") {
+		return fmt.Errorf("KeySuffix can't contain slashes, got: %q", ds.keySuffix)
+	}
+	if ds.listPageSize < 1 || ds.listPageSize > maxListPageSize {
+		return fmt.Errorf("ListPageSize must be between 1 and %d, got: %d", maxListPageSize, ds.listPageSize)
+	}
+	return nil
+}
+
+// ShardSuffix returns a ShardFunc that shards keys by their last n characters, padding
+// shorter keys with underscores
+func ShardSuffix(n int) func(key datastore.Key) string {
+	return func(key datastore.Key) string {
+		name := strings.Repeat("_", n) + key.BaseNamespace()
+		return name[len(name)-n:]
+	}
+}
+
+// ShardPrefix returns a ShardFunc that shards keys by their first n characters, padding
+// shorter keys with underscores. It matches the flatfs "prefix" shard function
+func ShardPrefix(n int) func(key datastore.Key) string {
+	return func(key datastore.Key) string {
+		return (key.BaseNamespace() + strings.Repeat("_", n))[:n]
+	}
+}
+
+// ShardNextToLast returns a ShardFunc that shards keys by the n characters before their
+// last character, padding shorter keys with underscores. It matches the flatfs
+// "next-to-last" shard function go-ipfs uses by default: with n = 2 "/CIQABC" is stored as
+// "AB/CIQABC". The last character of a base32 multihash key carries fewer bits, so skipping
+// it spreads keys evenly
+func ShardNextToLast(n int) func(key datastore.Key) string {
+	return func(key datastore.Key) string {
+		name := strings.Repeat("_", n+1) + key.BaseNamespace()
+		offset := len(name) - n - 1
+		return name[offset : offset+n]
+	}
+}
+
+// flatfsShardPrefix prefixes flatfs shard function specs, as written to a flatfs
+// repo's SHARDING file
+const flatfsShardPrefix = "/repo/flatfs/shard/v1/"
+
+// ParseShardFunc returns the ShardFunc for a flatfs shard function spec, eg.
+// "/repo/flatfs/shard/v1/next-to-last/2", so objects can be laid out like an existing
+// flatfs repo. The "/repo/flatfs/shard/v1/" prefix is optional
+func ParseShardFunc(spec string) (func(key datastore.Key) string, error) {
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(spec), flatfsShardPrefix), "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid shard function %q", spec)
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid shard function %q: length must be a positive integer", spec)
+	}
+
+	switch parts[0] {
+	case "prefix":
+		return ShardPrefix(n), nil
+	case "suffix":
+		return ShardSuffix(n), nil
+	case "next-to-last":
+		return ShardNextToLast(n), nil
+	default:
+		return nil, fmt.Errorf("invalid shard function %q: unknown function %q", spec, parts[0])
+	}
+}
+
+// validKey checks key can be stored without escaping Path or colliding with other keys.
+// Keys must be absolute & non-empty, and can't contain empty, "." or ".." segments or
+// control characters. datastore.NewKey cleans keys of everything but control characters,
+// so only raw & empty keys are otherwise invalid
+func validKey(key datastore.Key) error {
+	k := key.String()
+	if !strings.HasPrefix(k, "/") {
+		return fmt.Errorf("invalid key %q: keys must start with /", k)
+	}
+	if k == "/" {
+		return fmt.Errorf("invalid key %q: keys can't be empty", k)
+	}
+	for _, segment := range strings.Split(k[1:], "/") {
+		switch segment {
+		case "":
+			return fmt.Errorf("invalid key %q: keys can't contain empty segments", k)
+		case ".", "..":
+			return fmt.Errorf("invalid key %q: keys can't contain relative segments", k)
+		}
+	}
+	for _, r := range k {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("invalid key %q: keys can't contain control characters", k)
+		}
+	}
+	return nil
+}
+
+// root is the prefix of every object path: Path with a single trailing slash, or empty
+// when Path is empty
+func (ds *Datastore) root() string {
+	if p := strings.Trim(ds.Path, "/"); p != "" {
+		return p + "/"
+	}
+	return ""
+}
+
+// path creates the full path to an object by appending the bucket path to key.Path,
+// followed by any KeySuffix
+func (ds *Datastore) path(key datastore.Key) string {
+	p := ds.escape(strings.TrimLeft(key.String(), "/"))
+	if ds.shardFn != nil {
+		p = ds.shardFn(key) + "/" + p
+	}
+	return ds.root() + p + ds.keySuffix
+}
+
+// stringPath creates the full path to an object by appending the bucket path to path
+func (ds *Datastore) stringPath(path string) string {
+	return ds.root() + ds.escape(strings.TrimLeft(path, "/"))
+}
+
+// key returns a key from a full object path, removing the ds.Path prefix, shard & suffix
+func (ds *Datastore) key(fullPath string) datastore.Key {
+	p := strings.TrimSuffix(strings.TrimPrefix(fullPath, ds.root()), ds.keySuffix)
+	if ds.shardFn != nil {
+		if i := strings.IndexByte(p, '/'); i >= 0 {
+			p = p[i:]
+		}
+	}
+	return datastore.NewKey(ds.unescape(p))
 }
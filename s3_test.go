@@ -1,11 +1,44 @@
 package s3
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	ds "github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
 )
 
 var testcases = map[string]string{
@@ -22,93 +55,3711 @@ var testcases = map[string]string{
 // set this to the name of the bucket you'd like to test with
 const bucketName = "YOUR_TEST_BUCKET_NAME"
 
+// skipWithoutS3 skips tests that run against the live test bucket unless AWS credentials
+// are set in the environment
+func skipWithoutS3(t *testing.T) {
+	t.Helper()
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		t.Skip("set AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY & bucketName to test against S3")
+	}
+}
+
 func newDS(t *testing.T) *Datastore {
+	skipWithoutS3(t)
 	return NewDatastore(bucketName, func(o *Options) {
 		o.Region = "us-east-1"
 	})
 }
 
-func addTestCases(t *testing.T, d *Datastore, testcases map[string]string) {
+func addTestCases(t *testing.T, d *Datastore, testcases map[string]string) {
+	ctx := context.Background()
+	for k, v := range testcases {
+		dsk := ds.NewKey(k)
+		if err := d.Put(ctx, dsk, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for k, v := range testcases {
+		dsk := ds.NewKey(k)
+		v2, err := d.Get(ctx, dsk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v2) != v {
+			t.Errorf("%s values differ: '%s' != '%s'", k, v, v2)
+		}
+	}
+
+}
+
+func TestEndpoint(t *testing.T) {
+	d := NewDatastore(bucketName)
+	if cfg := d.S3Client().Config; cfg.Endpoint != nil {
+		t.Errorf("expected default config to have no endpoint, got: %s", aws.StringValue(cfg.Endpoint))
+	}
+
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.Endpoint = "http://localhost:9000"
+	})
+	cfg := d.S3Client().Config
+	if aws.StringValue(cfg.Endpoint) != "http://localhost:9000" {
+		t.Errorf("endpoint mismatch. expected: %s, got: %s", "http://localhost:9000", aws.StringValue(cfg.Endpoint))
+	}
+}
+
+func TestForcePathStyle(t *testing.T) {
+	d := NewDatastore(bucketName)
+	if aws.BoolValue(d.S3Client().Config.S3ForcePathStyle) {
+		t.Error("expected path-style addressing to be off by default")
+	}
+
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.Endpoint = "http://localhost:9000"
+		o.ForcePathStyle = true
+	})
+	if !aws.BoolValue(d.S3Client().Config.S3ForcePathStyle) {
+		t.Error("expected ForcePathStyle option to set S3ForcePathStyle")
+	}
+}
+
+func TestDisableSSL(t *testing.T) {
+	d := NewDatastore(bucketName)
+	if aws.BoolValue(d.S3Client().Config.DisableSSL) {
+		t.Error("expected SSL to be enabled by default")
+	}
+	if endpoint := d.S3Client().Endpoint; !strings.HasPrefix(endpoint, "https://") {
+		t.Errorf("expected an https endpoint by default, got: %s", endpoint)
+	}
+
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.DisableSSL = true
+	})
+	if !aws.BoolValue(d.S3Client().Config.DisableSSL) {
+		t.Error("expected DisableSSL option to set DisableSSL")
+	}
+	if endpoint := d.S3Client().Endpoint; !strings.HasPrefix(endpoint, "http://") {
+		t.Errorf("expected an http endpoint with SSL disabled, got: %s", endpoint)
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	d := NewDatastore(bucketName)
+	if strings.Contains(d.S3Client().Endpoint, "dualstack") {
+		t.Errorf("expected default endpoint not to be dual-stack, got: %s", d.S3Client().Endpoint)
+	}
+
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.UseDualStack = true
+	})
+	if d.S3Client().Config.UseDualStackEndpoint != endpoints.DualStackEndpointStateEnabled {
+		t.Error("expected UseDualStack option to enable dual-stack endpoint resolution")
+	}
+	if !strings.Contains(d.S3Client().Endpoint, "dualstack") {
+		t.Errorf("expected a dual-stack endpoint, got: %s", d.S3Client().Endpoint)
+	}
+}
+
+func TestAccelerate(t *testing.T) {
+	d := NewDatastore(bucketName)
+	if aws.BoolValue(d.S3Client().Config.S3UseAccelerate) {
+		t.Error("expected transfer acceleration to be off by default")
+	}
+
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.UseAccelerate = true
+	})
+	if !aws.BoolValue(d.S3Client().Config.S3UseAccelerate) {
+		t.Error("expected UseAccelerate option to set S3UseAccelerate")
+	}
+	if err := d.configError(); err != nil {
+		t.Errorf("unexpected config error: %s", err)
+	}
+
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.UseAccelerate = true
+		o.ForcePathStyle = true
+	})
+	expect := "UseAccelerate and ForcePathStyle can't be used together: transfer acceleration requires virtual-host style addressing"
+	if err := d.configError(); err == nil || err.Error() != expect {
+		t.Errorf("config error mismatch. expected: %s, got: %v", expect, err)
+	}
+	// requests with invalid configuration fail without being sent
+	if _, err := d.Has(context.Background(), ds.NewKey("/a")); err == nil || err.Error() != expect {
+		t.Errorf("request error mismatch. expected: %s, got: %v", expect, err)
+	}
+
+	// including requests of S3API clients, which the SDK's handlers don't run for
+	d, m := newMockDS(func(o *Options) {
+		o.UseAccelerate = true
+		o.ForcePathStyle = true
+	})
+	if _, err := d.Has(context.Background(), ds.NewKey("/a")); err == nil || err.Error() != expect {
+		t.Errorf("S3API request error mismatch. expected: %s, got: %v", expect, err)
+	}
+	if len(m.requests) != 0 {
+		t.Errorf("expected no requests to be sent, got: %v", m.requests)
+	}
+}
+
+func TestNewDatastoreWithError(t *testing.T) {
+	creds := func(o *Options) {
+		o.AccessKey = "key"
+		o.AccessSecret = "secret"
+	}
+
+	d, err := NewDatastoreWithError(bucketName, creds)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d.s3 == nil {
+		t.Error("expected client to be created")
+	}
+
+	cases := []struct {
+		bucket string
+		opt    func(o *Options)
+		expect string
+	}{
+		{"", creds, "bucket name is required"},
+		{bucketName, func(o *Options) { creds(o); o.Endpoint = "localhost:9000" }, `invalid Endpoint "localhost:9000": must be an absolute url, eg. http://localhost:9000`},
+		{bucketName, func(o *Options) { creds(o); o.Region = "" }, "Region is required when no Endpoint is set"},
+		{bucketName, func(o *Options) { creds(o); o.Region = "mars-west-1" }, `unknown Region "mars-west-1"`},
+		{bucketName, func(o *Options) { o.AccessKey = ""; o.AccessSecret = "" }, "no credentials: set AccessKey and AccessSecret, Profile, or UseDefaultCredentialChain"},
+		{bucketName, func(o *Options) { o.AccessKey = "key"; o.AccessSecret = "" }, "no credentials: set AccessKey and AccessSecret, Profile, or UseDefaultCredentialChain"},
+		{bucketName, func(o *Options) { creds(o); o.UseAccelerate = true; o.ForcePathStyle = true }, "UseAccelerate and ForcePathStyle can't be used together: transfer acceleration requires virtual-host style addressing"},
+		{bucketName, func(o *Options) { creds(o); o.ListPageSize = 0 }, "ListPageSize must be between 1 and 1000, got: 0"},
+	}
+
+	for i, c := range cases {
+		d, err := NewDatastoreWithError(c.bucket, c.opt)
+		if err == nil || err.Error() != c.expect {
+			t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.expect, err)
+		}
+		if d != nil {
+			t.Errorf("case %d expected no datastore on error", i)
+		}
+	}
+
+	// a profile that doesn't exist fails construction
+	path := filepath.Join(t.TempDir(), "credentials")
+	if err := ioutil.WriteFile(path, []byte("[other]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", path)
+	t.Setenv("AWS_CONFIG_FILE", path)
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	d, err = NewDatastoreWithError(bucketName, func(o *Options) { o.Profile = "missing" })
+	if err == nil || !strings.HasPrefix(err.Error(), "resolving credentials: ") {
+		t.Errorf("expected missing profile to fail construction, got: %v", err)
+	}
+	if d != nil {
+		t.Error("expected no datastore for a missing profile")
+	}
+}
+
+func TestInjectedClientConfig(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	// clients & sessions passed in don't need credentials or a region
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.AnonymousCredentials,
+	}))
+	injected := map[string]func(o *Options){
+		"S3API":   func(o *Options) { o.S3API = newMockS3() },
+		"Session": func(o *Options) { o.Session = sess },
+	}
+	for name, opt := range injected {
+		if _, err := NewDatastoreWithError(bucketName, opt, func(o *Options) { o.Region = "" }); err != nil {
+			t.Errorf("%s unexpected error: %s", name, err)
+		}
+	}
+
+	// configuration errors fail every operation of datastores with an injected client
+	cases := []struct {
+		opt    func(o *Options)
+		expect string
+	}{
+		{func(o *Options) { o.ListPageSize = 0 }, "ListPageSize must be between 1 and 1000, got: 0"},
+		{func(o *Options) { o.KeyEscapeFunc = PercentEscape }, "KeyEscapeFunc and KeyUnescapeFunc must be set together"},
+	}
+	for i, c := range cases {
+		m := newMockS3()
+		opts := []func(o *Options){func(o *Options) { o.S3API = m }, c.opt}
+		if _, err := NewDatastoreWithError(bucketName, opts...); err == nil || err.Error() != c.expect {
+			t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.expect, err)
+		}
+
+		d := NewDatastore(bucketName, opts...)
+		ops := map[string]func() error{
+			"Put": func() error { return d.Put(ctx, ds.NewKey("/a"), []byte("a")) },
+			"Get": func() error { _, err := d.Get(ctx, ds.NewKey("/a")); return err },
+			"Has": func() error { _, err := d.Has(ctx, ds.NewKey("/a")); return err },
+			"Query": func() error {
+				res, err := d.Query(ctx, dsq.Query{})
+				if err != nil {
+					return err
+				}
+				_, err = res.Rest()
+				return err
+			},
+		}
+		for name, op := range ops {
+			if err := op(); err == nil || err.Error() != c.expect {
+				t.Errorf("case %d %s error mismatch. expected: %s, got: %v", i, name, c.expect, err)
+			}
+		}
+		if len(m.objects) != 0 {
+			t.Errorf("case %d expected nothing to be written, got: %d objects", i, len(m.objects))
+		}
+	}
+}
+
+func TestAutoDetectRegion(t *testing.T) {
+	ctx := context.Background()
+
+	// the bucket lives in eu-west-1, redirecting requests signed for any other region
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-amz-bucket-region", "eu-west-1")
+		if !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/s3/") {
+			w.WriteHeader(http.StatusMovedPermanently)
+			if r.Method != http.MethodHead {
+				fmt.Fprint(w, `<Error><Code>PermanentRedirect</Code><Message>The bucket you are attempting to access must be addressed using the specified endpoint.</Message></Error>`)
+			}
+			return
+		}
+		w.Write([]byte("value"))
+	}))
+	defer srv.Close()
+
+	options := func(detect bool) func(o *Options) {
+		return func(o *Options) {
+			o.Endpoint = srv.URL
+			o.ForcePathStyle = true
+			o.AccessKey = "key"
+			o.AccessSecret = "secret"
+			o.Region = "us-east-1"
+			o.AutoDetectRegion = detect
+		}
+	}
+
+	if _, err := NewDatastore(bucketName, options(false)).Get(ctx, ds.NewKey("/a")); err == nil {
+		t.Error("expected request signed for the wrong region to fail")
+	}
+
+	d, err := NewDatastoreWithError(bucketName, options(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Region != "eu-west-1" {
+		t.Errorf("region mismatch. expected: eu-west-1, got: %s", d.Region)
+	}
+	if region := aws.StringValue(d.S3Client().Config.Region); region != "eu-west-1" {
+		t.Errorf("client region mismatch. expected: eu-west-1, got: %s", region)
+	}
+	v, err := d.Get(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "value" {
+		t.Errorf("value mismatch. expected: value, got: %s", v)
+	}
+
+	// failing to detect the region is logged, keeping the configured region
+	undetectable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("value"))
+	}))
+	defer undetectable.Close()
+
+	lines := []string{}
+	d, err = NewDatastoreWithError(bucketName, options(true), func(o *Options) {
+		o.Endpoint = undetectable.URL
+		o.Logger = func(format string, args ...interface{}) {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}
+	})
+	if err != nil {
+		t.Fatalf("expected failed region detection not to fail the datastore, got: %s", err)
+	}
+	if d.Region != "us-east-1" {
+		t.Errorf("region mismatch. expected: us-east-1, got: %s", d.Region)
+	}
+	if v, err := d.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "value" {
+		t.Errorf("expected requests to use the configured region, got: %q, %v", v, err)
+	}
+	if len(lines) == 0 || !strings.Contains(lines[0], "detecting region") {
+		t.Errorf("expected failed region detection to be logged, got: %v", lines)
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	// clients are copied to load a CA bundle from the environment, as TestTLSOptions checks
+	t.Setenv("AWS_CA_BUNDLE", "")
+	d := NewDatastore(bucketName)
+	if d.S3Client().Config.HTTPClient != http.DefaultClient {
+		t.Error("expected default config to use the default http client")
+	}
+
+	hc := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 100}}
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.HTTPClient = hc
+	})
+	if d.S3Client().Config.HTTPClient != hc {
+		t.Error("expected HTTPClient option to be used by the client config")
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	ctx := context.Background()
+	// options are checked without a CA bundle from the environment, which is checked below
+	t.Setenv("AWS_CA_BUNDLE", "")
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	cases := []struct {
+		caPEM    []byte
+		insecure bool
+		err      string
+	}{
+		{nil, false, "certificate"},
+		{caPEM, false, ""},
+		{nil, true, ""},
+		{[]byte("not a certificate"), false, "CACertPEM contains no valid certificates"},
+	}
+
+	for i, c := range cases {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.Endpoint = srv.URL
+			o.ForcePathStyle = true
+			o.AccessKey = "key"
+			o.AccessSecret = "secret"
+			o.CACertPEM = c.caPEM
+			o.InsecureSkipVerify = c.insecure
+			o.MaxRetries = 0
+		})
+
+		err := d.Put(ctx, ds.NewKey("/a"), []byte("a"))
+		if c.err == "" && err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+		} else if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.err, err)
+		}
+		if c.err != "" {
+			continue
+		}
+
+		transport, ok := d.S3Client().Config.HTTPClient.Transport.(*http.Transport)
+		if !ok {
+			t.Errorf("case %d expected an *http.Transport", i)
+			continue
+		}
+		if transport.TLSClientConfig.InsecureSkipVerify != c.insecure {
+			t.Errorf("case %d InsecureSkipVerify mismatch. expected: %t, got: %t", i, c.insecure, transport.TLSClientConfig.InsecureSkipVerify)
+		}
+		if (c.caPEM != nil) != (transport.TLSClientConfig.RootCAs != nil) {
+			t.Errorf("case %d expected root CAs only when CACertPEM is set", i)
+		}
+	}
+
+	// TLS options apply on top of a configured HTTPClient. the transport has a TLS config, as
+	// transports without one get a default config on first use
+	tlsCfg := &tls.Config{}
+	transport := &http.Transport{MaxIdleConnsPerHost: 100, TLSClientConfig: tlsCfg}
+	hc := &http.Client{Timeout: time.Minute, Transport: transport}
+	unmodified := func(name string) {
+		t.Helper()
+		if hc.Transport != transport || transport.TLSClientConfig != tlsCfg || tlsCfg.InsecureSkipVerify || tlsCfg.RootCAs != nil {
+			t.Errorf("expected %s to leave the HTTPClient option unmodified", name)
+		}
+	}
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.HTTPClient = hc
+		o.InsecureSkipVerify = true
+	})
+	got := d.S3Client().Config.HTTPClient
+	if got.Timeout != time.Minute || got.Transport.(*http.Transport).MaxIdleConnsPerHost != 100 {
+		t.Error("expected TLS options to keep HTTPClient settings")
+	}
+	unmodified("TLS options")
+
+	// the SDK loads a CA bundle from the environment into the client's transport, replacing
+	// its root CAs. the bundle holds a CA that didn't sign the test server's certificate
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bundle CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	ca, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(t.TempDir(), "bundle.pem")
+	if err := ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CA_BUNDLE", bundle)
+
+	put := func(endpoint string, opt func(o *Options)) error {
+		return NewDatastore(bucketName, func(o *Options) {
+			o.Endpoint = endpoint
+			o.ForcePathStyle = true
+			o.AccessKey = "key"
+			o.AccessSecret = "secret"
+			o.MaxRetries = 0
+		}, opt).Put(ctx, ds.NewKey("/a"), []byte("a"))
+	}
+	if err := put(srv.URL, func(o *Options) { o.CACertPEM = caPEM }); err != nil {
+		t.Errorf("expected CACertPEM to take precedence over AWS_CA_BUNDLE, got: %s", err)
+	}
+	if err := put(srv.URL, func(o *Options) { o.HTTPClient = hc }); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("expected AWS_CA_BUNDLE to apply to the HTTPClient option, got: %v", err)
+	}
+	unmodified("AWS_CA_BUNDLE")
+	defaultTransport := http.DefaultClient.Transport
+	if err := put(srv.URL, func(o *Options) {}); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("expected AWS_CA_BUNDLE to apply to the default client, got: %v", err)
+	}
+	if http.DefaultClient.Transport != defaultTransport {
+		t.Error("expected AWS_CA_BUNDLE to leave the default client unmodified")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	d := NewDatastore(bucketName)
+	if retries := aws.IntValue(d.S3Client().Config.MaxRetries); retries != aws.UseServiceDefaultRetries {
+		t.Errorf("expected default config to use service default retries, got: %d", retries)
+	}
+
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.MaxRetries = 0
+	})
+	if d.S3Client().Config.MaxRetries == nil || *d.S3Client().Config.MaxRetries != 0 {
+		t.Errorf("expected MaxRetries option of 0 to disable retries, got: %v", d.S3Client().Config.MaxRetries)
+	}
+
+	retryer := client.DefaultRetryer{NumMaxRetries: 10}
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.Retryer = retryer
+	})
+	if d.S3Client().Config.Retryer != retryer {
+		t.Error("expected Retryer option to be used by the client config")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// the slow server never responds, holding requests open until the client gives up
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Endpoint = slow.URL
+		o.ForcePathStyle = true
+		o.AccessKey = "key"
+		o.AccessSecret = "secret"
+		o.MaxRetries = 0
+		o.Timeout = 50 * time.Millisecond
+	})
+
+	start := time.Now()
+	if _, err := d.Get(context.Background(), ds.NewKey("/a")); err != context.DeadlineExceeded {
+		t.Errorf("error mismatch. expected: %s, got: %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected get to time out after ~50ms, took: %s", elapsed)
+	}
+}
+
+func TestCredentialsProvider(t *testing.T) {
+	cases := []struct {
+		accessKey string
+		useChain  bool
+		static    bool
+	}{
+		{"key", false, true},
+		{"", false, true},
+		{"key", true, true},
+		{"", true, false},
+	}
+
+	for i, c := range cases {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.AccessKey = c.accessKey
+			o.AccessSecret = "secret"
+			o.UseDefaultCredentialChain = c.useChain
+		})
+
+		p := d.credentialsProvider()
+		if !c.static {
+			if p != nil {
+				t.Errorf("case %d expected default credential chain, got: %T", i, p)
+			}
+			continue
+		}
+
+		sp, ok := p.(*credentials.StaticProvider)
+		if !ok {
+			t.Errorf("case %d expected static credentials, got: %T", i, p)
+			continue
+		}
+		if sp.AccessKeyID != c.accessKey {
+			t.Errorf("case %d access key mismatch. expected: %q, got: %q", i, c.accessKey, sp.AccessKeyID)
+		}
+	}
+}
+
+func TestProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	data := "[test]\naws_access_key_id = profile-key\naws_secret_access_key = profile-secret\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", path)
+
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Profile = "test"
+		o.AccessKey = "static-key"
+		o.AccessSecret = "static-secret"
+	})
+	if p := d.credentialsProvider(); p != nil {
+		t.Errorf("expected profile to take precedence over static credentials, got: %T", p)
+	}
+
+	creds, err := d.S3Client().Config.Credentials.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDatastoreWithError(bucketName, func(o *Options) { o.Profile = "test" }); err != nil {
+		t.Errorf("expected profile to resolve on construction, got: %s", err)
+	}
+	if creds.AccessKeyID != "profile-key" {
+		t.Errorf("access key mismatch. expected: %q, got: %q", "profile-key", creds.AccessKeyID)
+	}
+	if creds.SecretAccessKey != "profile-secret" {
+		t.Errorf("access secret mismatch. expected: %q, got: %q", "profile-secret", creds.SecretAccessKey)
+	}
+}
+
+func TestAssumeRoleProvider(t *testing.T) {
+	sess := session.New()
+
+	d := NewDatastore(bucketName)
+	if p := d.assumeRoleProvider(sess); p != nil {
+		t.Errorf("expected no assume role provider without a RoleARN, got: %T", p)
+	}
+
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.RoleARN = "arn:aws:iam::123456789012:role/ipfs"
+		o.RoleSessionName = "ipfs-node"
+		o.ExternalID = "external"
+	})
+	p, ok := d.assumeRoleProvider(sess).(*stscreds.AssumeRoleProvider)
+	if !ok {
+		t.Fatalf("expected an STS assume role provider, got: %T", d.assumeRoleProvider(sess))
+	}
+	if p.RoleARN != "arn:aws:iam::123456789012:role/ipfs" {
+		t.Errorf("RoleARN mismatch. got: %q", p.RoleARN)
+	}
+	if p.RoleSessionName != "ipfs-node" {
+		t.Errorf("RoleSessionName mismatch. got: %q", p.RoleSessionName)
+	}
+	if aws.StringValue(p.ExternalID) != "external" {
+		t.Errorf("ExternalID mismatch. got: %q", aws.StringValue(p.ExternalID))
+	}
+}
+
+func TestWebIdentity(t *testing.T) {
+	sess := session.New()
+	noKeys := func(o *Options) {
+		o.AccessKey, o.AccessSecret, o.AccessToken = "", "", ""
+	}
+
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	t.Setenv("AWS_ROLE_ARN", "")
+	t.Setenv("AWS_ROLE_SESSION_NAME", "")
+	if _, err := NewDatastoreWithError(bucketName, noKeys, func(o *Options) { o.UseWebIdentity = true }); err == nil || err.Error() != "UseWebIdentity requires AWS_WEB_IDENTITY_TOKEN_FILE to be set" {
+		t.Errorf("missing token file error mismatch. got: %v", err)
+	}
+
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", filepath.Join(t.TempDir(), "token"))
+	if _, err := NewDatastoreWithError(bucketName, noKeys, func(o *Options) { o.UseWebIdentity = true }); err == nil || err.Error() != "UseWebIdentity requires RoleARN or AWS_ROLE_ARN to be set" {
+		t.Errorf("missing role error mismatch. got: %v", err)
+	}
+
+	// web identity variables select the default credential chain when no keys are set
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/env")
+	t.Setenv("AWS_ROLE_SESSION_NAME", "env-session")
+	d, err := NewDatastoreWithError(bucketName, noKeys)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if p := d.credentialsProvider(); p != nil {
+		t.Errorf("expected default credential chain, got: %T", p)
+	}
+	if p := d.assumeRoleProvider(sess); p != nil {
+		t.Errorf("expected no role provider without UseWebIdentity, got: %T", p)
+	}
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.AccessKey, o.AccessSecret = "key", "secret"
+	})
+	if _, ok := d.credentialsProvider().(*credentials.StaticProvider); !ok {
+		t.Errorf("expected static keys to take precedence over the environment, got: %T", d.credentialsProvider())
+	}
+
+	cases := []struct {
+		roleARN, sessionName string
+		expectRole           string
+		expectSession        string
+	}{
+		{"", "", "arn:aws:iam::123456789012:role/env", "env-session"},
+		{"arn:aws:iam::123456789012:role/ipfs", "ipfs-node", "arn:aws:iam::123456789012:role/ipfs", "ipfs-node"},
+	}
+	for i, c := range cases {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.UseWebIdentity = true
+			o.RoleARN = c.roleARN
+			o.RoleSessionName = c.sessionName
+		})
+		if _, ok := d.assumeRoleProvider(sess).(*stscreds.WebIdentityRoleProvider); !ok {
+			t.Errorf("case %d expected a web identity provider, got: %T", i, d.assumeRoleProvider(sess))
+		}
+		tokenFile, roleARN, sessionName := d.webIdentityRole()
+		if tokenFile != os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") {
+			t.Errorf("case %d token file mismatch. expected: %s, got: %s", i, os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), tokenFile)
+		}
+		if roleARN != c.expectRole {
+			t.Errorf("case %d role mismatch. expected: %s, got: %s", i, c.expectRole, roleARN)
+		}
+		if sessionName != c.expectSession {
+			t.Errorf("case %d session name mismatch. expected: %s, got: %s", i, c.expectSession, sessionName)
+		}
+	}
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	cases := []struct {
+		sse, kmsKeyID string
+		expect        *string
+		expectKeyID   *string
+		err           string
+	}{
+		{"", "", nil, nil, ""},
+		{"AES256", "", aws.String("AES256"), nil, ""},
+		{"aws:kms", "", aws.String("aws:kms"), nil, ""},
+		{"", "key-id", aws.String("aws:kms"), aws.String("key-id"), ""},
+		{"aws:kms", "key-id", aws.String("aws:kms"), aws.String("key-id"), ""},
+		{"ROT13", "", nil, nil, `unsupported server side encryption: "ROT13"`},
+		{"AES256", "key-id", nil, nil, `KMSKeyID requires "aws:kms" server side encryption, got: "AES256"`},
+	}
+
+	for i, c := range cases {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.ServerSideEncryption = c.sse
+			o.KMSKeyID = c.kmsKeyID
+		})
+
+		input, err := d.putObjectInput(ds.NewKey("/a"), []byte("a"))
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if aws.StringValue(input.ServerSideEncryption) != aws.StringValue(c.expect) {
+			t.Errorf("case %d ServerSideEncryption mismatch. expected: %q, got: %q", i, aws.StringValue(c.expect), aws.StringValue(input.ServerSideEncryption))
+		}
+		if aws.StringValue(input.SSEKMSKeyId) != aws.StringValue(c.expectKeyID) {
+			t.Errorf("case %d SSEKMSKeyId mismatch. expected: %q, got: %q", i, aws.StringValue(c.expectKeyID), aws.StringValue(input.SSEKMSKeyId))
+		}
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	cases := []struct {
+		class string
+		err   string
+	}{
+		{"", ""},
+		{"STANDARD_IA", ""},
+		{"INTELLIGENT_TIERING", ""},
+		{"FROZEN", `unsupported storage class: "FROZEN"`},
+	}
+
+	for i, c := range cases {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.StorageClass = c.class
+		})
+
+		input, err := d.putObjectInput(ds.NewKey("/a"), []byte("a"))
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if aws.StringValue(input.StorageClass) != c.class {
+			t.Errorf("case %d StorageClass mismatch. expected: %q, got: %q", i, c.class, aws.StringValue(input.StorageClass))
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	cases := []struct {
+		acl string
+		err string
+	}{
+		{"", ""},
+		{"private", ""},
+		{"public-read", ""},
+		{"world-writable", `unsupported ACL: "world-writable"`},
+	}
+
+	for i, c := range cases {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.ACL = c.acl
+		})
+
+		input, err := d.putObjectInput(ds.NewKey("/a"), []byte("a"))
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if aws.StringValue(input.ACL) != c.acl {
+			t.Errorf("case %d ACL mismatch. expected: %q, got: %q", i, c.acl, aws.StringValue(input.ACL))
+		}
+	}
+
+	// an invalid ACL must fail before any request is made
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.ACL = "world-writable"
+	})
+	if err := d.Put(context.Background(), ds.NewKey("/a"), []byte("a")); err == nil || err.Error() != `unsupported ACL: "world-writable"` {
+		t.Errorf("put with invalid ACL error mismatch: %v", err)
+	}
+	if d.s3 != nil {
+		t.Error("expected put with invalid ACL to error before creating a client")
+	}
+}
+
+func TestContentType(t *testing.T) {
+	detect := func(key ds.Key, value []byte) string {
+		if strings.HasSuffix(key.String(), ".html") {
+			return "text/html"
+		}
+		return ""
+	}
+
+	cases := []struct {
+		contentType string
+		fn          func(ds.Key, []byte) string
+		key         string
+		expect      string
+	}{
+		{"", nil, "/a", ""},
+		{"application/octet-stream", nil, "/a", "application/octet-stream"},
+		{"", detect, "/index.html", "text/html"},
+		{"", detect, "/a", ""},
+		{"application/octet-stream", detect, "/index.html", "text/html"},
+		{"application/octet-stream", detect, "/a", "application/octet-stream"},
+	}
+
+	for i, c := range cases {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.ContentType = c.contentType
+			o.ContentTypeFunc = c.fn
+		})
+
+		input, err := d.putObjectInput(ds.NewKey(c.key), []byte("<html></html>"))
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if aws.StringValue(input.ContentType) != c.expect {
+			t.Errorf("case %d ContentType mismatch. expected: %q, got: %q", i, c.expect, aws.StringValue(input.ContentType))
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newMockDS(func(o *Options) {
+		o.Metadata = map[string]string{"pinned-by": "default", "source": "test"}
+		o.MetadataFunc = func(key ds.Key, value []byte) map[string]string {
+			if key.String() == "/metadata/override" {
+				return map[string]string{"pinned-by": "func"}
+			}
+			return nil
+		}
+	})
+
+	cases := []struct {
+		key    string
+		expect map[string]string
+	}{
+		{"/metadata/default", map[string]string{"pinned-by": "default", "source": "test"}},
+		{"/metadata/override", map[string]string{"pinned-by": "func", "source": "test"}},
+	}
+
+	for i, c := range cases {
+		key := ds.NewKey(c.key)
+		input, err := d.putObjectInput(key, []byte("metadata"))
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if len(input.Metadata) != len(c.expect) {
+			t.Errorf("case %d metadata length mismatch. expected: %d, got: %d", i, len(c.expect), len(input.Metadata))
+		}
+		for k, v := range c.expect {
+			if aws.StringValue(input.Metadata[k]) != v {
+				t.Errorf("case %d metadata %q mismatch. expected: %q, got: %q", i, k, v, aws.StringValue(input.Metadata[k]))
+			}
+		}
+
+		if err := d.Put(ctx, key, []byte("metadata")); err != nil {
+			t.Fatal(err)
+		}
+		got, err := d.GetMetadata(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range c.expect {
+			if got[k] != v {
+				t.Errorf("case %d stored metadata %q mismatch. expected: %q, got: %q", i, k, v, got[k])
+			}
+		}
+	}
+
+	if _, err := d.GetMetadata(ctx, ds.NewKey("/metadata/absent")); err != ds.ErrNotFound {
+		t.Errorf("absent key error mismatch. expected: %s, got: %v", ds.ErrNotFound, err)
+	}
+}
+
+func TestEncodeTags(t *testing.T) {
+	cases := []struct {
+		tags   map[string]string
+		expect string
+		err    string
+	}{
+		{map[string]string{}, "", ""},
+		{map[string]string{"tier": "cold"}, "tier=cold", ""},
+		{map[string]string{"tier": "cold", "owner": "pin service", "path": "a/b+c"}, "owner=pin+service&path=a%2Fb%2Bc&tier=cold", ""},
+		{map[string]string{"": "empty"}, "", `invalid tag key: ""`},
+		{map[string]string{"tier?": "cold"}, "", `invalid tag key: "tier?"`},
+		{map[string]string{"tier": "cold&hot"}, "", `invalid value for tag "tier": "cold&hot"`},
+	}
+
+	for i, c := range cases {
+		got, err := encodeTags(c.tags)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if got != c.expect {
+			t.Errorf("case %d mismatch. expected: %q, got: %q", i, c.expect, got)
+		}
+	}
+
+	d := NewDatastore(bucketName)
+	input, err := d.putObjectInput(ds.NewKey("/a"), []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if input.Tagging != nil {
+		t.Errorf("expected no tagging without tags, got: %q", aws.StringValue(input.Tagging))
+	}
+}
+
+func TestTags(t *testing.T) {
+	ctx := context.Background()
+	tags := map[string]string{"tier": "cold", "owner": "pin service"}
+	d, _ := newMockDS(func(o *Options) {
+		o.Tags = tags
+	})
+
+	key := ds.NewKey("/tags/a")
+	if err := d.Put(ctx, key, []byte("tagged")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.GetTags(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(tags) {
+		t.Errorf("tags length mismatch. expected: %d, got: %d", len(tags), len(got))
+	}
+	for k, v := range tags {
+		if got[k] != v {
+			t.Errorf("tag %q mismatch. expected: %q, got: %q", k, v, got[k])
+		}
+	}
+
+	if _, err := d.GetTags(ctx, ds.NewKey("/tags/absent")); err != ds.ErrNotFound {
+		t.Errorf("absent key error mismatch. expected: %s, got: %v", ds.ErrNotFound, err)
+	}
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
+
+	key := ds.NewKey("/absent/a")
+	written, err := d.PutIfAbsent(ctx, key, []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !written {
+		t.Error("expected first write to an absent key to be written")
+	}
+
+	written, err = d.PutIfAbsent(ctx, key, []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written {
+		t.Error("expected second write to an existing key to be skipped")
+	}
+
+	got, err := d.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "first" {
+		t.Errorf("value mismatch. expected: %q, got: %q", "first", got)
+	}
+
+	// values too large for a conditional write check for the key first
+	defer func(max int64) { maxPutObjectSize = max }(maxPutObjectSize)
+	maxPutObjectSize = 4
+	written, err = d.PutIfAbsent(ctx, key, []byte("third"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written {
+		t.Error("expected large write to an existing key to be skipped")
+	}
+	if string(m.objects[d.path(key)]) != "first" {
+		t.Errorf("stored value mismatch. expected: %q, got: %q", "first", m.objects[d.path(key)])
+	}
+}
+
+func TestGet(t *testing.T) {
+	ctx := context.Background()
+	d := newDS(t)
+	expectErrors(func(key ds.Key) error {
+		_, err := d.Get(ctx, key)
+		return err
+	}, t)
+}
+
+func TestVersioned(t *testing.T) {
+	ctx := context.Background()
+
+	d, m := newMockDS()
+	m.versioned = true
+	key := ds.NewKey("/versioned")
+
+	ids := []string{}
+	for _, v := range []string{"first", "second"} {
+		id, err := d.PutVersioned(ctx, key, []byte(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] != "v1" || ids[1] != "v2" {
+		t.Fatalf("version id mismatch. expected: [v1 v2], got: %v", ids)
+	}
+
+	cases := []struct {
+		versionID string
+		expect    string
+	}{
+		{"v1", "first"},
+		{"v2", "second"},
+		{"", "second"},
+	}
+	for i, c := range cases {
+		got, err := d.GetVersioned(ctx, key, c.versionID)
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if string(got) != c.expect {
+			t.Errorf("case %d value mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+	}
+
+	if _, err := d.GetVersioned(ctx, key, "v3"); err != ds.ErrNotFound {
+		t.Errorf("expected missing version to return ErrNotFound, got: %v", err)
+	}
+}
+
+func TestGetStream(t *testing.T) {
+	ctx := context.Background()
+	d := newDS(t)
+
+	value := bytes.Repeat([]byte("0123456789"), 1<<20)
+	key := ds.NewKey("/stream/get")
+	if err := d.Put(ctx, key, value); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := d.GetStream(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// compare in chunks as the object is read, never holding a second full copy
+	expect := bytes.NewReader(value)
+	got, want := make([]byte, 32*1024), make([]byte, 32*1024)
+	read := 0
+	for {
+		n, err := io.ReadFull(r, got)
+		if n > 0 {
+			if _, err := io.ReadFull(expect, want[:n]); err != nil {
+				t.Fatalf("stream is longer than expected value: %s", err)
+			}
+			if !bytes.Equal(got[:n], want[:n]) {
+				t.Fatalf("stream mismatch at byte %d", read)
+			}
+			read += n
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if read != len(value) {
+		t.Errorf("stream length mismatch. expected: %d, got: %d", len(value), read)
+	}
+
+	if _, err := d.GetStream(ctx, ds.NewKey("/stream/absent")); err != ds.ErrNotFound {
+		t.Errorf("absent key error mismatch. expected: %s, got: %v", ds.ErrNotFound, err)
+	}
+}
+
+func TestHas(t *testing.T) {
+	ctx := context.Background()
+	d := newDS(t)
+	if has, err := d.Has(ctx, ds.NewKey("/z")); has != false || err != nil {
+		t.Errorf("has on empty key result mismatch: %t != false || %s != nil", has, err)
+	}
+}
+
+func TestGetSize(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
+	addTestCases(t, d, map[string]string{
+		"/size/present": "present",
+		"/size/empty":   "",
+	})
+
+	cases := []struct {
+		key  string
+		size int
+		err  error
+	}{
+		{"/size/present", len("present"), nil},
+		{"/size/empty", 0, nil},
+		{"/size/absent", -1, ds.ErrNotFound},
+	}
+
+	for i, c := range cases {
+		m.reads = 0
+		size, err := d.GetSize(ctx, ds.NewKey(c.key))
+		if err != c.err {
+			t.Errorf("case %d error mismatch. expected: %v, got: %v", i, c.err, err)
+			continue
+		}
+		if size != c.size {
+			t.Errorf("case %d size mismatch. expected: %d, got: %d", i, c.size, size)
+		}
+		// sizes are read with a single HeadObject request
+		if m.reads != 1 {
+			t.Errorf("case %d expected a single request, got: %d", i, m.reads)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	skipWithoutS3(t)
+	ctx := context.Background()
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Region = "us-east-1"
+		o.StrictDelete = true
+	})
+	expectErrors(func(key ds.Key) error {
+		return d.Delete(ctx, key)
+	}, t)
+}
+
+func TestStrictDelete(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		strict bool
+		heads  int
+		err    error
+	}{
+		{false, 0, nil},
+		{true, 1, ds.ErrNotFound},
+	}
+
+	for i, c := range cases {
+		d, m := newMockDS(func(o *Options) {
+			o.StrictDelete = c.strict
+		})
+
+		if err := d.Delete(ctx, ds.NewKey("/absent")); err != c.err {
+			t.Errorf("case %d error mismatch. expected: %v, got: %v", i, c.err, err)
+		}
+		if heads := m.requestCount("HeadObject"); heads != c.heads {
+			t.Errorf("case %d HEAD request count mismatch. expected: %d, got: %d", i, c.heads, heads)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]string{"a": "a"}
+	d, m := newMockDS(func(o *Options) {
+		o.ReadOnly = true
+	})
+	m.addObjects(objects)
+	key := ds.NewKey("/a")
+
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := map[string]func() error{
+		"Put": func() error { return d.Put(ctx, key, []byte("b")) },
+		"PutIfAbsent": func() error {
+			_, err := d.PutIfAbsent(ctx, ds.NewKey("/b"), []byte("b"))
+			return err
+		},
+		"PutStream":    func() error { return d.PutStream(ctx, key, strings.NewReader("b")) },
+		"PutMany":      func() error { return d.PutMany(ctx, map[ds.Key][]byte{key: []byte("b")}) },
+		"Delete":       func() error { return d.Delete(ctx, key) },
+		"DeleteMany":   func() error { return d.DeleteMany(ctx, []ds.Key{key}) },
+		"Batch.Put":    func() error { return b.Put(ctx, key, []byte("b")) },
+		"Batch.Delete": func() error { return b.Delete(ctx, key) },
+	}
+	for name, write := range writes {
+		if err := write(); err != ErrReadOnly {
+			t.Errorf("%s error mismatch. expected: %s, got: %v", name, ErrReadOnly, err)
+		}
+	}
+	if len(m.requests) != 0 {
+		t.Errorf("expected read-only writes to make no requests, got: %d", len(m.requests))
+	}
+	if string(m.objects["a"]) != "a" {
+		t.Errorf("expected object to be unchanged, got: %q", m.objects["a"])
+	}
+
+	if v, err := d.Get(ctx, key); err != nil || string(v) != "a" {
+		t.Errorf("get mismatch. expected: a, got: %q, err: %v", v, err)
+	}
+	if has, err := d.Has(ctx, key); err != nil || !has {
+		t.Errorf("has mismatch. expected: true, got: %t, err: %v", has, err)
+	}
+	if size, err := d.GetSize(ctx, key); err != nil || size != 1 {
+		t.Errorf("size mismatch. expected: 1, got: %d, err: %v", size, err)
+	}
+	res, err := d.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/a"}, res)
+}
+
+func TestHardDelete(t *testing.T) {
+	ctx := context.Background()
+
+	type version struct {
+		id     string
+		marker bool
+	}
+	cases := []struct {
+		hard   bool
+		expect []version
+	}{
+		// soft deletes hide earlier versions behind a delete marker
+		{false, []version{{"v1", false}, {"v2", false}, {"m1", true}, {"m2", true}}},
+		{true, []version{}},
+	}
+
+	for i, c := range cases {
+		// the key starts with two versions and a delete marker. "/ab" shares its prefix
+		versions := map[string][]version{
+			"a":  {{"v1", false}, {"v2", false}, {"m1", true}},
+			"ab": {{"v1", false}},
+		}
+		// requests made without accepting charges, which requester-pays buckets reject
+		unpaid := []string{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+bucketName), "/")
+			if r.Header.Get("x-amz-request-payer") != "requester" {
+				unpaid = append(unpaid, r.Method+" "+r.URL.String())
+			}
+			if _, ok := r.URL.Query()["versions"]; path == "" && ok {
+				prefix := r.URL.Query().Get("prefix")
+				keys := []string{}
+				for k := range versions {
+					if strings.HasPrefix(k, prefix) {
+						keys = append(keys, k)
+					}
+				}
+				sort.Strings(keys)
+
+				fmt.Fprint(w, `<ListVersionsResult><IsTruncated>false</IsTruncated>`)
+				for _, k := range keys {
+					for _, v := range versions[k] {
+						tag := "Version"
+						if v.marker {
+							tag = "DeleteMarker"
+						}
+						fmt.Fprintf(w, `<%s><Key>%s</Key><VersionId>%s</VersionId></%s>`, tag, k, v.id, tag)
+					}
+				}
+				fmt.Fprint(w, `</ListVersionsResult>`)
+				return
+			}
+
+			if r.Method != http.MethodDelete {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			id := r.URL.Query().Get("versionId")
+			if id == "" {
+				versions[path] = append(versions[path], version{"m2", true})
+			} else {
+				kept := []version{}
+				for _, v := range versions[path] {
+					if v.id != id {
+						kept = append(kept, v)
+					}
+				}
+				versions[path] = kept
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.Endpoint = srv.URL
+			o.ForcePathStyle = true
+			o.AccessKey = "key"
+			o.AccessSecret = "secret"
+			o.HardDelete = c.hard
+			o.RequesterPays = true
+		})
+		if err := d.Delete(ctx, ds.NewKey("/a")); err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+		}
+		srv.Close()
+
+		if len(unpaid) > 0 {
+			t.Errorf("case %d expected every request to set the request payer, got: %v", i, unpaid)
+		}
+
+		if fmt.Sprint(versions["a"]) != fmt.Sprint(c.expect) {
+			t.Errorf("case %d versions mismatch. expected: %v, got: %v", i, c.expect, versions["a"])
+		}
+		if len(versions["ab"]) != 1 {
+			t.Errorf("case %d expected versions of other keys to be kept, got: %v", i, versions["ab"])
+		}
+	}
+}
+
+func TestHardDeletePaging(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS(func(o *Options) {
+		o.HardDelete = true
+	})
+	// more than a page of longer keys share the deleted key's prefix
+	m.addObjects(map[string]string{"a": "a"})
+	for i := 0; i < 1500; i++ {
+		m.addObjects(map[string]string{fmt.Sprintf("a%04d", i): "b"})
+	}
+
+	if err := d.Delete(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.objects["a"]; ok {
+		t.Errorf("expected /a to be deleted")
+	}
+	if len(m.objects) != 1500 {
+		t.Errorf("expected other keys to be kept. expected: 1500, got: %d", len(m.objects))
+	}
+	if n := m.requestCount("ListObjectVersions"); n != 1 {
+		t.Errorf("expected listing to stop after the deleted key's versions. expected: 1 list, got: %d", n)
+	}
+}
+
+// lockedS3 is a mockS3 that refuses to delete objects, like S3 does for locked objects
+type lockedS3 struct {
+	*mockS3
+}
+
+func (m lockedS3) DeleteObjectWithContext(ctx aws.Context, input *awsS3.DeleteObjectInput, opts ...request.Option) (*awsS3.DeleteObjectOutput, error) {
+	return nil, awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied because object protected by object lock.", nil), http.StatusForbidden, "")
+}
+
+func TestObjectLock(t *testing.T) {
+	until := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		mode  string
+		until time.Time
+		err   string
+	}{
+		{"", time.Time{}, ""},
+		{"GOVERNANCE", until, ""},
+		{"COMPLIANCE", until, ""},
+		{"FOREVER", until, `unsupported object lock mode: "FOREVER"`},
+		{"GOVERNANCE", time.Time{}, "ObjectLockMode requires ObjectLockRetainUntil"},
+		{"", until, "ObjectLockRetainUntil requires ObjectLockMode"},
+	}
+
+	for i, c := range cases {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.ObjectLockMode = c.mode
+			o.ObjectLockRetainUntil = c.until
+		})
+
+		input, err := d.putObjectInput(ds.NewKey("/a"), []byte("a"))
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if aws.StringValue(input.ObjectLockMode) != c.mode {
+			t.Errorf("case %d mode mismatch. expected: %q, got: %q", i, c.mode, aws.StringValue(input.ObjectLockMode))
+		}
+		if !aws.TimeValue(input.ObjectLockRetainUntilDate).Equal(c.until) {
+			t.Errorf("case %d retain until mismatch. expected: %s, got: %s", i, c.until, aws.TimeValue(input.ObjectLockRetainUntilDate))
+		}
+		// locked writes must carry a Content-MD5
+		if (c.mode != "") != (input.ContentMD5 != nil) {
+			t.Errorf("case %d expected Content-MD5 only on locked writes, got: %v", i, input.ContentMD5)
+		}
+	}
+
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.S3API = lockedS3{newMockS3()}
+	})
+	expect := "deleting /a: object is protected by object lock"
+	if err := d.Delete(context.Background(), ds.NewKey("/a")); err == nil || err.Error() != expect {
+		t.Errorf("delete error mismatch. expected: %s, got: %v", expect, err)
+	}
+}
+
+func TestRequesterPays(t *testing.T) {
+	ctx := context.Background()
+	key := ds.NewKey("/a")
+
+	for i, pays := range []bool{false, true} {
+		// the payer is sent as a header, so requests go through the SDK's HTTP layer
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Query().Get("list-type") == "2":
+				fmt.Fprintf(w, `<ListBucketResult><Name>%s</Name><IsTruncated>false</IsTruncated></ListBucketResult>`, bucketName)
+			case r.Method == http.MethodDelete:
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				w.Write([]byte("a"))
+			}
+		}))
+		defer srv.Close()
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.Endpoint = srv.URL
+			o.ForcePathStyle = true
+			o.AccessKey = "key"
+			o.AccessSecret = "secret"
+			o.RequesterPays = pays
+		})
+		headers := map[string]string{}
+		d.S3Client().Handlers.Complete.PushBack(func(r *request.Request) {
+			headers[r.Operation.Name] = r.HTTPRequest.Header.Get("x-amz-request-payer")
+		})
+
+		if err := d.Put(ctx, key, []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Get(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Has(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.ListKeys(ctx, "/"); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := ""
+		if pays {
+			expect = "requester"
+		}
+		for _, op := range []string{"PutObject", "GetObject", "HeadObject", "ListObjectsV2", "DeleteObject"} {
+			got, ok := headers[op]
+			if !ok {
+				t.Errorf("case %d expected a %s request", i, op)
+				continue
+			}
+			if got != expect {
+				t.Errorf("case %d %s request payer mismatch. expected: %q, got: %q", i, op, expect, got)
+			}
+		}
+	}
+}
+
+func TestGetIfModified(t *testing.T) {
+	ctx := context.Background()
+	etag := `"0cc175b9c0f1b6a831c399e269772661"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte("a"))
+	}))
+	defer srv.Close()
+
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Endpoint = srv.URL
+		o.ForcePathStyle = true
+		o.AccessKey = "key"
+		o.AccessSecret = "secret"
+	})
+
+	cases := []struct {
+		etag      string
+		value     string
+		unchanged bool
+	}{
+		{etag, "", true},
+		{`"900150983cd24fb0d6963f7d28e17f72"`, "a", false},
+		{"", "a", false},
+	}
+
+	for i, c := range cases {
+		value, unchanged, err := d.GetIfModified(ctx, ds.NewKey("/a"), c.etag)
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if unchanged != c.unchanged {
+			t.Errorf("case %d unchanged mismatch. expected: %t, got: %t", i, c.unchanged, unchanged)
+		}
+		if string(value) != c.value {
+			t.Errorf("case %d value mismatch. expected: %q, got: %q", i, c.value, value)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newMockDS(func(o *Options) {
+		o.Path = "folder"
+	})
+
+	cases := []struct {
+		src, dst string
+	}{
+		{"/a", "/b"},
+		{"/a/b", "/c/d/e"},
+		// source keys are escaped in CopySource
+		{"/with space/a+b%c", "/copied"},
+	}
+
+	for i, c := range cases {
+		value := []byte("value of " + c.src)
+		if err := d.Put(ctx, ds.NewKey(c.src), value); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Copy(ctx, ds.NewKey(c.src), ds.NewKey(c.dst)); err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		got, err := d.Get(ctx, ds.NewKey(c.dst))
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("case %d value mismatch. expected: %q, got: %q", i, value, got)
+		}
+	}
+
+	if err := d.Copy(ctx, ds.NewKey("/missing"), ds.NewKey("/dst")); err != ds.ErrNotFound {
+		t.Errorf("missing source error mismatch. expected: %s, got: %v", ds.ErrNotFound, err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
+
+	value := []byte("value")
+	if err := d.Put(ctx, ds.NewKey("/src"), value); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move(ctx, ds.NewKey("/src"), ds.NewKey("/dst")); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := d.Has(ctx, ds.NewKey("/src")); err != nil || has {
+		t.Errorf("expected src to be removed, got: %t, %v", has, err)
+	}
+	if got, err := d.Get(ctx, ds.NewKey("/dst")); err != nil || !bytes.Equal(got, value) {
+		t.Errorf("dst value mismatch. expected: %q, got: %q, %v", value, got, err)
+	}
+
+	if err := d.Move(ctx, ds.NewKey("/missing"), ds.NewKey("/other")); err != ds.ErrNotFound {
+		t.Errorf("missing source error mismatch. expected: %s, got: %v", ds.ErrNotFound, err)
+	}
+	if _, ok := m.objects["other"]; ok {
+		t.Error("expected moving a missing key not to write dst")
+	}
+}
+
+func TestPresign(t *testing.T) {
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Region = "us-east-1"
+		o.Endpoint = "http://localhost:9000"
+		o.ForcePathStyle = true
+		o.AccessKey = "key"
+		o.AccessSecret = "secret"
+		o.Path = "folder"
+	})
+
+	presigns := map[string]func(ds.Key, time.Duration) (string, error){
+		"get": d.PresignGet,
+		"put": d.PresignPut,
+	}
+	for name, presign := range presigns {
+		s, err := presign(ds.NewKey("/a/b"), 15*time.Minute)
+		if err != nil {
+			t.Fatalf("presign %s unexpected error: %s", name, err)
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatalf("presign %s invalid URL: %s", name, err)
+		}
+
+		if expect := "/" + bucketName + "/folder/a/b"; u.Path != expect {
+			t.Errorf("presign %s path mismatch. expected: %s, got: %s", name, expect, u.Path)
+		}
+		q := u.Query()
+		if q.Get("X-Amz-Signature") == "" {
+			t.Errorf("presign %s expected a signature, got: %s", name, s)
+		}
+		if !strings.HasPrefix(q.Get("X-Amz-Credential"), "key/") {
+			t.Errorf("presign %s credential mismatch. got: %s", name, q.Get("X-Amz-Credential"))
+		}
+		if q.Get("X-Amz-Expires") != "900" {
+			t.Errorf("presign %s expiry mismatch. expected: 900, got: %s", name, q.Get("X-Amz-Expires"))
+		}
+	}
+
+	if _, err := d.PresignGet(ds.Key{}, time.Minute); err == nil {
+		t.Error("expected presigning an invalid key to error")
+	}
+	d.readOnly = true
+	if _, err := d.PresignPut(ds.NewKey("/a"), time.Minute); err != ErrReadOnly {
+		t.Errorf("read-only presign put error mismatch. expected: %s, got: %v", ErrReadOnly, err)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	cases := []struct {
+		err    error
+		expect bool
+	}{
+		{awserr.New("NoSuchKey", "The specified key does not exist.", nil), true},
+		{awserr.New("NotFound", "Not Found", nil), true},
+		{awserr.New("NoSuchVersion", "The specified version does not exist.", nil), true},
+		{awserr.NewRequestFailure(awserr.New("NoSuchKey", "", nil), http.StatusNotFound, "id"), true},
+		// HEAD requests & some compatible stores 404 without a code
+		{awserr.NewRequestFailure(awserr.New("", "", nil), http.StatusNotFound, "id"), true},
+		{awserr.NewRequestFailure(awserr.New("UnknownError", "", nil), http.StatusNotFound, "id"), true},
+		{awserr.NewRequestFailure(awserr.New("NoSuchBucket", "", nil), http.StatusNotFound, "id"), false},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "", nil), http.StatusInternalServerError, "id"), false},
+		{awserr.New("AccessDenied", "Access Denied", nil), false},
+		{errors.New("NoSuchKey"), false},
+		{nil, false},
+	}
+
+	for i, c := range cases {
+		if got := isNotFound(c.err); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %t, got: %t", i, c.expect, got)
+		}
+	}
+}
+
+func TestNotFoundVariants(t *testing.T) {
+	ctx := context.Background()
+
+	// a store that 404s without an error code
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	for _, strict := range []bool{false, true} {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.Endpoint = srv.URL
+			o.ForcePathStyle = true
+			o.AccessKey = "key"
+			o.AccessSecret = "secret"
+			o.StrictDelete = strict
+		})
+		key := ds.NewKey("/a")
+
+		if _, err := d.Get(ctx, key); err != ds.ErrNotFound {
+			t.Errorf("get error mismatch. expected: %s, got: %v", ds.ErrNotFound, err)
+		}
+		if has, err := d.Has(ctx, key); err != nil || has {
+			t.Errorf("has mismatch. expected: false, got: %t, err: %v", has, err)
+		}
+		var expect error
+		if strict {
+			expect = ds.ErrNotFound
+		}
+		if err := d.Delete(ctx, key); err != expect {
+			t.Errorf("strict: %t delete error mismatch. expected: %v, got: %v", strict, expect, err)
+		}
+	}
+}
+
+func TestCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d := newDS(t)
+
+	if err := d.Put(ctx, ds.NewKey("/canceled"), []byte("canceled")); err != context.Canceled {
+		t.Errorf("put error mismatch. expected: %s, got: %v", context.Canceled, err)
+	}
+	if _, err := d.Get(ctx, ds.NewKey("/a")); err != context.Canceled {
+		t.Errorf("get error mismatch. expected: %s, got: %v", context.Canceled, err)
+	}
+	if _, err := d.Has(ctx, ds.NewKey("/a")); err != context.Canceled {
+		t.Errorf("has error mismatch. expected: %s, got: %v", context.Canceled, err)
+	}
+
+	rs, err := d.Query(ctx, dsq.Query{Prefix: "/a/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a canceled query must close its results without blocking
+	for range rs.Next() {
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS(func(o *Options) {
+		o.Path = "/diskusage"
+		o.DiskUsageCacheTTL = time.Minute
+		o.ListPageSize = 2
+	})
+	addTestCases(t, d, testcases)
+	// objects outside Path aren't counted
+	m.objects["outside"] = []byte("outside")
+
+	var expect uint64
+	for _, v := range testcases {
+		expect += uint64(len(v))
+	}
+
+	size, err := d.DiskUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != expect {
+		t.Errorf("disk usage mismatch. expected: %d, got: %d", expect, size)
+	}
+	if pages := (len(testcases) + 1) / 2; len(m.lists) != pages {
+		t.Errorf("list request count mismatch. expected: %d, got: %d", pages, len(m.lists))
+	}
+
+	// cached usage is returned until the TTL expires
+	if err := d.Put(ctx, ds.NewKey("/g"), []byte("g")); err != nil {
+		t.Fatal(err)
+	}
+	if size, err = d.DiskUsage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if size != expect {
+		t.Errorf("cached disk usage mismatch. expected: %d, got: %d", expect, size)
+	}
+}
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	d := newDS(t)
+	for _, prefix := range []string{"/", "/a/b"} {
+		if err := d.Sync(ctx, ds.NewKey(prefix)); err != nil {
+			t.Errorf("sync %s error: %s", prefix, err)
+		}
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+
+	newGCDS := func(maxAge time.Duration) (*Datastore, *mockS3) {
+		d, m := newMockDS(func(o *Options) {
+			o.GCMaxAge = maxAge
+		})
+		now := time.Now()
+		for k, age := range map[string]time.Duration{"fresh": time.Hour, "old": 48 * time.Hour, "older": 72 * time.Hour} {
+			m.addObjects(map[string]string{k: k})
+			m.modified[k] = now.Add(-age)
+		}
+		return d, m
+	}
+
+	d, m := newGCDS(0)
+	if err := d.CollectGarbage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.requests) != 0 {
+		t.Errorf("expected CollectGarbage without GCMaxAge to make no requests, got: %v", m.requests)
+	}
+
+	d, m = newGCDS(24 * time.Hour)
+	if err := d.CollectGarbage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	remaining := []string{}
+	for k := range m.objects {
+		remaining = append(remaining, k)
+	}
+	if len(remaining) != 1 || remaining[0] != "fresh" {
+		t.Errorf("remaining objects mismatch. expected: [fresh], got: %v", remaining)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		status int
+		expect string
+	}{
+		{http.StatusOK, ""},
+		{http.StatusNotFound, "checking bucket " + bucketName + ": bucket does not exist"},
+		{http.StatusForbidden, "checking bucket " + bucketName + ": access denied, check credentials and bucket permissions"},
+	}
+
+	for i, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodHead || r.URL.Path != "/"+bucketName {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.WriteHeader(c.status)
+		}))
+
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.Endpoint = srv.URL
+			o.ForcePathStyle = true
+			o.AccessKey = "key"
+			o.AccessSecret = "secret"
+			o.MaxRetries = 0
+		})
+		err := d.Check(ctx)
+		srv.Close()
+
+		if c.expect == "" && err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+		} else if c.expect != "" && (err == nil || err.Error() != c.expect) {
+			t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.expect, err)
+		}
+	}
+}
+
+func TestReadReplicas(t *testing.T) {
+	ctx := context.Background()
+
+	var lk sync.Mutex
+	failing := true
+	requests := map[string][]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		defer lk.Unlock()
+
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		bucket, path := parts[0], parts[1]
+		requests[bucket] = append(requests[bucket], r.Method+" "+path)
+
+		switch {
+		case bucket == "primary" && failing:
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<Error><Code>InternalError</Code><Message>injected failure</Message></Error>`)
+		case r.Method == http.MethodPut:
+		case bucket == "replica" && path == "a":
+			w.Write([]byte("a"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+		}
+	}))
+	defer srv.Close()
+
+	d := NewDatastore("primary", func(o *Options) {
+		o.Endpoint = srv.URL
+		o.ForcePathStyle = true
+		o.AccessKey = "key"
+		o.AccessSecret = "secret"
+		o.MaxRetries = 0
+		o.ReadReplicas = []Replica{{Bucket: "missing"}, {Bucket: "replica", Region: "eu-west-1"}}
+	})
+	if region := d.replicas[1].Region; region != "eu-west-1" {
+		t.Errorf("replica region mismatch. expected: eu-west-1, got: %s", region)
+	}
+
+	// replica options are appended to a copy, leaving spare capacity of the caller's
+	// options untouched
+	called := false
+	options := []func(o *Options){func(o *Options) {
+		o.ReadReplicas = []Replica{{Bucket: "replica"}}
+	}, func(o *Options) { called = true }}
+	NewDatastore("primary", options[:1]...)
+	if options[1](&Options{}); !called {
+		t.Error("expected replica options not to overwrite the caller's options")
+	}
+
+	// reads fail over when the primary errors
+	if v, err := d.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "a" {
+		t.Errorf("expected get to read from replica, got: %q, %v", v, err)
+	}
+	if has, err := d.Has(ctx, ds.NewKey("/a")); err != nil || !has {
+		t.Errorf("expected has to read from replica, got: %t, %v", has, err)
+	}
+	if _, err := d.Get(ctx, ds.NewKey("/b")); err == nil || !strings.Contains(err.Error(), "InternalError") {
+		t.Errorf("expected primary error when no replica has the key, got: %v", err)
+	}
+
+	// writes only go to the primary
+	if err := d.Put(ctx, ds.NewKey("/c"), []byte("c")); err == nil {
+		t.Error("expected put to fail with the primary")
+	}
+	lk.Lock()
+	defer lk.Unlock()
+	for _, bucket := range []string{"missing", "replica"} {
+		for _, req := range requests[bucket] {
+			if strings.HasPrefix(req, http.MethodPut) {
+				t.Errorf("expected no writes to %s, got: %s", bucket, req)
+			}
+		}
+	}
+
+	// missing keys don't fail over
+	failing = false
+	requests = map[string][]string{}
+	lk.Unlock()
+	_, err := d.Get(ctx, ds.NewKey("/b"))
+	lk.Lock()
+	if err != ds.ErrNotFound {
+		t.Errorf("missing key error mismatch. expected: %s, got: %v", ds.ErrNotFound, err)
+	}
+	if len(requests["missing"]) != 0 || len(requests["replica"]) != 0 {
+		t.Errorf("expected no replica requests for a missing key, got: %v", requests)
+	}
+}
+
+func TestRequestError(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Request-Id", "REQUESTID")
+		w.Header().Set("X-Amz-Id-2", "HOSTID")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `<Error><Code>InternalError</Code><Message>injected failure</Message></Error>`)
+	}))
+	defer srv.Close()
+
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Endpoint = srv.URL
+		o.ForcePathStyle = true
+		o.AccessKey = "key"
+		o.AccessSecret = "secret"
+		o.MaxRetries = 0
+		o.Path = "folder"
+	})
+
+	_, err := d.Get(ctx, ds.NewKey("/a/b"))
+	reqErr, ok := err.(*RequestError)
+	if !ok {
+		t.Fatalf("expected a RequestError, got: %T %v", err, err)
+	}
+	expect := "s3 GetObject /a/b: InternalError: injected failure (status code: 500, request id: REQUESTID, host id: HOSTID)"
+	if err.Error() != expect {
+		t.Errorf("error message mismatch. expected: %s, got: %s", expect, err)
+	}
+	if reqErr.Op != "GetObject" || reqErr.Key != "/a/b" || reqErr.RequestID() != "REQUESTID" || reqErr.HostID != "HOSTID" {
+		t.Errorf("unexpected error fields: %#v", reqErr)
+	}
+
+	// the SDK error is still available to callers
+	if awsErr, ok := err.(awserr.RequestFailure); !ok || awsErr.Code() != "InternalError" || awsErr.StatusCode() != http.StatusInternalServerError {
+		t.Errorf("expected error to implement awserr.RequestFailure, got: %v", err)
+	}
+	if _, ok := errors.Unwrap(err).(awserr.RequestFailure); !ok {
+		t.Errorf("expected Unwrap to return the SDK error, got: %T", errors.Unwrap(err))
+	}
+
+	// requests that don't act on a key omit it
+	if _, err := d.ListKeys(ctx, "/"); err == nil || !strings.HasPrefix(err.Error(), "s3 ListObjectsV2: InternalError: ") {
+		t.Errorf("unexpected list error: %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		status int
+		expect string
+	}{
+		{http.StatusOK, ""},
+		{http.StatusForbidden, "checking bucket " + bucketName + ": access denied, check credentials and bucket permissions"},
+		{http.StatusNotFound, "checking bucket " + bucketName + ": bucket does not exist"},
+		// unreachable
+		{0, "checking bucket " + bucketName + ": can't reach S3, check Endpoint and network access: "},
+	}
+
+	for i, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.status)
+		}))
+		if c.status == 0 {
+			srv.Close()
+		}
+
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.Endpoint = srv.URL
+			o.ForcePathStyle = true
+			o.AccessKey = "key"
+			o.AccessSecret = "secret"
+			o.MaxRetries = 0
+		})
+		err := d.Ping(ctx)
+		srv.Close()
+
+		if c.expect == "" && err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+		} else if c.expect != "" && (err == nil || !strings.HasPrefix(err.Error(), c.expect)) {
+			t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.expect, err)
+		}
+	}
+}
+
+func TestConcurrentClientInit(t *testing.T) {
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Region = "us-east-1"
+		o.AccessKey = "key"
+		o.AccessSecret = "secret"
+	})
+
+	// the first requests to a new datastore create its client concurrently
+	clients := make(chan s3iface.S3API, 20)
+	wg := sync.WaitGroup{}
+	for i := 0; i < cap(clients); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, _ := d.client()
+			clients <- c
+		}()
+	}
+	wg.Wait()
+	close(clients)
+
+	first := <-clients
+	for c := range clients {
+		if c != first {
+			t.Fatal("expected concurrent requests to share a single client")
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	ctx := context.Background()
+	// closed datastores reject requests in a handler of the SDK client
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("a"))
+	}))
+	defer srv.Close()
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Endpoint = srv.URL
+		o.ForcePathStyle = true
+		o.AccessKey = "key"
+		o.AccessSecret = "secret"
+	})
+	key := ds.NewKey("/a")
+
+	if _, err := d.Get(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Errorf("expected closing twice to be safe, got: %s", err)
+	}
+
+	ops := map[string]func() error{
+		"Put":    func() error { return d.Put(ctx, key, []byte("b")) },
+		"Get":    func() error { _, err := d.Get(ctx, key); return err },
+		"Has":    func() error { _, err := d.Has(ctx, key); return err },
+		"Delete": func() error { return d.Delete(ctx, key) },
+		"Query": func() error {
+			_, err := d.Query(ctx, dsq.Query{KeysOnly: true})
+			return err
+		},
+		"DiskUsage": func() error { _, err := d.DiskUsage(ctx); return err },
+		"Sync":      func() error { return d.Sync(ctx, key) },
+		"Batch":     func() error { _, err := d.Batch(ctx); return err },
+	}
+	for name, op := range ops {
+		if err := op(); err != ErrClosed {
+			t.Errorf("%s after close error mismatch. expected: %s, got: %v", name, ErrClosed, err)
+		}
+	}
+}
+
+// idleCounter is a RoundTripper counting calls to CloseIdleConnections
+type idleCounter struct {
+	http.RoundTripper
+	closes int
+}
+
+func (c *idleCounter) CloseIdleConnections() {
+	c.closes++
+}
+
+func TestCloseSharedClients(t *testing.T) {
+	// clients passed in by callers are left open
+	transport := &idleCounter{RoundTripper: http.DefaultTransport}
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Region = "us-east-1"
+		o.AccessKey = "key"
+		o.AccessSecret = "secret"
+		o.HTTPClient = &http.Client{Transport: transport}
+	})
+	d.client()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if transport.closes != 0 {
+		t.Errorf("expected a caller's HTTP client to be left open, got: %d closes", transport.closes)
+	}
+
+	// only clients of sessions the datastore doesn't share are owned
+	cases := []struct {
+		retryer request.Retryer
+		owned   bool
+	}{
+		{nil, false},
+		{client.DefaultRetryer{NumMaxRetries: 1}, true},
+	}
+	for i, c := range cases {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.Region = "us-east-1"
+			o.AccessKey = "key"
+			o.AccessSecret = "secret"
+			o.InsecureSkipVerify = true
+			o.Retryer = c.retryer
+		})
+		d.client()
+		if owned := d.ownHTTPClient != nil; owned != c.owned {
+			t.Errorf("case %d owned client mismatch. expected: %t, got: %t", i, c.owned, owned)
+		}
+		if d.WithSubPath("sub").ownHTTPClient != nil {
+			t.Errorf("case %d expected sub-stores to leave the parent's client open", i)
+		}
+	}
+}
+
+func TestSuite(t *testing.T) {
+	d, _ := newMockDS()
+	dstest.SubtestAll(t, d)
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	d := newDS(t)
+	addTestCases(t, d, testcases)
+
+	rs, err := d.Query(ctx, dsq.Query{Prefix: "/a/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectMatches(t, []string{
+		"/a/b",
+		"/a/b/c",
+		"/a/b/d",
+		"/a/c",
+		"/a/d",
+	}, rs)
+
+	// test offset and limit
+
+	rs, err = d.Query(ctx, dsq.Query{Prefix: "/a/", Offset: 2, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectMatches(t, []string{
+		"/a/b/d",
+		"/a/c",
+	}, rs)
+
+}
+
+func TestQueryOffsetLimit(t *testing.T) {
+	ctx := context.Background()
+	// pages of two keys put offsets & limits on either side of page boundaries
+	d, _ := newMockDS(func(o *Options) {
+		o.ListPageSize = 2
+	})
+	addTestCases(t, d, testcases)
+
+	// S3 lists keys in lexicographical order, which makes results for a given offset predictable
+	cases := []struct {
+		offset, limit int
+		expect        []string
+	}{
+		{0, 0, []string{"/a/b", "/a/b/c", "/a/b/d", "/a/c", "/a/d"}},
+		{0, 2, []string{"/a/b", "/a/b/c"}},
+		{1, 0, []string{"/a/b/c", "/a/b/d", "/a/c", "/a/d"}},
+		{2, 2, []string{"/a/b/d", "/a/c"}},
+		{1, 3, []string{"/a/b/c", "/a/b/d", "/a/c"}},
+		{3, 1, []string{"/a/c"}},
+		{4, 10, []string{"/a/d"}},
+		{5, 0, []string{}},
+		{10, 2, []string{}},
+	}
+
+	for i, c := range cases {
+		for _, keysOnly := range []bool{true, false} {
+			rs, err := d.Query(ctx, dsq.Query{Prefix: "/a/", Offset: c.offset, Limit: c.limit, KeysOnly: keysOnly})
+			if err != nil {
+				t.Fatalf("case %d (keysOnly: %t) error: %s", i, keysOnly, err)
+			}
+			entries, err := rs.Rest()
+			if err != nil {
+				t.Fatalf("case %d (keysOnly: %t) error: %s", i, keysOnly, err)
+			}
+			if len(entries) != len(c.expect) {
+				t.Errorf("case %d (keysOnly: %t) length mismatch. expected: %d, got: %d", i, keysOnly, len(c.expect), len(entries))
+				continue
+			}
+			for j, e := range entries {
+				if e.Key != c.expect[j] {
+					t.Errorf("case %d (keysOnly: %t) entry %d mismatch. expected: %s, got: %s", i, keysOnly, j, c.expect[j], e.Key)
+				}
+			}
+		}
+	}
+}
+
+func TestQueryFilters(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newMockDS(func(o *Options) {
+		o.ListPageSize = 2
+	})
+	addTestCases(t, d, testcases)
+
+	cases := []struct {
+		filters []dsq.Filter
+		expect  []string
+	}{
+		{[]dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/a/b"}}, []string{"/a/b", "/a/b/c", "/a/b/d"}},
+		{[]dsq.Filter{dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: "/a/b/c"}}, []string{"/a/b/d", "/a/c", "/a/d"}},
+		{[]dsq.Filter{dsq.FilterKeyCompare{Op: dsq.LessThanOrEqual, Key: "/a/b/c"}}, []string{"/a/b", "/a/b/c"}},
+		{[]dsq.Filter{dsq.FilterKeyCompare{Op: dsq.Equal, Key: "/a/c"}}, []string{"/a/c"}},
+		{[]dsq.Filter{
+			dsq.FilterKeyPrefix{Prefix: "/a/b"},
+			dsq.FilterKeyCompare{Op: dsq.NotEqual, Key: "/a/b/c"},
+		}, []string{"/a/b", "/a/b/d"}},
+	}
+
+	for i, c := range cases {
+		for _, keysOnly := range []bool{true, false} {
+			rs, err := d.Query(ctx, dsq.Query{Prefix: "/a/", Filters: c.filters, KeysOnly: keysOnly})
+			if err != nil {
+				t.Fatalf("case %d (keysOnly: %t) error: %s", i, keysOnly, err)
+			}
+			expectMatches(t, c.expect, rs)
+		}
+	}
+
+	// value filters require values, which non-KeysOnly queries fetch
+	rs, err := d.Query(ctx, dsq.Query{Prefix: "/a/", Filters: []dsq.Filter{
+		dsq.FilterValueCompare{Op: dsq.Equal, Value: []byte("abc")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/a/b/c"}, rs)
+
+	// filters apply before offset & limit
+	rs, err = d.Query(ctx, dsq.Query{Prefix: "/a/", Offset: 1, Limit: 1, Filters: []dsq.Filter{
+		dsq.FilterKeyPrefix{Prefix: "/a/b"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/a/b/c"}, rs)
+}
+
+func TestQueryOrders(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newMockDS(func(o *Options) {
+		o.ListPageSize = 2
+	})
+	addTestCases(t, d, testcases)
+
+	cases := []struct {
+		orders        []dsq.Order
+		offset, limit int
+		keysOnly      bool
+		expect        []string
+	}{
+		{[]dsq.Order{dsq.OrderByKey{}}, 0, 0, true, []string{"/a/b", "/a/b/c", "/a/b/d", "/a/c", "/a/d"}},
+		{[]dsq.Order{dsq.OrderByKeyDescending{}}, 0, 0, true, []string{"/a/d", "/a/c", "/a/b/d", "/a/b/c", "/a/b"}},
+		{[]dsq.Order{dsq.OrderByKeyDescending{}}, 0, 0, false, []string{"/a/d", "/a/c", "/a/b/d", "/a/b/c", "/a/b"}},
+		// values: "ab", "abc", "a/b/d", "ac", "ad"
+		{[]dsq.Order{dsq.OrderByValue{}}, 0, 0, false, []string{"/a/b/d", "/a/b", "/a/b/c", "/a/c", "/a/d"}},
+		{[]dsq.Order{dsq.OrderByValueDescending{}}, 0, 0, false, []string{"/a/d", "/a/c", "/a/b/c", "/a/b", "/a/b/d"}},
+		// order is applied before offset & limit
+		{[]dsq.Order{dsq.OrderByKeyDescending{}}, 1, 2, true, []string{"/a/c", "/a/b/d"}},
+		{[]dsq.Order{dsq.OrderByKeyDescending{}}, 10, 0, true, []string{}},
+	}
+
+	for i, c := range cases {
+		rs, err := d.Query(ctx, dsq.Query{Prefix: "/a/", Orders: c.orders, Offset: c.offset, Limit: c.limit, KeysOnly: c.keysOnly})
+		if err != nil {
+			t.Fatalf("case %d error: %s", i, err)
+		}
+		expectOrderedMatches(t, c.expect, rs)
+	}
+}
+
+func TestQueryConcurrency(t *testing.T) {
+	ctx := context.Background()
+
+	objects := map[string]string{}
+	expect := []string{}
+	for i := 0; i < 50; i++ {
+		objects[fmt.Sprintf("concurrent/%02d", i)] = fmt.Sprintf("%d", i)
+		expect = append(expect, fmt.Sprintf("/concurrent/%02d", i))
+	}
+
+	d, m := newMockDS(func(o *Options) {
+		o.QueryConcurrency = 4
+	})
+	m.addObjects(objects)
+	rs, err := d.Query(ctx, dsq.Query{Prefix: "/concurrent/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// concurrently fetched entries still arrive in listing order
+	expectOrderedMatches(t, expect, rs)
+
+	// a failed fetch is reported in place, without ending the query
+	d, m = newMockDS(func(o *Options) {
+		o.QueryConcurrency = 4
+	})
+	m.addObjects(objects)
+	m.fail = map[string]bool{"concurrent/10": true}
+	rs, err = d.Query(ctx, dsq.Query{Prefix: "/concurrent/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []dsq.Result{}
+	for r := range rs.Next() {
+		got = append(got, r)
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("expected a result for every key, got %d results", len(got))
+	}
+	for i, r := range got {
+		if r.Key != expect[i] {
+			t.Errorf("result %d key mismatch. expected: %s, got: %s", i, expect[i], r.Key)
+		}
+		if failed := i == 10; failed != (r.Error != nil) {
+			t.Errorf("result %d error mismatch. expected error: %t, got: %v", i, failed, r.Error)
+		}
+		if r.Error == nil && string(r.Value) != objects[strings.TrimPrefix(r.Key, "/")] {
+			t.Errorf("result %d value mismatch. got: %s", i, r.Value)
+		}
+	}
+
+	// sorted queries deliver failed fetches ahead of the sorted entries
+	rs, err = d.Query(ctx, dsq.Query{Prefix: "/concurrent/", Orders: []dsq.Order{dsq.OrderByKeyDescending{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = got[:0]
+	for r := range rs.Next() {
+		got = append(got, r)
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("expected a result for every sorted key, got %d results", len(got))
+	}
+	if got[0].Key != expect[10] || got[0].Error == nil {
+		t.Errorf("expected the failed fetch first. expected: %s, got: %s, %v", expect[10], got[0].Key, got[0].Error)
+	}
+	for i, r := range got[1:] {
+		j := len(expect) - 1 - i
+		if j <= 10 {
+			j--
+		}
+		if r.Key != expect[j] || r.Error != nil {
+			t.Errorf("sorted result %d mismatch. expected: %s, got: %s, %v", i, expect[j], r.Key, r.Error)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	ctx := context.Background()
+
+	lines := []string{}
+	d, m := newMockDS(func(o *Options) {
+		o.Logger = func(format string, args ...interface{}) {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}
+	})
+	m.addObjects(map[string]string{"a": "a"})
+
+	if _, err := d.Get(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ctx, ds.NewKey("/b")); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got: %v", err)
+	}
+	if _, err := d.PutVersioned(ctx, ds.NewKey("/c"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 log lines, got: %d. %v", len(lines), lines)
+	}
+	if !strings.HasPrefix(lines[0], "s3 Get /a took ") || !strings.HasSuffix(lines[0], "error: <nil>") {
+		t.Errorf("unexpected log line for successful get: %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "s3 Get /b took ") || !strings.HasSuffix(lines[1], "error: "+ds.ErrNotFound.Error()) {
+		t.Errorf("unexpected log line for failed get: %s", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "s3 PutVersioned /c took ") || !strings.HasSuffix(lines[2], "error: <nil>") {
+		t.Errorf("unexpected log line for versioned put: %s", lines[2])
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+
+	lines := []string{}
+	objects := map[string]string{"a": "a", "b": "b", "c": "c"}
+	d, m := newMockDS(func(o *Options) {
+		o.DryRun = true
+		o.Logger = func(format string, args ...interface{}) {
+			if line := fmt.Sprintf(format, args...); strings.HasPrefix(line, "s3 dry run ") {
+				lines = append(lines, line)
+			}
+		}
+	})
+	m.addObjects(objects)
+
+	if err := d.Put(ctx, ds.NewKey("/d"), []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Copy(ctx, ds.NewKey("/b"), ds.NewKey("/e")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteMany(ctx, []ds.Key{ds.NewKey("/b"), ds.NewKey("/c")}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, ds.NewKey("/c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.requests) != 0 {
+		t.Errorf("expected dry run mutations to make no requests, got: %v", m.requests)
+	}
+	expect := []string{
+		"s3 dry run Put /d",
+		"s3 dry run Delete /a",
+		"s3 dry run Copy /b /e",
+		"s3 dry run Delete /b",
+		"s3 dry run Delete /c",
+		"s3 dry run Delete /c",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("log mismatch. expected: %v, got: %v", expect, lines)
+	}
+	if len(m.objects) != 3 || string(m.objects["a"]) != "a" {
+		t.Errorf("expected objects to be unchanged, got: %v", m.objects)
+	}
+
+	// reads still reach S3
+	if v, err := d.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "a" {
+		t.Errorf("expected dry run reads to succeed, got: %q, %v", v, err)
+	}
+	if len(m.requests) != 1 || m.requests[0] != "GetObject" {
+		t.Errorf("expected a single GetObject request, got: %v", m.requests)
+	}
+}
+
+type observation struct {
+	op  string
+	err error
+}
+
+type recordingObserver struct {
+	ops []observation
+}
+
+func (o *recordingObserver) ObserveOp(op string, dur time.Duration, err error) {
+	o.ops = append(o.ops, observation{op, err})
+}
+
+func TestObserver(t *testing.T) {
+	ctx := context.Background()
+
+	// operations are observed by a handler of the SDK client
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + bucketName + "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<Error><Code>InternalError</Code><Message>injected failure</Message></Error>`)
+		case "/" + bucketName + "/b":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+		default:
+			w.Write([]byte("a"))
+		}
+	}))
+	defer srv.Close()
+
+	o := &recordingObserver{}
+	d := NewDatastore(bucketName, func(opts *Options) {
+		opts.Endpoint = srv.URL
+		opts.ForcePathStyle = true
+		opts.AccessKey = "key"
+		opts.AccessSecret = "secret"
+		opts.MaxRetries = 0
+		opts.Observer = o
+	})
+
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, ds.NewKey("/fail"), []byte("a")); err == nil {
+		t.Fatal("expected put to fail")
+	}
+	if _, err := d.Get(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ctx, ds.NewKey("/b")); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got: %v", err)
+	}
+
+	expect := []observation{
+		{"PutObject", nil},
+		{"PutObject", errors.New("InternalError")},
+		{"GetObject", nil},
+		{"GetObject", errors.New("NoSuchKey")},
+	}
+	if len(o.ops) != len(expect) {
+		t.Fatalf("observation count mismatch. expected: %d, got: %d", len(expect), len(o.ops))
+	}
+	for i, e := range expect {
+		got := o.ops[i]
+		if got.op != e.op {
+			t.Errorf("case %d op mismatch. expected: %s, got: %s", i, e.op, got.op)
+		}
+		if e.err == nil && got.err != nil {
+			t.Errorf("case %d error mismatch. expected: nil, got: %v", i, got.err)
+		} else if e.err != nil && (got.err == nil || !strings.Contains(got.err.Error(), e.err.Error())) {
+			t.Errorf("case %d error mismatch. expected: %s, got: %v", i, e.err, got.err)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	cases := []struct {
+		path   string
+		key    string
+		expect string
+		prefix string
+	}{
+		{"folder", "/a", "folder/a", "folder/"},
+		{"folder/", "/a/b", "folder/a/b", "folder/"},
+		{"/folder", "/a", "folder/a", "folder/"},
+		{"/folder/sub/", "/a", "folder/sub/a", "folder/sub/"},
+		{"", "/a", "a", ""},
+		{"", "/a/b", "a/b", ""},
+	}
+
+	for i, c := range cases {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.Path = c.path
+		})
+		got := d.path(ds.NewKey(c.key))
+		if got != c.expect {
+			t.Errorf("case %d path mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+		if key := d.key(got); key.String() != c.key {
+			t.Errorf("case %d key mismatch. expected: %s, got: %s", i, c.key, key)
+		}
+		if prefix := d.stringPath("/"); prefix != c.prefix {
+			t.Errorf("case %d prefix mismatch. expected: %s, got: %s", i, c.prefix, prefix)
+		}
+	}
+}
+
+func TestKeySuffix(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		suffix string
+		shard  bool
+		key    string
+		expect string
+	}{
+		{"", false, "/a/b", "folder/a/b"},
+		{".bin", false, "/a/b", "folder/a/b.bin"},
+		{".bin", false, "/a.bin", "folder/a.bin.bin"},
+		{".bin", true, "/CIQABC", "folder/AB/CIQABC.bin"},
+	}
+
+	for i, c := range cases {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.Path = "folder"
+			o.KeySuffix = c.suffix
+			if c.shard {
+				o.ShardFunc = ShardNextToLast(2)
+			}
+		})
+		got := d.path(ds.NewKey(c.key))
+		if got != c.expect {
+			t.Errorf("case %d path mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+		if key := d.key(got); key.String() != c.key {
+			t.Errorf("case %d key mismatch. expected: %s, got: %s", i, c.key, key)
+		}
+	}
+
+	for _, suffix := range []string{"", ".bin"} {
+		d, m := newMockDS(func(o *Options) {
+			o.KeySuffix = suffix
+		})
+		for k, v := range testcases {
+			if err := d.Put(ctx, ds.NewKey(k), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, ok := m.objects["a/b/c"+suffix]; !ok {
+			t.Errorf("suffix %q: expected object at a/b/c%s", suffix, suffix)
+		}
+		if v, err := d.Get(ctx, ds.NewKey("/a/b/c")); err != nil || string(v) != testcases["/a/b/c"] {
+			t.Errorf("suffix %q: get mismatch. expected: %q, got: %q, %v", suffix, testcases["/a/b/c"], v, err)
+		}
+
+		res, err := d.Query(ctx, dsq.Query{Prefix: "/a/b/", KeysOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectMatches(t, []string{"/a/b/c", "/a/b/d"}, res)
+	}
+
+	// prefixes are matched against keys without their suffix. "/a" is stored at "a.bin",
+	// which S3 lists for a prefix of "/a.b"
+	for _, shard := range []bool{false, true} {
+		d, _ := newMockDS(func(o *Options) {
+			o.KeySuffix = ".bin"
+			if shard {
+				o.ShardFunc = ShardSuffix(1)
+			}
+		})
+		for _, k := range []string{"/a", "/a/b", "/a/b/c"} {
+			if err := d.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		keys, err := d.ListKeys(ctx, "/a.b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 0 {
+			t.Errorf("shard %t: expected no keys under /a.b, got: %v", shard, keys)
+		}
+		if has, err := d.HasPrefix(ctx, "/a.b"); err != nil || has {
+			t.Errorf("shard %t: expected no keys under /a.b, got: %t, %v", shard, has, err)
+		}
+		if n, err := d.CountPrefix(ctx, "/a/b."); err != nil || n != 0 {
+			t.Errorf("shard %t: count mismatch. expected: 0, got: %d, %v", shard, n, err)
+		}
+		if _, n, err := d.UsageForPrefix(ctx, "/a/b."); err != nil || n != 0 {
+			t.Errorf("shard %t: usage count mismatch. expected: 0, got: %d, %v", shard, n, err)
+		}
+		if n, err := d.CountPrefix(ctx, "/a/b"); err != nil || n != 2 {
+			t.Errorf("shard %t: count mismatch. expected: 2, got: %d, %v", shard, n, err)
+		}
+
+		res, err := d.Query(ctx, dsq.Query{Prefix: "/a/b", KeysOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectMatches(t, []string{"/a/b/c"}, res)
+	}
+
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Region = "us-east-1"
+		o.KeySuffix = "/bin"
+	})
+	expect := `KeySuffix can't contain slashes, got: "/bin"`
+	if err := d.configError(); err == nil || err.Error() != expect {
+		t.Errorf("config error mismatch. expected: %s, got: %v", expect, err)
+	}
+}
+
+func TestWithSubPath(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		path   string
+		sub    string
+		expect string
+	}{
+		{"", "sub", "sub/a"},
+		{"", "/sub/", "sub/a"},
+		{"folder", "sub", "folder/sub/a"},
+		{"/folder/", "/sub/", "folder/sub/a"},
+		{"folder", "sub/deeper", "folder/sub/deeper/a"},
+		{"folder", "", "folder/a"},
+	}
+
+	for i, c := range cases {
+		d, m := newMockDS(func(o *Options) {
+			o.Path = c.path
+		})
+		sub := d.WithSubPath(c.sub)
+		subClient, _ := sub.client()
+		if parentClient, _ := d.client(); subClient != parentClient {
+			t.Errorf("case %d expected sub-store to share the parent's client", i)
+		}
+
+		if err := sub.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if _, ok := m.objects[c.expect]; !ok {
+			t.Errorf("case %d expected object at %s, got: %v", i, c.expect, m.objects)
+		}
+		keys, err := sub.ListKeys(ctx, "/")
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if len(keys) != 1 || keys[0].String() != "/a" {
+			t.Errorf("case %d keys mismatch. expected: [/a], got: %v", i, keys)
+		}
+	}
+
+	// closing a sub-store leaves its parent open. Closed stores reject requests in the SDK's
+	// handlers, so this runs against an HTTP server
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Endpoint = srv.URL
+		o.ForcePathStyle = true
+		o.AccessKey = "key"
+		o.AccessSecret = "secret"
+	})
+	sub := d.WithSubPath("sub")
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Put(ctx, ds.NewKey("/a"), []byte("a")); err != ErrClosed {
+		t.Errorf("closed sub-store put error mismatch. expected: %s, got: %v", ErrClosed, err)
+	}
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Errorf("parent put unexpected error: %s", err)
+	}
+
+	// closing a parent closes its sub-stores, including ones created after it's closed
+	sub = d.WithSubPath("sub")
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range []*Datastore{sub, d.WithSubPath("sub"), sub.WithSubPath("deeper")} {
+		if err := s.Put(ctx, ds.NewKey("/a"), []byte("a")); err != ErrClosed {
+			t.Errorf("case %d sub-store of closed parent put error mismatch. expected: %s, got: %v", i, ErrClosed, err)
+		}
+	}
+}
+
+func TestS3Client(t *testing.T) {
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/"+bucketName+"/")
+		if r.Method == http.MethodPut {
+			objects[path], _ = ioutil.ReadAll(r.Body)
+			return
+		}
+		w.Write(objects[path])
+	}))
+	defer srv.Close()
+
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Endpoint = srv.URL
+		o.ForcePathStyle = true
+		o.AccessKey = "key"
+		o.AccessSecret = "secret"
+	})
+	c := d.S3Client()
+	if c == nil {
+		t.Fatal("expected a client")
+	}
+	if d.S3Client() != c {
+		t.Error("expected S3Client to return the same client on every call")
+	}
+
+	ctx := context.Background()
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.GetObjectWithContext(ctx, &awsS3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String("a"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer res.Body.Close()
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "a" {
+		t.Errorf("body mismatch. expected: a, got: %s", body)
+	}
+}
+
+func TestS3API(t *testing.T) {
+	ctx := context.Background()
+	m := newMockS3()
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Path = "folder"
+		o.S3API = m
+	})
+
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if v := string(m.objects["folder/a"]); v != "a" {
+		t.Errorf("stored value mismatch. expected: a, got: %q", v)
+	}
+	v, err := d.Get(ctx, ds.NewKey("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "a" {
+		t.Errorf("value mismatch. expected: a, got: %q", v)
+	}
+	if _, err := d.Get(ctx, ds.NewKey("/missing")); err != ds.ErrNotFound {
+		t.Errorf("missing key error mismatch. expected: %s, got: %v", ds.ErrNotFound, err)
+	}
+
+	if d.S3Client() != nil {
+		t.Error("expected S3Client to be nil for an S3API that isn't an *s3.S3")
+	}
+}
+
+func TestMockedOps(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS(func(o *Options) {
+		o.ListPageSize = 2
+	})
+
+	for k, v := range testcases {
+		if err := d.Put(ctx, ds.NewKey(k), []byte(v)); err != nil {
+			t.Fatalf("putting %s: %s", k, err)
+		}
+	}
+	if len(m.objects) != len(testcases) {
+		t.Errorf("object count mismatch. expected: %d, got: %d", len(testcases), len(m.objects))
+	}
+
+	for k, v := range testcases {
+		got, err := d.Get(ctx, ds.NewKey(k))
+		if err != nil {
+			t.Fatalf("getting %s: %s", k, err)
+		}
+		if string(got) != v {
+			t.Errorf("value mismatch for %s. expected: %s, got: %s", k, v, got)
+		}
+		if has, err := d.Has(ctx, ds.NewKey(k)); err != nil || !has {
+			t.Errorf("expected %s to exist, got: %t, %v", k, has, err)
+		}
+	}
+
+	// a page size of 2 makes the query page through listings
+	res, err := d.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(testcases) {
+		t.Errorf("query result count mismatch. expected: %d, got: %d", len(testcases), len(entries))
+	}
+	for _, e := range entries {
+		if v, ok := testcases[e.Key]; !ok || string(e.Value) != v {
+			t.Errorf("unexpected query result %s: %s", e.Key, e.Value)
+		}
+	}
+
+	if err := d.Delete(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := d.Has(ctx, ds.NewKey("/a")); err != nil || has {
+		t.Errorf("expected /a to be deleted, got: %t, %v", has, err)
+	}
+	if _, err := d.Get(ctx, ds.NewKey("/a")); err != ds.ErrNotFound {
+		t.Errorf("get deleted key error mismatch. expected: %s, got: %v", ds.ErrNotFound, err)
+	}
+}
+
+func TestDelimiter(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newMockDS(func(o *Options) {
+		o.Path = "folder"
+		o.Delimiter = "/"
+		o.ListPageSize = 2
+	})
+	for k, v := range testcases {
+		if err := d.Put(ctx, ds.NewKey(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		prefix   string
+		keys     string
+		prefixes string
+	}{
+		{"/", "[/a /e /f]", "[/a/]"},
+		{"/a/", "[/a/b /a/c /a/d]", "[/a/b/]"},
+		{"/a/b/", "[/a/b/c /a/b/d]", "[]"},
+		{"/e/", "[]", "[]"},
+	}
+
+	for i, c := range cases {
+		keys, err := d.ListKeys(ctx, c.prefix)
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if got := fmt.Sprint(keys); got != c.keys {
+			t.Errorf("case %d keys mismatch. expected: %s, got: %s", i, c.keys, got)
+		}
+
+		res, err := d.Query(ctx, dsq.Query{Prefix: c.prefix, KeysOnly: true})
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		queried := []string{}
+		for _, e := range entries {
+			queried = append(queried, e.Key)
+		}
+		if got := fmt.Sprint(queried); got != c.keys {
+			t.Errorf("case %d query keys mismatch. expected: %s, got: %s", i, c.keys, got)
+		}
+
+		prefixes, err := d.CommonPrefixes(ctx, c.prefix)
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if got := fmt.Sprint(prefixes); got != c.prefixes {
+			t.Errorf("case %d prefixes mismatch. expected: %s, got: %s", i, c.prefixes, got)
+		}
+	}
+
+	plain, _ := newMockDS()
+	if _, err := plain.CommonPrefixes(ctx, "/"); err == nil {
+		t.Error("expected CommonPrefixes without a Delimiter to error")
+	}
+
+	_, err := NewDatastoreWithError(bucketName, func(o *Options) {
+		o.Region = "us-east-1"
+		o.AccessKey = "key"
+		o.AccessSecret = "secret"
+		o.Delimiter = "/"
+		o.ShardFunc = ShardSuffix(2)
+	})
+	if err == nil {
+		t.Error("expected Delimiter with ShardFunc to error")
+	}
+}
+
+func TestUsageForPrefix(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		prefix string
+		size   uint64
+		count  int
+	}{
+		{"/", 36, 7},
+		{"/tenant-a", 30, 5},
+		{"/tenant-a/", 30, 5},
+		{"/tenant-a/logs", 20, 2},
+		{"/tenant-b", 6, 2},
+		{"/tenant-c", 0, 0},
+	}
+
+	for _, shard := range []bool{false, true} {
+		d, m := newMockDS(func(o *Options) {
+			o.Path = "folder"
+			// span several list pages
+			o.ListPageSize = 2
+			if shard {
+				o.ShardFunc = ShardSuffix(2)
+			}
+		})
+		objects := map[string]int{
+			"/tenant-a/a":        1,
+			"/tenant-a/b":        2,
+			"/tenant-a/c":        7,
+			"/tenant-a/logs/one": 10,
+			"/tenant-a/logs/two": 10,
+			"/tenant-b/a":        3,
+			"/tenant-b/b":        3,
+		}
+		for k, size := range objects {
+			if err := d.Put(ctx, ds.NewKey(k), bytes.Repeat([]byte("x"), size)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i, c := range cases {
+			m.lists = nil
+			size, count, err := d.UsageForPrefix(ctx, c.prefix)
+			if err != nil {
+				t.Fatalf("case %d unexpected error: %s", i, err)
+			}
+			if size != c.size || count != c.count {
+				t.Errorf("case %d sharded: %t usage mismatch. expected: %d bytes in %d objects, got: %d in %d", i, shard, c.size, c.count, size, count)
+			}
+			for _, l := range m.lists {
+				if aws.Int64Value(l.MaxKeys) != 2 {
+					t.Errorf("case %d expected list page size 2, got: %d", i, aws.Int64Value(l.MaxKeys))
+				}
+			}
+		}
+	}
+}
+
+func TestCountPrefix(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		prefix string
+		count  int
+	}{
+		{"/", len(testcases)},
+		{"/a", 6},
+		{"/a/b", 3},
+		{"/e", 1},
+		{"/g", 0},
+		{"/a/z", 0},
+	}
+
+	for _, shard := range []bool{false, true} {
+		d, m := newMockDS(func(o *Options) {
+			o.Path = "folder"
+			if shard {
+				o.ShardFunc = ShardSuffix(2)
+			}
+		})
+		for k, v := range testcases {
+			if err := d.Put(ctx, ds.NewKey(k), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i, c := range cases {
+			count, err := d.CountPrefix(ctx, c.prefix)
+			if err != nil {
+				t.Fatalf("case %d unexpected error: %s", i, err)
+			}
+			if count != c.count {
+				t.Errorf("case %d sharded: %t count mismatch. expected: %d, got: %d", i, shard, c.count, count)
+			}
+
+			m.lists = nil
+			has, err := d.HasPrefix(ctx, c.prefix)
+			if err != nil {
+				t.Fatalf("case %d unexpected error: %s", i, err)
+			}
+			if has != (c.count > 0) {
+				t.Errorf("case %d sharded: %t has mismatch. expected: %t, got: %t", i, shard, c.count > 0, has)
+			}
+			if !shard && (len(m.lists) != 1 || aws.Int64Value(m.lists[0].MaxKeys) != 1) {
+				t.Errorf("case %d expected HasPrefix to list a single key", i)
+			}
+		}
+	}
+}
+
+func TestQuerySizes(t *testing.T) {
+	ctx := context.Background()
+	queries := []dsq.Query{
+		{},
+		{KeysOnly: true},
+		{Orders: []dsq.Order{dsq.OrderByKeyDescending{}}},
+		{KeysOnly: true, Orders: []dsq.Order{dsq.OrderByKeyDescending{}}},
+	}
+
+	stores := []struct {
+		name string
+		opt  func(o *Options)
+	}{
+		{"plain", func(o *Options) {}},
+		{"compressed", func(o *Options) { o.Compression = "gzip" }},
+		{"inline", func(o *Options) { o.InlineSmallValues = 16 }},
+	}
+	for _, s := range stores {
+		d, _ := newMockDS(s.opt)
+		for k, v := range testcases {
+			if err := d.Put(ctx, ds.NewKey(k), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i, q := range queries {
+			res, err := d.Query(ctx, q)
+			if err != nil {
+				t.Fatalf("%s case %d unexpected error: %s", s.name, i, err)
+			}
+			entries, err := res.Rest()
+			if err != nil {
+				t.Fatalf("%s case %d unexpected error: %s", s.name, i, err)
+			}
+			if len(entries) != len(testcases) {
+				t.Errorf("%s case %d result count mismatch. expected: %d, got: %d", s.name, i, len(testcases), len(entries))
+			}
+			// KeysOnly entries are sized by their stored objects
+			if q.KeysOnly && s.name != "plain" {
+				continue
+			}
+			for _, e := range entries {
+				if expect := len(testcases[e.Key]); e.Size != expect {
+					t.Errorf("%s case %d size mismatch for %s. expected: %d, got: %d", s.name, i, e.Key, expect, e.Size)
+				}
+			}
+		}
+	}
+}
+
+func TestQueryReturnsSizes(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
 	for k, v := range testcases {
-		dsk := ds.NewKey(k)
-		if err := d.Put(dsk, []byte(v)); err != nil {
+		if err := d.Put(ctx, ds.NewKey(k), []byte(v)); err != nil {
 			t.Fatal(err)
 		}
 	}
 
+	res, err := d.Query(ctx, dsq.Query{KeysOnly: true, ReturnsSizes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.reads != 0 {
+		t.Errorf("expected a size-only query to read no objects, got: %d reads", m.reads)
+	}
+	if len(entries) != len(testcases) {
+		t.Errorf("result count mismatch. expected: %d, got: %d", len(testcases), len(entries))
+	}
+	for _, e := range entries {
+		if expect := len(testcases[e.Key]); e.Size != expect {
+			t.Errorf("size mismatch for %s. expected: %d, got: %d", e.Key, expect, e.Size)
+		}
+		if e.Value != nil {
+			t.Errorf("expected no value for %s, got: %q", e.Key, e.Value)
+		}
+	}
+}
+
+func TestQueryEmpty(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newMockDS()
 	for k, v := range testcases {
-		dsk := ds.NewKey(k)
-		v2, err := d.Get(dsk)
-		if err != nil {
+		if err := d.Put(ctx, ds.NewKey(k), []byte(v)); err != nil {
 			t.Fatal(err)
 		}
-		if v2b, ok := v2.([]byte); ok {
-			if string(v2b) != v {
-				t.Errorf("%s values differ: '%s' != '%s'", k, v, v2b)
+	}
+
+	queries := []dsq.Query{
+		{Prefix: "/nothing"},
+		{Prefix: "/nothing", KeysOnly: true},
+		{Prefix: "/nothing", Orders: []dsq.Order{dsq.OrderByKeyDescending{}}},
+	}
+	for i, q := range queries {
+		res, err := d.Query(ctx, q)
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if res == nil {
+			t.Fatalf("case %d expected results, got nil", i)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("case %d expected no entries, got: %v", i, entries)
+		}
+	}
+}
+
+func TestSessionCache(t *testing.T) {
+	options := func(region string) func(o *Options) {
+		return func(o *Options) {
+			o.Region = region
+			o.AccessKey = "cache-key"
+			o.AccessSecret = "cache-secret"
+			o.InsecureSkipVerify = true
+		}
+	}
+
+	a := NewDatastore(bucketName, options("us-east-1"))
+	b := NewDatastore("other-bucket", options("us-east-1"))
+	c := NewDatastore(bucketName, options("eu-west-1"))
+
+	// sessions carry credentials & the HTTP client, which are shared with clients
+	if a.S3Client().Config.Credentials != b.S3Client().Config.Credentials {
+		t.Error("expected datastores with identical options to share credentials")
+	}
+	if a.S3Client().Config.HTTPClient != b.S3Client().Config.HTTPClient {
+		t.Error("expected datastores with identical options to share an HTTP client")
+	}
+	if a.S3Client().Config.Credentials == c.S3Client().Config.Credentials {
+		t.Error("expected datastores in different regions not to share a session")
+	}
+
+	// a retryer opts out of sharing
+	d := NewDatastore(bucketName, options("us-east-1"), func(o *Options) {
+		o.Retryer = client.DefaultRetryer{NumMaxRetries: 1}
+	})
+	if a.S3Client().Config.Credentials == d.S3Client().Config.Credentials {
+		t.Error("expected a datastore with a Retryer not to share a session")
+	}
+
+	// session tokens expire, so sessions using them aren't cached
+	sessions.Lock()
+	cached := len(sessions.m)
+	sessions.Unlock()
+	token := func(o *Options) { o.AccessToken = "cache-token" }
+	e := NewDatastore(bucketName, options("us-east-1"), token)
+	f := NewDatastore(bucketName, options("us-east-1"), token)
+	if e.S3Client().Config.Credentials == f.S3Client().Config.Credentials {
+		t.Error("expected datastores with an AccessToken not to share a session")
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	if len(sessions.m) != cached {
+		t.Errorf("expected sessions with an AccessToken not to be cached. expected: %d, got: %d", cached, len(sessions.m))
+	}
+	for key := range sessions.m {
+		if strings.Contains(fmt.Sprintf("%v", key), "cache-secret") {
+			t.Errorf("expected cached session keys not to hold secrets, got: %v", key)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-central-1"),
+		Credentials: credentials.NewStaticCredentials("key", "secret", ""),
+	}))
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Session = sess
+	})
+
+	// the session's configuration replaces the default region
+	if region := aws.StringValue(d.S3Client().Config.Region); region != "eu-central-1" {
+		t.Errorf("region mismatch. expected: eu-central-1, got: %s", region)
+	}
+	creds, err := d.S3Client().Config.Credentials.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "key" {
+		t.Errorf("access key mismatch. expected: key, got: %s", creds.AccessKeyID)
+	}
+}
+
+func TestPathQuery(t *testing.T) {
+	ctx := context.Background()
+
+	// objects outside the path sharing its prefix must not be listed
+	objects := map[string]string{"folder/a": "a", "folder/b/c": "c", "foldera": "x"}
+	for i, path := range []string{"folder", "folder/", "/folder"} {
+		d, m := newMockDS(func(o *Options) {
+			o.Path = path
+		})
+		m.addObjects(objects)
+		res, err := d.Query(ctx, dsq.Query{KeysOnly: true})
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		expectMatches(t, []string{"/a", "/b/c"}, res)
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
+
+	cases := []struct {
+		key    ds.Key
+		expect string
+	}{
+		{ds.Key{}, `invalid key "": keys must start with /`},
+		{ds.RawKey("/"), `invalid key "/": keys can't be empty`},
+		{ds.RawKey("/a//b"), `invalid key "/a//b": keys can't contain empty segments`},
+		{ds.RawKey("/a/../../b"), `invalid key "/a/../../b": keys can't contain relative segments`},
+		{ds.RawKey("/./a"), `invalid key "/./a": keys can't contain relative segments`},
+		{ds.RawKey("/a\x00b"), `invalid key "/a\x00b": keys can't contain control characters`},
+		{ds.NewKey("/a\nb"), `invalid key "/a\nb": keys can't contain control characters`},
+	}
+
+	for i, c := range cases {
+		ops := map[string]func() error{
+			"Put":    func() error { return d.Put(ctx, c.key, []byte("x")) },
+			"Get":    func() error { _, err := d.Get(ctx, c.key); return err },
+			"Has":    func() error { _, err := d.Has(ctx, c.key); return err },
+			"Delete": func() error { return d.Delete(ctx, c.key) },
+		}
+		for name, op := range ops {
+			if err := op(); err == nil || err.Error() != c.expect {
+				t.Errorf("case %d %s error mismatch. expected: %s, got: %v", i, name, c.expect, err)
 			}
-		} else {
-			t.Errorf("%s value isn't []byte: %s", k, v2)
 		}
 	}
+	if len(m.requests) != 0 {
+		t.Errorf("expected invalid keys to make no requests, got: %d", len(m.requests))
+	}
 
+	// cleaned keys can't escape Path
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.Path = "folder"
+	})
+	key := ds.NewKey("/../../a")
+	if err := validKey(key); err != nil {
+		t.Errorf("unexpected error for cleaned key: %s", err)
+	}
+	if p := d.path(key); p != "folder/a" {
+		t.Errorf("path mismatch. expected: folder/a, got: %s", p)
+	}
 }
 
-func TestGet(t *testing.T) {
-	d := newDS(t)
-	expectErrors(func(key ds.Key) error {
-		_, err := d.Get(key)
-		return err
-	}, t)
+func TestShardSuffix(t *testing.T) {
+	cases := []struct {
+		key    string
+		expect string
+	}{
+		{"/CIQABC", "BC"},
+		{"/a/b/CIQXYZ", "YZ"},
+		{"/a", "_a"},
+	}
+
+	shard := ShardSuffix(2)
+	for i, c := range cases {
+		if got := shard(ds.NewKey(c.key)); got != c.expect {
+			t.Errorf("case %d shard mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+	}
 }
 
-func TestHas(t *testing.T) {
-	d := newDS(t)
-	if has, err := d.Has(ds.NewKey("/z")); has != false || err != nil {
-		t.Errorf("has on empty key result mismatch: %t != false || %s != nil", has, err)
+func TestParseShardFunc(t *testing.T) {
+	cases := []struct {
+		spec   string
+		key    string
+		expect string
+		err    string
+	}{
+		{"/repo/flatfs/shard/v1/next-to-last/2", "/CIQABC", "AB", ""},
+		{"/repo/flatfs/shard/v1/next-to-last/2", "/a", "__", ""},
+		{"/repo/flatfs/shard/v1/next-to-last/2", "/ab", "_a", ""},
+		{"next-to-last/3\n", "/CIQABCD", "ABC", ""},
+		{"/repo/flatfs/shard/v1/suffix/2", "/CIQABC", "BC", ""},
+		{"/repo/flatfs/shard/v1/prefix/4", "/CIQABC", "CIQA", ""},
+		{"/repo/flatfs/shard/v1/prefix/4", "/a", "a___", ""},
+		{"/repo/flatfs/shard/v1/middle/2", "", "", `invalid shard function "/repo/flatfs/shard/v1/middle/2": unknown function "middle"`},
+		{"/repo/flatfs/shard/v1/suffix/0", "", "", `invalid shard function "/repo/flatfs/shard/v1/suffix/0": length must be a positive integer`},
+		{"/repo/flatfs/shard/v1/suffix", "", "", `invalid shard function "/repo/flatfs/shard/v1/suffix"`},
+	}
+
+	for i, c := range cases {
+		shard, err := ParseShardFunc(c.spec)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("case %d error mismatch. expected: %s, got: %v", i, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+		if got := shard(ds.NewKey(c.key)); got != c.expect {
+			t.Errorf("case %d shard mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
 	}
 }
 
-func TestDelete(t *testing.T) {
-	d := newDS(t)
-	expectErrors(d.Delete, t)
+func TestShardedPath(t *testing.T) {
+	// CIDv0 & CIDv1 blocks as go-ipfs keys them: base32 encoded multihashes
+	cases := []struct {
+		key    string
+		expect string
+	}{
+		{"/CIQA4T3TD3BP3C2M3GXCGRCRTCCHV7XSGAZPZJOAOHLPOI6IQR3H6YQ", "folder/6Y/CIQA4T3TD3BP3C2M3GXCGRCRTCCHV7XSGAZPZJOAOHLPOI6IQR3H6YQ"},
+		{"/CIQJ7IHPGOFUJT5UMXIW6CUDSNH6AVKMEOXI3UM3VLYJRZUISUMGCXQ", "folder/CX/CIQJ7IHPGOFUJT5UMXIW6CUDSNH6AVKMEOXI3UM3VLYJRZUISUMGCXQ"},
+		{"/AFKREIHDWDCEFGH4DQKJV67UZCMW7OJEE6XEDZDETOJUZJEVTENXQUVYKU", "folder/YK/AFKREIHDWDCEFGH4DQKJV67UZCMW7OJEE6XEDZDETOJUZJEVTENXQUVYKU"},
+		{"/blocks/CIQJ7IHPGOFUJT5UMXIW6CUDSNH6AVKMEOXI3UM3VLYJRZUISUMGCXQ", "folder/CX/blocks/CIQJ7IHPGOFUJT5UMXIW6CUDSNH6AVKMEOXI3UM3VLYJRZUISUMGCXQ"},
+	}
+
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.Path = "folder"
+		o.ShardFunc = ShardNextToLast(2)
+	})
+	for i, c := range cases {
+		got := d.path(ds.NewKey(c.key))
+		if got != c.expect {
+			t.Errorf("case %d path mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+		if key := d.key(got); key.String() != c.key {
+			t.Errorf("case %d key mismatch. expected: %s, got: %s", i, c.key, key)
+		}
+	}
 }
 
-func TestQuery(t *testing.T) {
-	d := newDS(t)
-	addTestCases(t, d, testcases)
+func TestSharding(t *testing.T) {
+	ctx := context.Background()
+
+	d, m := newMockDS(func(o *Options) {
+		o.ShardFunc = ShardSuffix(2)
+	})
+
+	keys := []string{"/a/CIQABC", "/a/CIQXYZ", "/b/CIQABD"}
+	for _, k := range keys {
+		if err := d.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []string{"BC/a/CIQABC", "YZ/a/CIQXYZ", "BD/b/CIQABD"} {
+		if _, ok := m.objects[p]; !ok {
+			t.Errorf("expected object at sharded path %s", p)
+		}
+	}
+
+	for _, k := range keys {
+		v, err := d.Get(ctx, ds.NewKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != k {
+			t.Errorf("value mismatch for key %s. expected: %s, got: %s", k, k, string(v))
+		}
+	}
 
-	rs, err := d.Query(dsq.Query{Prefix: "/a/"})
+	res, err := d.Query(ctx, dsq.Query{Prefix: "/a", Orders: []dsq.Order{dsq.OrderByKey{}}})
 	if err != nil {
 		t.Fatal(err)
 	}
+	expectOrderedMatches(t, []string{"/a/CIQABC", "/a/CIQXYZ"}, res)
+}
 
-	expectMatches(t, []string{
-		"/a/b",
-		"/a/b/c",
-		"/a/b/d",
-		"/a/c",
-		"/a/d",
-	}, rs)
+func TestListPageSize(t *testing.T) {
+	ctx := context.Background()
 
-	// test offset and limit
+	d, m := newMockDS(func(o *Options) {
+		o.ListPageSize = 50
+	})
+	m.addObjects(map[string]string{"a": "a", "b": "b"})
 
-	rs, err = d.Query(dsq.Query{Prefix: "/a/", Offset: 2, Limit: 2})
+	res, err := d.Query(ctx, dsq.Query{KeysOnly: true})
 	if err != nil {
 		t.Fatal(err)
 	}
+	expectMatches(t, []string{"/a", "/b"}, res)
+	if len(m.lists) != 1 || aws.Int64Value(m.lists[0].MaxKeys) != 50 {
+		t.Errorf("max-keys mismatch. expected: 1 request of 50, got: %d requests", len(m.lists))
+	}
 
-	expectMatches(t, []string{
-		// TODO - this returns a different result due to the behaviour of s3's list objects
-		// "/a/b/d",
-		"/a/d",
-		"/a/c",
-	}, rs)
+	if err := NewDatastore(bucketName).configError(); err != nil {
+		t.Errorf("unexpected config error for default page size: %s", err)
+	}
+	for i, size := range []int{0, -1, 1001} {
+		d := NewDatastore(bucketName, func(o *Options) {
+			o.ListPageSize = size
+		})
+		expect := fmt.Sprintf("ListPageSize must be between 1 and 1000, got: %d", size)
+		if err := d.configError(); err == nil || err.Error() != expect {
+			t.Errorf("case %d config error mismatch. expected: %s, got: %v", i, expect, err)
+		}
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
+	m.addObjects(map[string]string{"a": "a", "a/b": "ab", "a/c": "ac", "ab": "ab", "d": "d"})
+
+	cases := []struct {
+		prefix string
+		expect []string
+	}{
+		{"", []string{"/a", "/a/b", "/a/c", "/ab", "/d"}},
+		{"/", []string{"/a", "/a/b", "/a/c", "/ab", "/d"}},
+		{"/a/", []string{"/a/b", "/a/c"}},
+		{"/a", []string{"/a", "/a/b", "/a/c", "/ab"}},
+		{"/z", []string{}},
+	}
+
+	for i, c := range cases {
+		keys, err := d.ListKeys(ctx, c.prefix)
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		got := make([]string, len(keys))
+		for j, k := range keys {
+			got[j] = k.String()
+		}
+		if strings.Join(got, ",") != strings.Join(c.expect, ",") {
+			t.Errorf("case %d keys mismatch. expected: %v, got: %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestQueryPagination(t *testing.T) {
+	ctx := context.Background()
+	// small pages require several list requests to return every key
+	d, m := newMockDS(func(o *Options) {
+		o.ListPageSize = 100
+	})
+
+	pages := map[string]string{}
+	for i := 0; i < 1050; i++ {
+		pages[fmt.Sprintf("/pages/%04d", i)] = fmt.Sprintf("%d", i)
+	}
+	addTestCases(t, d, pages)
+
+	rs, err := d.Query(ctx, dsq.Query{Prefix: "/pages/", KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rs.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(pages) {
+		t.Errorf("keys only query length mismatch. expected: %d, got: %d", len(pages), len(entries))
+	}
+	if len(m.lists) != 11 {
+		t.Errorf("list request count mismatch. expected: 11, got: %d", len(m.lists))
+	}
 
+	rs, err = d.Query(ctx, dsq.Query{Prefix: "/pages/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = rs.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(pages) {
+		t.Errorf("query length mismatch. expected: %d, got: %d", len(pages), len(entries))
+	}
+	for _, e := range entries {
+		if v, ok := pages[e.Key]; !ok || string(e.Value) != v {
+			t.Errorf("entry %s value mismatch: '%s' != '%s'", e.Key, v, e.Value)
+		}
+	}
 }
 
 func TestQueryRespectsProcess(t *testing.T) {
-	d := newDS(t)
-	addTestCases(t, d, testcases)
+	d, m := newMockDS(func(o *Options) {
+		o.QueryConcurrency = 2
+		o.ListPageSize = 10
+	})
+	for i := 0; i < 1000; i++ {
+		m.objects[fmt.Sprintf("%04d", i)] = []byte("value")
+	}
+
+	// expectClosed fails unless the query's process finishes closing promptly
+	expectClosed := func(name string, res dsq.Results) {
+		select {
+		case <-res.Process().Closed():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: expected query to stop", name)
+		}
+		m.lk.Lock()
+		defer m.lk.Unlock()
+		if len(m.lists) >= 100 {
+			t.Errorf("%s: expected listing to stop early, got %d list requests", name, len(m.lists))
+		}
+	}
+
+	res, err := d.Query(context.Background(), dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := res.NextSync(); !ok || r.Error != nil {
+		t.Fatalf("expected a result, got: %v", r.Error)
+	}
+	go res.Close()
+	expectClosed("closing results", res)
+
+	m.lk.Lock()
+	m.lists = nil
+	m.lk.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	res, err = d.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	expectClosed("canceling query", res)
+}
+
+// pageBlockingS3 blocks requests for any list page after the first until released
+type pageBlockingS3 struct {
+	*mockS3
+	listing chan struct{}
+	release chan struct{}
+}
+
+func (m *pageBlockingS3) ListObjectsV2WithContext(ctx aws.Context, input *awsS3.ListObjectsV2Input, opts ...request.Option) (*awsS3.ListObjectsV2Output, error) {
+	if input.ContinuationToken != nil {
+		select {
+		case m.listing <- struct{}{}:
+		default:
+		}
+		<-m.release
+	}
+	return m.mockS3.ListObjectsV2WithContext(ctx, input, opts...)
+}
+
+func TestQueryListsAhead(t *testing.T) {
+	m := &pageBlockingS3{mockS3: newMockS3(), listing: make(chan struct{}, 1), release: make(chan struct{})}
+	for i := 0; i < 30; i++ {
+		m.objects[fmt.Sprintf("%04d", i)] = []byte("value")
+	}
+	d := NewDatastore(bucketName, func(o *Options) {
+		o.S3API = m
+		o.QueryConcurrency = 2
+		o.ListPageSize = 10
+	})
+
+	res, err := d.Query(context.Background(), dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+
+	// the second page is requested before any values from the first are consumed
+	select {
+	case <-m.listing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the next page to be listed while fetching values")
+	}
+	r, ok := res.NextSync()
+	if !ok || r.Error != nil {
+		t.Fatalf("expected a result before the listing completed, got: %v", r.Error)
+	}
+	if r.Key != "/0000" {
+		t.Errorf("first result key mismatch. expected: %s, got: %s", "/0000", r.Key)
+	}
+
+	close(m.release)
+	rest, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 29 {
+		t.Errorf("result count mismatch. expected: %d, got: %d", 29, len(rest))
+	}
 }
 
 func expectMatches(t *testing.T, expect []string, actualR dsq.Results) {
@@ -134,6 +3785,24 @@ func expectMatches(t *testing.T, expect []string, actualR dsq.Results) {
 	}
 }
 
+func expectOrderedMatches(t *testing.T, expect []string, actualR dsq.Results) {
+	actual, err := actualR.Rest()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(actual) != len(expect) {
+		t.Error("length mismatch", expect, actual)
+		return
+	}
+
+	for i, e := range actual {
+		if e.Key != expect[i] {
+			t.Errorf("entry %d mismatch. expected: %s, got: %s", i, expect[i], e.Key)
+		}
+	}
+}
+
 func expectErrors(fn func(key ds.Key) error, t *testing.T) {
 	errCases := []struct {
 		key   string
@@ -160,35 +3829,35 @@ func expectErrors(fn func(key ds.Key) error, t *testing.T) {
 	}
 }
 
-// TODO
-// func TestBatching(t *testing.T) {
-// 	d := newDS(t)
+func TestBatching(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newMockDS()
 
-// 	b, err := d.Batch()
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-// 	for k, v := range testcases {
-// 		err := b.Put(ds.NewKey(k), []byte(v))
-// 		if err != nil {
-// 			t.Fatal(err)
-// 		}
-// 	}
+	for k, v := range testcases {
+		err := b.Put(ctx, ds.NewKey(k), []byte(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
 
-// 	err = b.Commit()
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
+	err = b.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-// 	for k, v := range testcases {
-// 		val, err := d.Get(ds.NewKey(k))
-// 		if err != nil {
-// 			t.Fatal(err)
-// 		}
+	for k, v := range testcases {
+		val, err := d.Get(ctx, ds.NewKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
 
-// 		if v != string(val.([]byte)) {
-// 			t.Fatal("got wrong data!")
-// 		}
-// 	}
-// }
+		if v != string(val) {
+			t.Fatal("got wrong data!")
+		}
+	}
+}
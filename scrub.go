@@ -0,0 +1,85 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+	datastore "github.com/ipfs/go-datastore"
+)
+
+// assert *Datastore satisfies datastore.ScrubbedDatastore interface at compile time
+var _ datastore.ScrubbedDatastore = (*Datastore)(nil)
+
+// Scrub checks every object in the store is retrievable, returning the first object that
+// isn't. By default Scrub only fetches object metadata with a HEAD request per object.
+// With ScrubBodies set Scrub downloads every object instead, verifying its contents
+// against its ETag when the ETag is an MD5 of the object. Scrubbing lists the entire
+// store and makes a request per object, so it's slow & costly on large stores
+func (ds *Datastore) Scrub(ctx context.Context) error {
+	var scrubErr error
+	err := ds.eachObject(ctx, "", "", func(obj *awsS3.Object) bool {
+		if ds.scrubBodies {
+			scrubErr = ds.scrubBody(ctx, obj.Key)
+		} else {
+			scrubErr = ds.scrubMetadata(ctx, obj.Key)
+		}
+		if scrubErr != nil {
+			scrubErr = fmt.Errorf("scrubbing %s: %s", ds.key(aws.StringValue(obj.Key)), scrubErr)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return scrubErr
+}
+
+// scrubMetadata confirms the object at path can be retrieved
+func (ds *Datastore) scrubMetadata(ctx context.Context, path *string) error {
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	c, err := ds.client()
+	if err != nil {
+		return err
+	}
+	_, err = c.HeadObjectWithContext(ctx, &awsS3.HeadObjectInput{
+		Bucket:       aws.String(ds.Bucket),
+		RequestPayer: ds.requestPayer(),
+		Key:          path,
+	})
+	return ctxErr(ctx, err)
+}
+
+// scrubBody downloads the object at path, checking it against its ETag
+func (ds *Datastore) scrubBody(ctx context.Context, path *string) error {
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	c, err := ds.client()
+	if err != nil {
+		return err
+	}
+	res, err := c.GetObjectWithContext(ctx, &awsS3.GetObjectInput{
+		Bucket:       aws.String(ds.Bucket),
+		RequestPayer: ds.requestPayer(),
+		Key:          path,
+	})
+	if err != nil {
+		return ctxErr(ctx, err)
+	}
+
+	var body io.ReadCloser = res.Body
+	if etagIsMD5(res) {
+		body = newMD5ReadCloser(body, aws.StringValue(res.ETag))
+	}
+	defer body.Close()
+
+	_, err = io.Copy(ioutil.Discard, body)
+	return ctxErr(ctx, err)
+}
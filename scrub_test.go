@@ -0,0 +1,45 @@
+package s3
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestScrubMetadata(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]string{"a": "a", "b/c": "c"}
+
+	d, m := newMockDS()
+	m.addObjects(objects)
+	if err := d.Scrub(ctx); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	d, m = newMockDS()
+	m.addObjects(objects)
+	m.fail = map[string]bool{"b/c": true}
+	if err := d.Scrub(ctx); err == nil || !strings.HasPrefix(err.Error(), "scrubbing /b/c: ") {
+		t.Errorf("expected unretrievable object error, got: %v", err)
+	}
+}
+
+func TestScrubBodies(t *testing.T) {
+	ctx := context.Background()
+
+	d, m := newMockDS(func(o *Options) {
+		o.ScrubBodies = true
+	})
+	m.addObjects(map[string]string{"intact": "hello"})
+
+	if err := d.Scrub(ctx); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// corrupt has the ETag of a different value
+	m.addObjects(map[string]string{"corrupt": "hello"})
+	m.etags["corrupt"] = `"7d793037a0760186574b0282f2f435e7"`
+	if err := d.Scrub(ctx); err == nil || !strings.HasPrefix(err.Error(), "scrubbing /corrupt: checksum mismatch") {
+		t.Errorf("expected checksum mismatch error, got: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package s3
+
+import (
+	"context"
+
+	datastore "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+)
+
+// assert *Datastore satisfies datastore.TxnDatastore interface at compile time
+var _ datastore.TxnDatastore = (*Datastore)(nil)
+
+// Txn buffers writes & deletes until Commit, reading its own pending writes. S3 has no
+// transactions, so a Txn is neither atomic nor isolated: reads see writes committed by
+// others as they happen, and a commit that fails part way leaves the writes made before
+// the failure in place. Queries ignore pending writes
+type Txn struct {
+	ds       *Datastore
+	readOnly bool
+	puts     map[datastore.Key][]byte
+	deletes  map[datastore.Key]struct{}
+}
+
+// assert *Txn satisfies datastore.Txn interface at compile time
+var _ datastore.Txn = (*Txn)(nil)
+
+// NewTransaction creates a transaction. Writes to a read-only transaction, or any
+// transaction on a ReadOnly datastore, fail with ErrReadOnly
+func (ds *Datastore) NewTransaction(ctx context.Context, readOnly bool) (datastore.Txn, error) {
+	if ds.isClosed() {
+		return nil, ErrClosed
+	}
+	return &Txn{
+		ds:       ds,
+		readOnly: readOnly || ds.readOnly,
+		puts:     map[datastore.Key][]byte{},
+		deletes:  map[datastore.Key]struct{}{},
+	}, nil
+}
+
+// Get reads a pending write to key, falling back to the store
+func (t *Txn) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	if value, ok := t.puts[key]; ok {
+		return value, nil
+	}
+	if _, ok := t.deletes[key]; ok {
+		return nil, datastore.ErrNotFound
+	}
+	return t.ds.Get(ctx, key)
+}
+
+// Has checks pending writes for key, falling back to the store
+func (t *Txn) Has(ctx context.Context, key datastore.Key) (bool, error) {
+	if _, ok := t.puts[key]; ok {
+		return true, nil
+	}
+	if _, ok := t.deletes[key]; ok {
+		return false, nil
+	}
+	return t.ds.Has(ctx, key)
+}
+
+// GetSize checks pending writes for key, falling back to the store
+func (t *Txn) GetSize(ctx context.Context, key datastore.Key) (int, error) {
+	if value, ok := t.puts[key]; ok {
+		return len(value), nil
+	}
+	if _, ok := t.deletes[key]; ok {
+		return -1, datastore.ErrNotFound
+	}
+	return t.ds.GetSize(ctx, key)
+}
+
+// Query the store, ignoring pending writes
+func (t *Txn) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	return t.ds.Query(ctx, q)
+}
+
+// Put adds a value to the transaction, replacing any pending operation on key
+func (t *Txn) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	if err := validKey(key); err != nil {
+		return err
+	}
+
+	delete(t.deletes, key)
+	t.puts[key] = value
+	return nil
+}
+
+// Delete adds a key removal to the transaction, replacing any pending operation on key
+func (t *Txn) Delete(ctx context.Context, key datastore.Key) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	if err := validKey(key); err != nil {
+		return err
+	}
+
+	delete(t.puts, key)
+	t.deletes[key] = struct{}{}
+	return nil
+}
+
+// Commit writes pending puts concurrently like PutMany, then removes pending deletes with DeleteMany.
+// Successfully committed operations are dropped from the transaction, so a failed commit
+// can be retried
+func (t *Txn) Commit(ctx context.Context) error {
+	if len(t.puts) > 0 {
+		errs := t.ds.putMany(ctx, t.puts)
+		for key := range t.puts {
+			if _, failed := errs[key]; !failed {
+				delete(t.puts, key)
+			}
+		}
+		if len(errs) > 0 {
+			return errs
+		}
+	}
+
+	if len(t.deletes) > 0 {
+		keys := make([]datastore.Key, 0, len(t.deletes))
+		for key := range t.deletes {
+			keys = append(keys, key)
+		}
+		if err := t.ds.DeleteMany(ctx, keys); err != nil {
+			return err
+		}
+		t.deletes = map[datastore.Key]struct{}{}
+	}
+
+	return nil
+}
+
+// Discard drops all pending operations
+func (t *Txn) Discard(ctx context.Context) {
+	t.puts = map[datastore.Key][]byte{}
+	t.deletes = map[datastore.Key]struct{}{}
+}
@@ -0,0 +1,104 @@
+package s3
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestTxnReadYourWrites(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
+	m.addObjects(map[string]string{"a": "a", "b": "b"})
+
+	txn, err := d.NewTransaction(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, ds.NewKey("/a"), []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, ds.NewKey("/c"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete(ctx, ds.NewKey("/b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := txn.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "changed" {
+		t.Errorf("expected transaction to read its own put. got: %q, err: %v", v, err)
+	}
+	if has, err := txn.Has(ctx, ds.NewKey("/c")); err != nil || !has {
+		t.Errorf("expected transaction to have its own put. got: %t, err: %v", has, err)
+	}
+	if _, err := txn.Get(ctx, ds.NewKey("/b")); err != ds.ErrNotFound {
+		t.Errorf("expected transaction to read its own delete. expected: %s, got: %v", ds.ErrNotFound, err)
+	}
+	if size, err := txn.GetSize(ctx, ds.NewKey("/a")); err != nil || size != 7 {
+		t.Errorf("size mismatch. expected: 7, got: %d, err: %v", size, err)
+	}
+
+	// nothing is written until commit
+	if string(m.objects["a"]) != "a" || string(m.objects["b"]) != "b" || m.objects["c"] != nil {
+		t.Errorf("expected writes to be buffered, got: %v", m.objects)
+	}
+
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.objects["a"]) != "changed" || string(m.objects["c"]) != "c" {
+		t.Errorf("expected puts to be committed, got: %v", m.objects)
+	}
+	if _, ok := m.objects["b"]; ok {
+		t.Errorf("expected delete to be committed, got: %v", m.objects)
+	}
+}
+
+func TestTxnDiscard(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
+	m.addObjects(map[string]string{"a": "a"})
+
+	txn, err := d.NewTransaction(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, ds.NewKey("/a"), []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, ds.NewKey("/b"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	txn.Discard(ctx)
+
+	if v, err := txn.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "a" {
+		t.Errorf("expected discarded put to be dropped. got: %q, err: %v", v, err)
+	}
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.objects["a"]) != "a" || len(m.objects) != 1 {
+		t.Errorf("expected discarded transaction to write nothing, got: %v", m.objects)
+	}
+}
+
+func TestTxnReadOnly(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS()
+	m.addObjects(map[string]string{"a": "a"})
+
+	txn, err := d.NewTransaction(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, ds.NewKey("/a"), []byte("b")); err != ErrReadOnly {
+		t.Errorf("put error mismatch. expected: %s, got: %v", ErrReadOnly, err)
+	}
+	if err := txn.Delete(ctx, ds.NewKey("/a")); err != ErrReadOnly {
+		t.Errorf("delete error mismatch. expected: %s, got: %v", ErrReadOnly, err)
+	}
+	if v, err := txn.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "a" {
+		t.Errorf("get mismatch. expected: a, got: %q, err: %v", v, err)
+	}
+}
@@ -0,0 +1,114 @@
+package s3
+
+import (
+	"context"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsS3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	datastore "github.com/ipfs/go-datastore"
+)
+
+// PutStream writes the contents of r to key with a multipart upload, buffering at most
+// MultipartConcurrency parts in memory instead of the entire stream. The value passed to
+// ContentTypeFunc and MetadataFunc is always nil for streamed writes
+func (ds *Datastore) PutStream(ctx context.Context, key datastore.Key, r io.Reader) error {
+	if ds.readOnly {
+		return ErrReadOnly
+	}
+
+	input, err := ds.putObjectInput(key, nil)
+	if err != nil {
+		return err
+	}
+	if ds.dryRun {
+		ds.logDryRun("PutStream", key)
+		return nil
+	}
+
+	ctx, cancel := ds.withTimeout(ctx)
+	defer cancel()
+
+	upload := uploadInput(input)
+	upload.Body = r
+	var gz *gzipPipe
+	if aws.StringValue(input.ContentEncoding) == gzipEncoding {
+		gz = gzipStream(r)
+		upload.Body = gz
+	}
+	_, err = ds.upload(ctx, key, upload, -1)
+	if gz != nil {
+		// a failed upload stops reading the stream, leaving compression blocked on the pipe
+		gz.CloseWithError(err)
+	}
+	if err != nil {
+		return err
+	}
+	ds.recordWrite(key)
+	return nil
+}
+
+// maxPutObjectSize is the largest value S3 accepts in a single PutObject request. It's a
+// variable so tests can lower it
+var maxPutObjectSize int64 = 5 << 30
+
+// multipart reports whether a value of size bytes should be written with a multipart upload
+func (ds *Datastore) multipart(size int) bool {
+	if ds.multipartThreshold <= 0 {
+		return false
+	}
+	return int64(size) > ds.multipartThreshold || int64(size) > maxPutObjectSize
+}
+
+// checkSize rejects values too large to write with a single PutObject request that won't be
+// uploaded in parts
+func (ds *Datastore) checkSize(size int) error {
+	if !ds.multipart(size) && int64(size) > maxPutObjectSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// upload writes an object of size bytes to key with a multipart upload, sending parts
+// concurrently, returning the ID of the object version created. size is -1 if unknown
+func (ds *Datastore) upload(ctx context.Context, key datastore.Key, input *s3manager.UploadInput, size int64) (versionID string, err error) {
+	c, err := ds.client()
+	if err != nil {
+		return "", err
+	}
+	uploader := s3manager.NewUploaderWithClient(ds.withProgress(c, key, size), func(u *s3manager.Uploader) {
+		if ds.partSize > 0 {
+			u.PartSize = ds.partSize
+		}
+		if ds.partConcurrency > 0 {
+			u.Concurrency = ds.partConcurrency
+		}
+	})
+
+	res, err := uploader.UploadWithContext(ctx, input)
+	if err != nil {
+		return "", ctxErr(ctx, err)
+	}
+	return aws.StringValue(res.VersionID), nil
+}
+
+// uploadInput converts a PutObject request to an equivalent multipart upload request
+func uploadInput(input *awsS3.PutObjectInput) *s3manager.UploadInput {
+	return &s3manager.UploadInput{
+		ACL:                       input.ACL,
+		Body:                      input.Body,
+		Bucket:                    input.Bucket,
+		ContentEncoding:           input.ContentEncoding,
+		ContentType:               input.ContentType,
+		Key:                       input.Key,
+		Metadata:                  input.Metadata,
+		RequestPayer:              input.RequestPayer,
+		ObjectLockMode:            input.ObjectLockMode,
+		ObjectLockRetainUntilDate: input.ObjectLockRetainUntilDate,
+		SSEKMSKeyId:               input.SSEKMSKeyId,
+		ServerSideEncryption:      input.ServerSideEncryption,
+		StorageClass:              input.StorageClass,
+		Tagging:                   input.Tagging,
+	}
+}
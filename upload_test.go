@@ -0,0 +1,153 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestMultipartPut(t *testing.T) {
+	ctx := context.Background()
+	d, m := newMockDS(func(o *Options) {
+		o.MultipartThreshold = s3manager.MinUploadPartSize
+		o.MultipartPartSize = s3manager.MinUploadPartSize
+	})
+
+	if d.multipart(int(s3manager.MinUploadPartSize)) {
+		t.Error("expected values at the threshold to use a single request")
+	}
+
+	// large enough to be split into three parts
+	value := bytes.Repeat([]byte("multipart"), int(s3manager.MinUploadPartSize)*2/9+1024)
+	key := ds.NewKey("/multipart/large")
+	if !d.multipart(len(value)) {
+		t.Fatal("expected values above the threshold to use a multipart upload")
+	}
+	if err := d.Put(ctx, key, value); err != nil {
+		t.Fatal(err)
+	}
+	if parts := m.parts[d.path(key)]; parts != 3 {
+		t.Errorf("part count mismatch. expected: 3, got: %d", parts)
+	}
+	if !bytes.Equal(m.objects[d.path(key)], value) {
+		t.Errorf("uploaded value mismatch. expected %d bytes, got %d bytes", len(value), len(m.objects[d.path(key)]))
+	}
+
+	got, err := d.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("multipart value mismatch. expected %d bytes, got %d bytes", len(value), len(got))
+	}
+
+	// a part failing to upload aborts the upload, leaving no object behind
+	m.failPart = 2
+	failed := ds.NewKey("/multipart/failed")
+	if err := d.Put(ctx, failed, value); err == nil {
+		t.Error("expected a failed part to fail the put")
+	}
+	if m.aborts != 1 {
+		t.Errorf("abort count mismatch. expected: 1, got: %d", m.aborts)
+	}
+	if len(m.uploads) != 0 {
+		t.Errorf("expected no uploads in progress, got: %d", len(m.uploads))
+	}
+	if _, ok := m.objects[d.path(failed)]; ok {
+		t.Error("expected a failed upload not to write an object")
+	}
+}
+
+func TestValueTooLarge(t *testing.T) {
+	ctx := context.Background()
+	defer func(max int64) { maxPutObjectSize = max }(maxPutObjectSize)
+	maxPutObjectSize = 10
+
+	d, m := newMockDS(func(o *Options) {
+		o.MultipartThreshold = 0
+	})
+	if err := d.Put(ctx, ds.NewKey("/a"), bytes.Repeat([]byte("a"), 10)); err != nil {
+		t.Errorf("unexpected error writing a value at the limit: %s", err)
+	}
+	large := bytes.Repeat([]byte("b"), 11)
+	if err := d.Put(ctx, ds.NewKey("/b"), large); err != ErrValueTooLarge {
+		t.Errorf("put error mismatch. expected: %s, got: %v", ErrValueTooLarge, err)
+	}
+	if _, err := d.PutIfAbsent(ctx, ds.NewKey("/b"), large); err != ErrValueTooLarge {
+		t.Errorf("put if absent error mismatch. expected: %s, got: %v", ErrValueTooLarge, err)
+	}
+	if _, ok := m.objects["b"]; ok {
+		t.Error("expected oversized value not to be written")
+	}
+
+	// values over the limit are uploaded in parts, regardless of the threshold
+	d = NewDatastore(bucketName, func(o *Options) {
+		o.Region = "us-east-1"
+		o.MultipartThreshold = 100
+	})
+	if !d.multipart(len(large)) {
+		t.Error("expected values over the PutObject limit to use a multipart upload")
+	}
+	if err := d.checkSize(len(large)); err != nil {
+		t.Errorf("unexpected error checking a multipart value: %s", err)
+	}
+}
+
+func TestPutStream(t *testing.T) {
+	ctx := context.Background()
+	// random values don't compress, so compressed streams are still uploaded in parts
+	value := make([]byte, s3manager.MinUploadPartSize*2+1024)
+	rand.New(rand.NewSource(1)).Read(value)
+
+	cases := []struct {
+		compression string
+		encoding    string
+	}{
+		{"", ""},
+		{gzipEncoding, gzipEncoding},
+	}
+	for i, c := range cases {
+		d, m := newMockDS(func(o *Options) {
+			o.Compression = c.compression
+		})
+		// hide the underlying bytes.Reader so the uploader can only treat r as a stream
+		r := struct{ io.Reader }{bytes.NewReader(value)}
+
+		key := ds.NewKey("/stream/a")
+		if err := d.PutStream(ctx, key, r); err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if parts := m.parts[d.path(key)]; parts != 3 {
+			t.Errorf("case %d part count mismatch. expected: 3, got: %d", i, parts)
+		}
+		if encoding := m.encodings[d.path(key)]; encoding != c.encoding {
+			t.Errorf("case %d encoding mismatch. expected: %q, got: %q", i, c.encoding, encoding)
+		}
+
+		got, err := d.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("case %d unexpected error: %s", i, err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("case %d streamed value mismatch. expected %d bytes, got %d bytes", i, len(value), len(got))
+		}
+
+		// a failed upload stops reading the stream, aborting the upload
+		m.failPart = 2
+		failed := ds.NewKey("/stream/failed")
+		if err := d.PutStream(ctx, failed, struct{ io.Reader }{bytes.NewReader(value)}); err == nil {
+			t.Errorf("case %d expected a failed part to fail the put", i)
+		}
+		if m.aborts != 1 {
+			t.Errorf("case %d abort count mismatch. expected: 1, got: %d", i, m.aborts)
+		}
+		if _, ok := m.objects[d.path(failed)]; ok {
+			t.Errorf("case %d expected a failed upload not to write an object", i)
+		}
+	}
+}